@@ -0,0 +1,171 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+var errNoSMTPUTF8 = errors.New("strew: relay does not support SMTPUTF8")
+
+// normalize returns the canonical form of the mailbox of addr, so that the
+// different spellings of an address designate the same subscriber:
+//   - the display name is dropped,
+//   - the local part is NFC normalized,
+//   - the domain is lowercased, and IDNs are converted to U-labels,
+//   - the local part is lowercased if fold_local_part is set,
+//   - the +tag of the local part is dropped for the plus_domains,
+//   - the dots of the local part are dropped for the dot_domains.
+func (srv *Server) normalize(addr string) (string, error) {
+	v, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "strew: invalid address %q", addr)
+	}
+	i := strings.LastIndex(v.Address, "@")
+	if i < 0 {
+		return "", errors.Errorf("strew: invalid address %q", addr)
+	}
+	local, domain := norm.NFC.String(v.Address[:i]), normalizeDomain(v.Address[i+1:])
+
+	if srv.cfg.FoldLocalPart {
+		local = strings.ToLower(local)
+	}
+	if matchDomain(srv.cfg.PlusDomains, domain) {
+		if j := strings.Index(local, "+"); j > 0 {
+			local = local[:j]
+		}
+	}
+	if matchDomain(srv.cfg.DotDomains, domain) {
+		local = strings.Replace(local, ".", "", -1)
+	}
+	return local + "@" + domain, nil
+}
+
+// normalizeDomain returns the lowercased Unicode form of domain, so that the
+// A-labels (xn--) and U-labels spellings of an IDN are the same.
+func normalizeDomain(domain string) string {
+	v, err := idna.Lookup.ToUnicode(domain)
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return v
+}
+
+// envelopeAddress returns the address of addr to use in SMTP commands.
+// Without SMTPUTF8 support, IDNs are converted to A-labels, and addresses
+// with a non-ASCII local part can not be used.
+func envelopeAddress(addr string, smtputf8 bool) (string, error) {
+	v, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "strew: invalid address %q", addr)
+	}
+	if smtputf8 || isASCII(v.Address) {
+		return v.Address, nil
+	}
+	return asciiAddress(v.Address)
+}
+
+// asciiAddress converts the domain of addr to A-labels.
+func asciiAddress(addr string) (string, error) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return "", errors.Errorf("strew: invalid address %q", addr)
+	}
+	local, domain := addr[:i], addr[i+1:]
+	if !isASCII(local) {
+		return "", errors.Wrapf(errNoSMTPUTF8, "can not send to %q", addr)
+	}
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", errors.Wrapf(err, "strew: invalid domain in %q", addr)
+	}
+	return local + "@" + domain, nil
+}
+
+// asciiAddressList converts the IDNs of a list of addresses to A-labels,
+// for relays without SMTPUTF8 support. Addresses with a non-ASCII local
+// part are left as is.
+func asciiAddressList(list string) string {
+	if isASCII(list) {
+		return list
+	}
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil {
+		return list
+	}
+	vs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if v, err := asciiAddress(addr.Address); err == nil {
+			addr.Address = v
+		}
+		vs[i] = addr.String()
+	}
+	return strings.Join(vs, ", ")
+}
+
+// sameAddress reports whether a and b designate the same mailbox.
+func (srv *Server) sameAddress(a, b string) bool {
+	na, err := srv.normalize(a)
+	if err != nil {
+		return false
+	}
+	nb, err := srv.normalize(b)
+	if err != nil {
+		return false
+	}
+	return na == nb
+}
+
+// matchDomain reports whether domain is one of domains, "*" matching all
+// domains.
+func matchDomain(domains []string, domain string) bool {
+	for _, v := range domains {
+		if v == "*" || strings.EqualFold(v, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupSubscription returns the subscription of user to list.
+// Subscribers are stored with their address as given, so that mail is
+// delivered to it: they are matched by their normalized address.
+// The members of list are only read if neither the address as given nor
+// its normalized form is subscribed.
+func (srv *Server) lookupSubscription(ctx context.Context, user, list string) (database.Subscription, error) {
+	var sub database.Subscription
+	norm, err := srv.normalize(user)
+	if err != nil {
+		return sub, err
+	}
+	v, err := mail.ParseAddress(user)
+	if err != nil {
+		return sub, errors.WithStack(err)
+	}
+	for _, addr := range []string{v.Address, norm} {
+		sub, err = srv.db.Subscription(ctx, addr, list)
+		if errors.Cause(err) != database.ErrNotSubscribed {
+			return sub, err
+		}
+	}
+
+	users, err := srv.db.Subscribers(ctx, list)
+	if err != nil {
+		return sub, err
+	}
+	for _, addr := range users {
+		if v, err := srv.normalize(addr); err == nil && v == norm {
+			return srv.db.Subscription(ctx, addr, list)
+		}
+	}
+	return sub, database.ErrNotSubscribed
+}
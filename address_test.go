@@ -0,0 +1,200 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+	_ "github.com/sbinet-alt63/strew/database/memdb"
+)
+
+func TestNormalize(t *testing.T) {
+	srv := &Server{cfg: Config{
+		PlusDomains: []string{"example.org", "gmail.com"},
+		DotDomains:  []string{"gmail.com"},
+	}}
+	fold := &Server{cfg: Config{FoldLocalPart: true, PlusDomains: []string{"*"}}}
+
+	for _, tc := range []struct {
+		srv  *Server
+		addr string
+		want string
+		err  bool
+	}{
+		{srv: srv, addr: "alice@example.com", want: "alice@example.com"},
+		{srv: srv, addr: "Alice <alice@EXAMPLE.com>", want: "alice@example.com"},
+		{srv: srv, addr: "Alice@example.com", want: "Alice@example.com"},
+		{srv: srv, addr: "alice+lists@example.com", want: "alice+lists@example.com"},
+		{srv: srv, addr: "alice+lists@Example.ORG", want: "alice@example.org"},
+		{srv: srv, addr: "a.l.ice+go@gmail.com", want: "alice@gmail.com"},
+		{srv: srv, addr: "+tag@example.org", want: "+tag@example.org"},
+		{srv: fold, addr: "\"Bob\" <Bob+x@Example.COM>", want: "bob@example.com"},
+		{srv: srv, addr: "not an address", err: true},
+	} {
+		got, err := tc.srv.normalize(tc.addr)
+		if (err != nil) != tc.err {
+			t.Fatalf("%q: invalid error: %v", tc.addr, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: got=%q, want=%q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+// noScan is a Store failing the tests reading the members of a list.
+type noScan struct {
+	database.Store
+	t *testing.T
+}
+
+func (db noScan) Subscribers(ctx context.Context, list string) ([]string, error) {
+	db.t.Fatalf("members of %q were read", list)
+	return nil, nil
+}
+
+func (db noScan) Members(ctx context.Context, list string) ([]database.Subscription, error) {
+	db.t.Fatalf("members of %q were read", list)
+	return nil, nil
+}
+
+func TestSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, list := range []string{"golang", "rust", "cobol"} {
+		db.AddList(ctx, list)
+	}
+	db.Subscribe(ctx, "Alice.Smith+go@Gmail.com", "golang")
+	// subscriptions stored in their normalized form.
+	db.Subscribe(ctx, "alicesmith@gmail.com", "rust")
+	// lists missing from the configuration are not reported.
+	db.Subscribe(ctx, "alicesmith@gmail.com", "cobol")
+
+	srv := &Server{
+		cfg: Config{
+			FoldLocalPart: true,
+			PlusDomains:   []string{"gmail.com"},
+			DotDomains:    []string{"gmail.com"},
+			Lists: map[string]*List{
+				"golang@example.com": {ID: "golang"},
+				"rust@example.com":   {ID: "rust"},
+			},
+		},
+		db: noScan{db, t},
+	}
+
+	for _, tc := range []struct {
+		user string
+		want map[string]bool
+	}{
+		{"Alice <Alice.Smith+go@Gmail.com>", map[string]bool{"golang": true, "rust": true}},
+		{"alice.smith@gmail.com", map[string]bool{"rust": true}},
+		{"bob@example.com", map[string]bool{}},
+	} {
+		got, err := srv.subscriptions(ctx, tc.user)
+		if err != nil {
+			t.Fatalf("%q: could not get subscriptions: %+v", tc.user, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%q: invalid subscriptions: got=%v, want=%v", tc.user, got, tc.want)
+		}
+	}
+	if _, err := srv.subscriptions(ctx, "not an address"); err != (rejection{"invalid address"}) {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestSubscriberLookup(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddList(ctx, "golang")
+	srv := &Server{
+		cfg: Config{
+			FoldLocalPart: true,
+			PlusDomains:   []string{"gmail.com"},
+			DotDomains:    []string{"gmail.com"},
+			Lists:         map[string]*List{"golang@example.com": {ID: "golang"}},
+		},
+		db: db,
+	}
+
+	for _, user := range []string{"Alice <Alice.Smith+go@Gmail.com>", "bob@EXAMPLE.com"} {
+		err = srv.subscribe(ctx, user, "golang")
+		if err != nil {
+			t.Fatalf("could not subscribe %q: %+v", user, err)
+		}
+	}
+
+	// mail is delivered to the addresses as given.
+	got, err := db.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Alice.Smith+go@Gmail.com", "bob@EXAMPLE.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid subscribers:\ngot= %q\nwant=%q", got, want)
+	}
+
+	// other spellings designate the same subscribers.
+	for _, user := range []string{"alicesmith@gmail.com", "Alice <alice.smith+lists@GMAIL.COM>", "Bob@example.com"} {
+		if ok, err := srv.isSubscribed(ctx, user, "golang"); err != nil || !ok {
+			t.Fatalf("%q should be subscribed (err=%v)", user, err)
+		}
+	}
+	if _, err := srv.isSubscribed(ctx, "not an address", "golang"); err != (rejection{"invalid address"}) {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if ok, err := srv.canPost(ctx, &Message{From: "ALICE <alicesmith@gmail.COM>"}, &List{ID: "golang", Posters: []string{"alice.smith@gmail.com"}}); err != nil || !ok {
+		t.Fatalf("alice should be allowed to post (err=%v)", err)
+	}
+
+	err = srv.unsubscribe(ctx, "alicesmith@gmail.com", "golang")
+	if err != nil {
+		t.Fatalf("could not unsubscribe: %+v", err)
+	}
+	got, err = db.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bob@EXAMPLE.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid subscribers:\ngot= %q\nwant=%q", got, want)
+	}
+	err = srv.unsubscribe(ctx, "alicesmith@gmail.com", "golang")
+	if errors.Cause(err) != database.ErrNotSubscribed {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrNotSubscribed)
+	}
+}
+
+func TestSubscribeMetadata(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddList(ctx, "golang")
+	srv := &Server{db: db}
+
+	err = srv.subscribe(ctx, "Alice <alice@EXAMPLE.com>", "golang")
+	if err != nil {
+		t.Fatalf("could not subscribe: %+v", err)
+	}
+	sub, err := db.Subscription(ctx, "alice@EXAMPLE.com", "golang")
+	if err != nil {
+		t.Fatalf("could not get subscription: %+v", err)
+	}
+	if sub.Name != "Alice" || sub.Source != database.SourceEmail ||
+		sub.Delivery != database.DeliveryRegular || sub.SubscribedAt.IsZero() {
+		t.Fatalf("invalid subscription: %+v", sub)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/sbinet-alt63/strew/dkim"
+	"github.com/sbinet-alt63/strew/dmarc"
+	"github.com/sbinet-alt63/strew/spf"
+)
+
+// authResults holds the outcome of the authentication of an inbound message.
+type authResults struct {
+	dkim      []dkim.Result
+	spf       spf.Result
+	spfDomain string           // domain authorized (or not) by SPF.
+	arc       dkim.ChainStatus // validation status of the ARC chain of the message.
+	instance  int              // instance of the last ARC set of the message.
+}
+
+// arcSeal describes the ARC set to add to an outgoing message.
+type arcSeal struct {
+	instance int
+	cv       dkim.ChainStatus
+	results  string
+}
+
+// verifySender authenticates the sender of msg, either from the
+// Authentication-Results header field of a trusted MTA or by verifying its
+// DKIM signatures and SPF policy.
+// Results are cached in the message.
+func (srv *Server) verifySender(ctx context.Context, msg *Message) *authResults {
+	if msg.auth != nil {
+		return msg.auth
+	}
+
+	res := &authResults{spf: spf.None}
+	body, size := msg.bodyReaderAt()
+	res.arc, res.instance = dkim.VerifyChain(ctx, srv.resolver(), msg.header, body, size)
+
+	if !srv.trustedResults(msg, res) {
+		res.dkim = dkim.Verify(ctx, srv.resolver(), msg.header, body, size)
+		res.spf, res.spfDomain = srv.checkSPF(ctx, msg)
+	}
+
+	msg.auth = res
+	return res
+}
+
+// trustedResults fills res from the topmost Authentication-Results header
+// field added by a trusted MTA, if any.
+// Only the fields above the topmost Received field are considered: fields
+// below it were present before the message reached the delivering MTA, and
+// may have been forged by the sender. (RFC 8601, 5)
+func (srv *Server) trustedResults(msg *Message, res *authResults) bool {
+	if len(srv.cfg.TrustedAuthservIDs) == 0 {
+		return false
+	}
+
+	for _, f := range dkim.ParseHeader(msg.header) {
+		if strings.EqualFold(f.Name, "Received") {
+			return false
+		}
+		if !strings.EqualFold(f.Name, "Authentication-Results") {
+			continue
+		}
+		parts := strings.Split(stripComments(f.Value()), ";")
+		id := strings.Fields(parts[0])
+		if len(id) == 0 || !srv.trustedAuthserv(id[0]) {
+			continue
+		}
+
+		for _, part := range parts[1:] {
+			toks := strings.Fields(part)
+			if len(toks) == 0 {
+				continue
+			}
+			kv := strings.SplitN(toks[0], "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			method, result := strings.ToLower(kv[0]), strings.ToLower(kv[1])
+			props := make(map[string]string)
+			for _, tok := range toks[1:] {
+				kv := strings.SplitN(tok, "=", 2)
+				if len(kv) == 2 {
+					props[strings.ToLower(kv[0])] = kv[1]
+				}
+			}
+
+			switch method {
+			case "dkim":
+				domain := props["header.d"]
+				if domain == "" {
+					domain = domainOf(props["header.i"])
+				}
+				res.dkim = append(res.dkim, dkim.Result{
+					Domain:   strings.ToLower(domain),
+					Selector: props["header.s"],
+					Status:   dkim.Status(result),
+				})
+			case "spf":
+				res.spf = spf.Result(result)
+				res.spfDomain = domainOf(props["smtp.mailfrom"])
+				if res.spfDomain == "" {
+					res.spfDomain = strings.ToLower(props["smtp.helo"])
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (srv *Server) trustedAuthserv(id string) bool {
+	for _, v := range srv.cfg.TrustedAuthservIDs {
+		if strings.EqualFold(v, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) trustedRelay(host string) bool {
+	for _, v := range srv.cfg.TrustedRelays {
+		if strings.EqualFold(v, host) {
+			return true
+		}
+	}
+	return false
+}
+
+var reReceivedIP = regexp.MustCompile(`\[(?:IPv6:)?([0-9a-fA-F:.]+)\]`)
+
+// checkSPF evaluates the SPF policy of the envelope sender of msg for the
+// IP address of the client that sent it, as recorded by a trusted relay.
+func (srv *Server) checkSPF(ctx context.Context, msg *Message) (spf.Result, string) {
+	ip, sender := srv.envelope(msg)
+	domain := domainOf(sender)
+	if ip == nil || domain == "" {
+		return spf.None, domain
+	}
+	res, _ := spf.Check(ctx, srv.resolver(), ip, domain, sender)
+	return res, domain
+}
+
+// envelope returns the IP address of the client that sent msg and its
+// envelope sender, as recorded by one of the trusted relays.
+// The topmost Received header field must have been added by a trusted relay,
+// and the Return-Path header field, if any, must be above it: fields further
+// down may have been written by anyone.
+func (srv *Server) envelope(msg *Message) (ip net.IP, sender string) {
+	if len(srv.cfg.TrustedRelays) == 0 {
+		return nil, ""
+	}
+	for _, f := range dkim.ParseHeader(msg.header) {
+		switch {
+		case strings.EqualFold(f.Name, "Return-Path"):
+			if sender == "" {
+				sender = strings.Trim(f.Value(), "<> ")
+			}
+		case strings.EqualFold(f.Name, "Received"):
+			from, by := receivedBy(f.Value())
+			if !srv.trustedRelay(by) {
+				return nil, ""
+			}
+			if m := reReceivedIP.FindStringSubmatch(from); m != nil {
+				ip = net.ParseIP(m[1])
+			}
+			return ip, sender
+		}
+	}
+	return nil, ""
+}
+
+// receivedBy splits the value of a Received header field before its "by"
+// clause, and returns the host name of that clause.
+func receivedBy(v string) (from, by string) {
+	isSpace := func(i int) bool {
+		return i < 0 || i >= len(v) || v[i] == ' ' || v[i] == '\t'
+	}
+	depth := 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0 && isSpace(i-1) && hasPrefixFold(v[i:], "by") && isSpace(i+2):
+			toks := strings.Fields(stripComments(v[i+2:]))
+			if len(toks) > 0 {
+				by = strings.TrimSuffix(toks[0], ";")
+			}
+			return v[:i], by
+		}
+	}
+	return v, ""
+}
+
+// aligned reports whether the domain of the From address is authenticated
+// by a passing DKIM signature or SPF check of a domain in the same
+// organizational domain. (RFC 7489, 3.1)
+func (res *authResults) aligned(from string) bool {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	org, err := dmarc.OrganizationalDomain(domainOf(addr.Address))
+	if err != nil {
+		return false
+	}
+
+	same := func(domain string) bool {
+		if domain == "" {
+			return false
+		}
+		v, err := dmarc.OrganizationalDomain(domain)
+		return err == nil && v == org
+	}
+
+	for _, r := range res.dkim {
+		if r.Status == dkim.Pass && same(r.Domain) {
+			return true
+		}
+	}
+	return res.spf == spf.Pass && same(res.spfDomain)
+}
+
+// String formats the results as the result list of an
+// Authentication-Results header field.
+func (res *authResults) String() string {
+	var parts []string
+	if len(res.dkim) == 0 {
+		parts = append(parts, "dkim=none")
+	}
+	for _, r := range res.dkim {
+		v := fmt.Sprintf("dkim=%s", r.Status)
+		if r.Domain != "" {
+			v += " header.d=" + r.Domain
+		}
+		if r.Selector != "" {
+			v += " header.s=" + r.Selector
+		}
+		parts = append(parts, v)
+	}
+	v := fmt.Sprintf("spf=%s", res.spf)
+	if res.spfDomain != "" {
+		v += " smtp.mailfrom=" + res.spfDomain
+	}
+	parts = append(parts, v)
+	parts = append(parts, fmt.Sprintf("arc=%s", res.arc))
+	return strings.Join(parts, ";\r\n\t")
+}
+
+// authservID returns the identifier used by the server in the
+// authentication results it adds to messages.
+func (srv *Server) authservID() string {
+	if srv.cfg.AuthservID != "" {
+		return srv.cfg.AuthservID
+	}
+	return domainOf(srv.cfg.CommandAddress)
+}
+
+// sealFor returns the ARC set to add to fwd, a copy of msg forwarded to list.
+func (srv *Server) sealFor(ctx context.Context, msg, fwd *Message, list *List) *arcSeal {
+	if !list.ARCSeal {
+		return nil
+	}
+	res := srv.verifySender(ctx, msg)
+	seal := &arcSeal{
+		instance: res.instance + 1,
+		cv:       res.arc,
+		results:  srv.authservID() + ";\r\n\t" + res.String(),
+	}
+	if len(fwd.arc) == 0 {
+		// the previous ARC sets were not forwarded: start a new chain.
+		seal.instance = 1
+		seal.cv = dkim.ChainNone
+	}
+	return seal
+}
+
+// stripComments removes the RFC 5322 comments of a header field value.
+func stripComments(v string) string {
+	var (
+		out   strings.Builder
+		depth = 0
+	)
+	for _, c := range v {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
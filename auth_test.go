@@ -0,0 +1,192 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sbinet-alt63/strew/dkim"
+	"github.com/sbinet-alt63/strew/spf"
+)
+
+func TestRequireAuth(t *testing.T) {
+	srv := &Server{cfg: Config{
+		TrustedAuthservIDs: []string{"mx.example.com"},
+		Resolver:           fakeDNS{},
+	}}
+	list := &List{
+		ID:          "announce",
+		Address:     "announce@example.com",
+		Posters:     []string{"admin@example.com"},
+		RequireAuth: true,
+	}
+
+	for _, tc := range []struct {
+		name string
+		hdr  string
+		want bool
+	}{
+		{
+			name: "no-results",
+			want: false,
+		},
+		{
+			name: "dkim-aligned",
+			hdr:  "Authentication-Results: mx.example.com; dkim=pass (good signature) header.d=mail.example.com; spf=none\r\n",
+			want: true,
+		},
+		{
+			name: "spf-aligned",
+			hdr:  "Authentication-Results: mx.example.com 1; dkim=none; spf=pass smtp.mailfrom=bounces@example.com\r\n",
+			want: true,
+		},
+		{
+			name: "dkim-not-aligned",
+			hdr:  "Authentication-Results: mx.example.com; dkim=pass header.d=example.org; spf=fail smtp.mailfrom=example.com\r\n",
+			want: false,
+		},
+		{
+			name: "untrusted",
+			hdr:  "Authentication-Results: mx.evil.com; dkim=pass header.d=example.com\r\n",
+			want: false,
+		},
+		{
+			name: "above-received",
+			hdr: "Authentication-Results: mx.example.com; dkim=pass header.d=example.com\r\n" +
+				"Received: from mail.example.com ([192.0.2.1]) by mx.example.com; Mon, 1 Jan 2018 00:00:00 +0000\r\n",
+			want: true,
+		},
+		{
+			name: "forged-below-received",
+			hdr: "Received: from mail.evil.com ([192.0.2.66]) by mx.example.com; Mon, 1 Jan 2018 00:00:00 +0000\r\n" +
+				"Authentication-Results: mx.example.com; dkim=pass header.d=example.com\r\n",
+			want: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := tc.hdr +
+				"From: admin@example.com\r\n" +
+				"To: announce@example.com\r\n" +
+				"Subject: hello\r\n\r\nhello\r\n"
+			var msg Message
+			_, err := msg.ReadFrom(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("could not read message: %v", err)
+			}
+			got, err := srv.canPost(context.Background(), &msg, list)
+			if err != nil {
+				t.Fatalf("could not check posting rights: %+v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("invalid posting rights: got=%v, want=%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifySender(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{cfg: Config{
+		TrustedRelays: []string{"mx.example.com"},
+		Resolver: fakeDNS{
+			txt: map[string][]string{
+				"example.com":                {"v=spf1 mx -all"},
+				"sel._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+			},
+			mxs: map[string][]*net.MX{"example.com": {{Host: "mail.example.com", Pref: 10}}},
+			ips: map[string][]net.IPAddr{"mail.example.com": {{IP: net.ParseIP("192.0.2.1")}}},
+		},
+	}}
+
+	const (
+		hdr = "From: alice@example.com\r\n" +
+			"To: golang@example.com\r\n" +
+			"Subject: hello\r\n"
+		body = "hello\r\n"
+	)
+	s := &dkim.Signer{Domain: "example.com", Selector: "sel", Key: key}
+	sig, err := s.Sign([]byte(hdr), strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("could not sign: %v", err)
+	}
+
+	const (
+		rpath   = "Return-Path: <alice@example.com>\r\n"
+		relayed = "Received: from mail.example.com (mail.example.com [192.0.2.1])\r\n" +
+			"\tby mx.example.com (Postfix) with ESMTPS id 42; Mon, 1 Jan 2018 00:00:00 +0000\r\n"
+	)
+	for _, tc := range []struct {
+		name string
+		raw  string
+		spf  spf.Result
+		dkim dkim.Status
+	}{
+		{
+			name: "spf-pass",
+			raw:  rpath + relayed + hdr + "\r\n" + body,
+			spf:  spf.Pass,
+		},
+		{
+			name: "spf-fail",
+			raw:  rpath + strings.Replace(relayed, "192.0.2.1", "198.51.100.7", 1) + hdr + "\r\n" + body,
+			spf:  spf.Fail,
+		},
+		{
+			name: "untrusted-relay",
+			raw:  rpath + strings.Replace(relayed, "by mx.example.com", "by mx.evil.com", 1) + hdr + "\r\n" + body,
+			spf:  spf.None,
+		},
+		{
+			name: "forged-return-path",
+			raw:  relayed + rpath + hdr + "\r\n" + body,
+			spf:  spf.None,
+		},
+		{
+			name: "forged-received",
+			raw:  "Received: by mx.evil.com; Mon, 1 Jan 2018 00:00:00 +0000\r\n" + rpath + relayed + hdr + "\r\n" + body,
+			spf:  spf.None,
+		},
+		{
+			name: "dkim-pass",
+			raw:  sig + hdr + "\r\n" + body,
+			spf:  spf.None,
+			dkim: dkim.Pass,
+		},
+		{
+			name: "dkim-fail",
+			raw:  sig + hdr + "\r\n" + "hello, world\r\n",
+			spf:  spf.None,
+			dkim: dkim.Fail,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var msg Message
+			_, err := msg.ReadFrom(strings.NewReader(tc.raw))
+			if err != nil {
+				t.Fatalf("could not read message: %v", err)
+			}
+			res := srv.verifySender(context.Background(), &msg)
+			if res.spf != tc.spf {
+				t.Fatalf("invalid SPF result: got=%q, want=%q", res.spf, tc.spf)
+			}
+			var got dkim.Status
+			if len(res.dkim) > 0 {
+				got = res.dkim[0].Status
+			}
+			if got != tc.dkim {
+				t.Fatalf("invalid DKIM result: got=%q, want=%q (%+v)", got, tc.dkim, res.dkim)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package client implements a client for the strew command socket.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/proto"
+)
+
+// Client submits messages to a strew server.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	id   uint64
+}
+
+// Dial connects to the strew server listening at addr.
+func Dial(network, addr string) (*Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return New(conn), nil
+}
+
+// DialTLS connects to the strew server listening at addr over TLS.
+// cfg may carry a client certificate when the server verifies them.
+func DialTLS(network, addr string, cfg *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, addr, cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return New(conn), nil
+}
+
+// New returns a client talking to a strew server over conn.
+func New(conn net.Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Auth presents the shared secret token to the server.
+// It must be called before any message is submitted, when the server
+// is configured with a listen_token.
+func (c *Client) Auth(token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	auth := proto.Auth{Token: token}
+	_, err := auth.WriteTo(c.conn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var resp proto.Response
+	_, err = resp.ReadFrom(c.conn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.Status != proto.Accepted {
+		return fmt.Errorf("strew/client: authentication failed: %s", resp.Reason)
+	}
+	return nil
+}
+
+// Submit sends msg to the server and waits for its status reply.
+// A *strew.Message may be passed directly.
+func (c *Client) Submit(msg io.WriterTo) (proto.Response, error) {
+	buf := new(bytes.Buffer)
+	_, err := msg.WriteTo(buf)
+	if err != nil {
+		return proto.Response{}, errors.WithStack(err)
+	}
+	return c.SubmitRaw(buf.Bytes())
+}
+
+// SubmitRaw sends the RFC 5322 message raw to the server and waits for its
+// status reply.
+func (c *Client) SubmitRaw(raw []byte) (proto.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id++
+	req := proto.Request{
+		Version: proto.Version,
+		ID:      c.id,
+		Body:    raw,
+	}
+	_, err := req.WriteTo(c.conn)
+	if err != nil {
+		return proto.Response{}, errors.WithStack(err)
+	}
+
+	var resp proto.Response
+	_, err = resp.ReadFrom(c.conn)
+	if err != nil {
+		return resp, errors.WithStack(err)
+	}
+	if resp.ID != req.ID {
+		return resp, fmt.Errorf("strew/client: response ID mismatch (got=%d, want=%d)", resp.ID, req.ID)
+	}
+	return resp, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sbinet-alt63/strew/proto"
+)
+
+// fakeServer answers the requests read from conn with the statuses of
+// resps, in order, and records their bodies.
+func fakeServer(t *testing.T, conn net.Conn, token string, resps []proto.Response) chan string {
+	bodies := make(chan string, len(resps))
+	go func() {
+		defer conn.Close()
+		defer close(bodies)
+		if token != "" {
+			var auth proto.Auth
+			_, err := auth.ReadFrom(conn)
+			if err != nil {
+				t.Errorf("could not read auth frame: %v", err)
+				return
+			}
+			resp := proto.Response{Status: proto.Accepted}
+			if auth.Token != token {
+				resp = proto.Response{Status: proto.Rejected, Reason: "invalid authentication token"}
+			}
+			resp.WriteTo(conn)
+			if resp.Status != proto.Accepted {
+				return
+			}
+		}
+		for _, resp := range resps {
+			var req proto.Request
+			_, err := req.ReadFrom(conn)
+			if err != nil {
+				t.Errorf("could not read request: %v", err)
+				return
+			}
+			bodies <- string(req.Body)
+			if resp.ID == 0 {
+				resp.ID = req.ID
+			}
+			resp.WriteTo(conn)
+		}
+	}()
+	return bodies
+}
+
+func TestSubmit(t *testing.T) {
+	srv, cli := net.Pipe()
+	bodies := fakeServer(t, srv, "s3cr3t", []proto.Response{
+		{Status: proto.Accepted},
+		{Status: proto.Rejected, Reason: "not a list member"},
+	})
+
+	c := New(cli)
+	defer c.Close()
+
+	err := c.Auth("s3cr3t")
+	if err != nil {
+		t.Fatalf("could not authenticate: %+v", err)
+	}
+
+	resp, err := c.SubmitRaw([]byte("Subject: help\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("could not submit message: %+v", err)
+	}
+	if resp.ID != 1 || resp.Status != proto.Accepted {
+		t.Fatalf("invalid response: %+v", resp)
+	}
+
+	resp, err = c.Submit(bytes.NewBufferString("Subject: hello\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatalf("could not submit message: %+v", err)
+	}
+	if want := (proto.Response{ID: 2, Status: proto.Rejected, Reason: "not a list member"}); resp != want {
+		t.Fatalf("invalid response:\ngot= %+v\nwant=%+v", resp, want)
+	}
+
+	var got []string
+	for body := range bodies {
+		got = append(got, body)
+	}
+	if want := "Subject: help\r\n\r\n|Subject: hello\r\n\r\nhello\r\n"; strings.Join(got, "|") != want {
+		t.Fatalf("invalid bodies: got=%q, want=%q", got, want)
+	}
+}
+
+func TestAuthRejected(t *testing.T) {
+	srv, cli := net.Pipe()
+	fakeServer(t, srv, "s3cr3t", nil)
+
+	c := New(cli)
+	defer c.Close()
+
+	err := c.Auth("guess")
+	if err == nil || !strings.Contains(err.Error(), "invalid authentication token") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestResponseIDMismatch(t *testing.T) {
+	srv, cli := net.Pipe()
+	fakeServer(t, srv, "", []proto.Response{{ID: 42, Status: proto.Accepted}})
+
+	c := New(cli)
+	defer c.Close()
+
+	_, err := c.SubmitRaw([]byte("Subject: help\r\n\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "response ID mismatch") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
@@ -2,29 +2,426 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Command strew-srv runs a strew server, and manages its database.
+//
+// Usage:
+//
+//	strew-srv [serve] <config>         run the server.
+//	strew-srv export <config> [file]   export the database as JSON.
+//	strew-srv import <config> <file>   import a JSON export into the database.
+//	strew-srv backup <config> <file>   copy the database.
+//	strew-srv list <config> [<list> <action>]
+//	                                   show or change the state of lists.
+//	strew-srv migrate <config> <kind> <args...>
+//	                                   import lists from another list manager.
+//
+// The list command shows the state of the lists of the database, or changes
+// the state of a list with one of the actions:
+//
+//	open     accept posts and subscriptions.
+//	close    refuse posts and new subscriptions.
+//	archive  close the list, and stop advertising it.
+//	purge    remove a list deleted from the configuration, and its
+//	         subscriptions.
+//
+// The migrate command stores the subscriptions of the imported lists in the
+// database, prints their [list.<id>] sections to stdout and reports what
+// could not be converted. Its arguments are one of:
+//
+//	nanolist <nanolist.ini>
+//	mailman <list> <config.pck> <members> [<digest members> [<nomail members>]]
+//	mlmmj <spool dir>...
+//
+// Mailman members are read from the output of Mailman's bin/list_members -f.
+// Digest and nomail members are reported and not imported.
+//
+// The commands other than serve open the database directly. A boltdb
+// database can only be opened by one process at a time: stop the server
+// before running them, or send SIGUSR1 to a running server to write a backup
+// to its backup_file instead.
 package main
 
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"text/tabwriter"
 
+	"github.com/pkg/errors"
 	"github.com/sbinet-alt63/strew"
+	"github.com/sbinet-alt63/strew/database"
 	_ "github.com/sbinet-alt63/strew/database/boltdb"
+	_ "github.com/sbinet-alt63/strew/database/memdb"
+	_ "github.com/sbinet-alt63/strew/database/sqldb"
+	"github.com/sbinet-alt63/strew/importer"
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: strew-srv [command] <config> [file]
+
+Commands:
+  serve   run the server (default)
+  export  export the database as JSON, to file or stdout
+  import  import a JSON export into the database
+  backup  copy the database to file
+  list    show the state of lists, or change it:
+            list <config> <list> open|close|archive|purge
+  migrate import lists from nanolist, mailman or mlmmj:
+            migrate <config> nanolist <nanolist.ini>
+            migrate <config> mailman <list> <config.pck> <members> [<digest> [<nomail>]]
+            migrate <config> mlmmj <spool dir>...
+          mailman members are read from the output of bin/list_members -f;
+          digest and nomail members are not imported.
+
+The commands other than serve open the database directly. A boltdb database
+is locked by a running server: stop it first, or send it SIGUSR1 to write a
+backup to its backup_file.
+`)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if len(flag.Args()) != 1 {
+	args := flag.Args()
+	cmd := "serve"
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve", "export", "import", "backup", "list", "migrate":
+			cmd, args = args[0], args[1:]
+		}
+	}
+	if len(args) < 1 {
+		flag.Usage()
 		log.Fatalf("missing path to configuration file")
 	}
 
-	srv, err := strew.NewServerFrom(flag.Arg(0))
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args[0])
+	case "export":
+		fname := ""
+		if len(args) > 1 {
+			fname = args[1]
+		}
+		err = export(args[0], fname)
+	case "import":
+		if len(args) < 2 {
+			log.Fatalf("missing path to the file to import")
+		}
+		err = load(args[0], args[1])
+	case "backup":
+		if len(args) < 2 {
+			log.Fatalf("missing path to the backup file")
+		}
+		err = backup(args[0], args[1])
+	case "list":
+		switch len(args) {
+		case 1:
+			err = showLists(args[0])
+		case 3:
+			err = changeList(args[0], args[1], args[2])
+		default:
+			log.Fatalf("missing list or action")
+		}
+	case "migrate":
+		if len(args) < 3 {
+			log.Fatalf("missing kind and files of the lists to migrate")
+		}
+		err = migrate(args[0], args[1], args[2:])
+	}
+	if err != nil {
+		log.Fatalf("%s: %+v", cmd, err)
+	}
+}
+
+func serve(fname string) error {
+	cfg, err := strew.LoadConfig(fname)
+	if err != nil {
+		return err
+	}
+	srv, err := strew.NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+	go func() {
+		for sig := range sigc {
+			if sig != syscall.SIGUSR1 {
+				cancel()
+				return
+			}
+			if cfg.BackupFile == "" {
+				log.Printf("no backup_file configured")
+				continue
+			}
+			err := writeFile(cfg.BackupFile, func(w io.Writer) error {
+				_, err := srv.Backup(ctx, w)
+				return err
+			})
+			if err != nil {
+				log.Printf("could not backup database: %+v", err)
+				continue
+			}
+			log.Printf("database saved to %q", cfg.BackupFile)
+		}
+	}()
+
+	err = srv.Serve(ctx)
+	if err != nil && err != context.Canceled {
+		log.Print(err)
+	}
+	return srv.Close()
+}
+
+// openDB opens the database of the configuration file fname.
+func openDB(fname string) (database.Store, error) {
+	cfg, err := strew.LoadConfig(fname)
+	if err != nil {
+		return nil, err
+	}
+	return database.Open(cfg.Driver, cfg.Database)
+}
+
+func closeDB(db database.Store) error {
+	if c, ok := db.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func export(cfg, fname string) error {
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeDB(db)
+
+	return writeFile(fname, func(w io.Writer) error {
+		return database.Export(context.Background(), w, db)
+	})
+}
+
+func load(cfg, fname string) error {
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		closeDB(db)
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	err = database.Import(context.Background(), db, f)
+	if err != nil {
+		closeDB(db)
+		return err
+	}
+	return closeDB(db)
+}
+
+func backup(cfg, fname string) error {
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeDB(db)
+
+	b, ok := db.(database.Backuper)
+	if !ok {
+		return errors.New("database driver does not support backups")
+	}
+	return writeFile(fname, func(w io.Writer) error {
+		_, err := b.Backup(context.Background(), w)
+		return err
+	})
+}
+
+func showLists(fname string) error {
+	cfg, err := strew.LoadConfig(fname)
+	if err != nil {
+		return err
+	}
+	db, err := database.Open(cfg.Driver, cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer closeDB(db)
+
+	ctx := context.Background()
+	states, err := db.ListStates(ctx)
+	if err != nil {
+		return err
+	}
+	configured := make(map[string]bool, len(cfg.Lists))
+	ids := make([]string, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	for _, list := range cfg.Lists {
+		configured[list.ID] = true
+		if _, ok := states[list.ID]; !ok {
+			ids = append(ids, list.ID)
+		}
+	}
+	sort.Strings(ids)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "LIST\tSTATE\tSUBSCRIBERS\n")
+	for _, id := range ids {
+		state, ok := states[id]
+		if !ok {
+			// created when the server starts.
+			fmt.Fprintf(w, "%s\tnew\t0\n", id)
+			continue
+		}
+		label := string(state)
+		if !configured[id] && state != database.ListDeleted {
+			label += " (not configured)"
+		}
+		subs, err := db.Subscribers(ctx, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", id, label, len(subs))
+	}
+	return w.Flush()
+}
+
+func changeList(fname, id, action string) error {
+	cfg, err := strew.LoadConfig(fname)
+	if err != nil {
+		return err
+	}
+	db, err := database.Open(cfg.Driver, cfg.Database)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	ctx := context.Background()
-	log.Fatal(srv.Serve(ctx))
+	switch action {
+	case "open":
+		err = strew.SetListState(ctx, cfg, db, id, database.ListActive)
+	case "close":
+		err = strew.SetListState(ctx, cfg, db, id, database.ListClosed)
+	case "archive":
+		err = strew.SetListState(ctx, cfg, db, id, database.ListArchived)
+	case "purge":
+		err = strew.PurgeList(ctx, cfg, db, id)
+	default:
+		err = errors.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		closeDB(db)
+		return err
+	}
+	return closeDB(db)
+}
+
+func migrate(cfg, kind string, args []string) error {
+	var (
+		res *importer.Result
+		err error
+	)
+	switch kind {
+	case "nanolist":
+		res, err = importer.ReadNanolist(args[0])
+	case "mailman":
+		res, err = readMailman(args)
+	case "mlmmj":
+		res = new(importer.Result)
+		for _, dir := range args {
+			r, err := importer.ReadMlmmj(dir)
+			if err != nil {
+				return err
+			}
+			res.Merge(r)
+		}
+	default:
+		return errors.Errorf("unknown list manager %q", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range res.Warnings {
+		log.Printf("warning: %s", msg)
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	err = res.Apply(context.Background(), db)
+	if err != nil {
+		closeDB(db)
+		return err
+	}
+	err = closeDB(db)
+	if err != nil {
+		return err
+	}
+	log.Printf("imported %d subscriptions to %d lists", len(res.Subscriptions), len(res.Lists))
+
+	return res.WriteConfig(os.Stdout)
+}
+
+func readMailman(args []string) (*importer.Result, error) {
+	if len(args) < 3 {
+		return nil, errors.New("missing mailman configuration or members")
+	}
+	m := importer.Mailman{ID: args[0]}
+	for i, r := range []*io.Reader{&m.Config, &m.Members, &m.Digest, &m.NoMail} {
+		if i+1 >= len(args) {
+			break
+		}
+		f, err := os.Open(args[i+1])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer f.Close()
+		*r = f
+	}
+	return importer.ReadMailman(m)
+}
+
+// writeFile writes the output of fn to fname, or to stdout if fname is empty.
+// The file is replaced once fn succeeds.
+func writeFile(fname string, fn func(w io.Writer) error) error {
+	if fname == "" || fname == "-" {
+		return fn(os.Stdout)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = fn(f)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(f.Name(), fname))
 }
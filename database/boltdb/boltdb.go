@@ -7,130 +7,819 @@ package boltdb
 
 import (
 	"bytes"
-	"sort"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/pkg/errors"
 	"github.com/sbinet-alt63/strew/database"
 )
 
+// Layout of the database:
+//   - lists: list ID -> database.ListState of the list,
+//   - subscriptions: one nested bucket per list ID, of address -> JSON
+//     encoded database.Subscription,
+//   - users: one nested bucket per address, of list ID -> nothing, indexing
+//     the subscriptions of each user,
+//   - keys: list ID + "\x00" + address -> OpenPGP public key,
+//   - blocks: key -> end of the block,
+//   - meta: "version" -> version of the layout.
 var (
 	subBucket = []byte("subscriptions")
 	lstBucket = []byte("lists")
+	keyBucket = []byte("keys")
+	blkBucket = []byte("blocks")
+	metBucket = []byte("meta")
+	usrBucket = []byte("users")
 
-	errInvalidListID     = errors.New("strew/database/boltdb: invalid list ID")
-	errInvalidListBucket = errors.New("strew/database/boltdb: invalid list bucket")
+	versionKey = []byte("version")
 )
 
+// version is the current version of the layout of the database.
+// Databases without a version use the layout of version 1, where the
+// subscribers of a list are stored as a single comma-separated value.
+const version = 5
+
+// subscriptionV2 is the metadata of a subscription in versions 2 and 3.
+type subscriptionV2 struct {
+	Since time.Time `json:"since,omitempty"` // time of the subscription.
+}
+
 type store struct {
 	db *bolt.DB
 }
 
-func (db *store) AddList(list string) error {
-	k := []byte(list)
-	return db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(lstBucket)
-		return b.Put(k, []byte("1"))
+// view runs fn in a read transaction, unless ctx is done.
+func (db *store) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(db.db.View(fn))
+}
+
+// update runs fn in a write transaction, unless ctx is done.
+func (db *store) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(db.db.Update(fn))
+}
+
+// checkList returns ErrListNotFound if list does not exist.
+func checkList(tx *bolt.Tx, list string) error {
+	if tx.Bucket(lstBucket).Get([]byte(list)) == nil {
+		return errors.Wrapf(database.ErrListNotFound, "list=%q", list)
+	}
+	return nil
+}
+
+func (db *store) AddList(ctx context.Context, list string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return addList(tx, list)
 	})
 }
 
-func (db *store) DelList(list string) error {
+func addList(tx *bolt.Tx, list string) error {
 	k := []byte(list)
-	return db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(lstBucket)
-		return b.Put(k, []byte("0"))
+	b := tx.Bucket(lstBucket)
+	err := b.Put(k, []byte(database.ListActive))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tx.Bucket(subBucket).CreateBucketIfNotExists(k)
+	return errors.WithStack(err)
+}
+
+func (db *store) DelList(ctx context.Context, list string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return delList(tx, list)
+	})
+}
+
+func delList(tx *bolt.Tx, list string) error {
+	return setListState(tx, list, database.ListDeleted)
+}
+
+func (db *store) ListState(ctx context.Context, list string) (database.ListState, error) {
+	var state database.ListState
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		state, err = listState(tx, list)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+func listState(tx *bolt.Tx, list string) (database.ListState, error) {
+	err := checkList(tx, list)
+	if err != nil {
+		return "", err
+	}
+	return database.ListState(tx.Bucket(lstBucket).Get([]byte(list))), nil
+}
+
+func (db *store) ListStates(ctx context.Context) (map[string]database.ListState, error) {
+	states := make(map[string]database.ListState)
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(lstBucket).ForEach(func(k, v []byte) error {
+			states[string(k)] = database.ListState(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (db *store) SetListState(ctx context.Context, list string, state database.ListState) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return setListState(tx, list, state)
+	})
+}
+
+func setListState(tx *bolt.Tx, list string, state database.ListState) error {
+	if !state.Valid() {
+		return errors.Wrapf(database.ErrInvalidState, "state=%q", state)
+	}
+	err := checkList(tx, list)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(tx.Bucket(lstBucket).Put([]byte(list), []byte(state)))
+}
+
+func (db *store) PurgeList(ctx context.Context, list string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return purgeList(tx, list)
 	})
 }
 
-func (db *store) Subscribers(list string) ([]string, error) {
+// purgeList removes list, its subscriptions from the users index, and the
+// keys registered for it.
+func purgeList(tx *bolt.Tx, list string) error {
+	err := checkList(tx, list)
+	if err != nil {
+		return err
+	}
+
+	k := []byte(list)
+	if b := tx.Bucket(subBucket).Bucket(k); b != nil {
+		var users []string
+		err := b.ForEach(func(user, v []byte) error {
+			users = append(users, string(user))
+			return nil
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, user := range users {
+			err = unindex(tx, user, list)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Bucket(subBucket).DeleteBucket(k)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
 	var (
-		users []string
-		key   = []byte(list)
+		keys   [][]byte
+		prefix = keyID("", list)
+		c      = tx.Bucket(keyBucket).Cursor()
 	)
+	for key, _ := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	for _, key := range keys {
+		err := tx.Bucket(keyBucket).Delete(key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return errors.WithStack(tx.Bucket(lstBucket).Delete(k))
+}
+
+func (db *store) Subscribers(ctx context.Context, list string) ([]string, error) {
+	var users []string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		err := checkList(tx, list)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(subBucket).Bucket([]byte(list))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			users = append(users, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
 
-	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(subBucket)
-		v := b.Get(key)
+func (db *store) Subscribe(ctx context.Context, user, list string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return subscribe(tx, user, list)
+	})
+}
+
+func subscribe(tx *bolt.Tx, user, list string) error {
+	err := checkList(tx, list)
+	if err != nil {
+		return err
+	}
+	if b := tx.Bucket(subBucket).Bucket([]byte(list)); b != nil && b.Get([]byte(user)) != nil {
+		return errors.Wrapf(database.ErrAlreadySubscribed, "user=%q, list=%q", user, list)
+	}
+	return putSubscription(tx, database.Subscription{
+		List:         list,
+		Address:      user,
+		SubscribedAt: time.Now().UTC(),
+	})
+}
+
+func (db *store) AddSubscription(ctx context.Context, sub database.Subscription) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return addSubscription(tx, sub)
+	})
+}
+
+func addSubscription(tx *bolt.Tx, sub database.Subscription) error {
+	err := checkList(tx, sub.List)
+	if err != nil {
+		return err
+	}
+	return putSubscription(tx, sub)
+}
+
+func (db *store) Subscription(ctx context.Context, user, list string) (database.Subscription, error) {
+	var sub database.Subscription
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		err := checkList(tx, list)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(subBucket).Bucket([]byte(list))
+		if b == nil {
+			return errors.WithStack(database.ErrNotSubscribed)
+		}
+		v := b.Get([]byte(user))
 		if v == nil {
-			return errors.WithStack(errInvalidListID)
+			return errors.WithStack(database.ErrNotSubscribed)
 		}
-		vs := bytes.Split(v, []byte(","))
-		for _, v := range vs {
-			users = append(users, string(v))
+		return decodeSubscription(&sub, list, []byte(user), v)
+	})
+	if err != nil {
+		return sub, err
+	}
+	return sub, nil
+}
+
+func (db *store) Members(ctx context.Context, list string) ([]database.Subscription, error) {
+	var subs []database.Subscription
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		subs, err = members(tx, list)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func members(tx *bolt.Tx, list string) ([]database.Subscription, error) {
+	err := checkList(tx, list)
+	if err != nil {
+		return nil, err
+	}
+	b := tx.Bucket(subBucket).Bucket([]byte(list))
+	if b == nil {
+		return nil, nil
+	}
+	var subs []database.Subscription
+	err = b.ForEach(func(k, v []byte) error {
+		var sub database.Subscription
+		err := decodeSubscription(&sub, list, k, v)
+		if err != nil {
+			return err
 		}
+		subs = append(subs, sub)
 		return nil
 	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-	return users, nil
+	return subs, nil
 }
 
-func (db *store) Subscribe(user, list string) error {
-	k := []byte(list)
-	return db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(subBucket)
-		v := b.Get(k)
-		vs := bytes.Split(v, []byte(","))
-		user := []byte(user)
-		users := make([][]byte, 0, len(vs)+1)
-		for _, v := range vs {
-			if !bytes.Equal(v, user) {
-				users = append(users, v)
+// putSubscription stores sub and indexes it.
+func putSubscription(tx *bolt.Tx, sub database.Subscription) error {
+	b, err := tx.Bucket(subBucket).CreateBucketIfNotExists([]byte(sub.List))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	v, err := json.Marshal(sub)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = b.Put([]byte(sub.Address), v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return index(tx, sub.Address, sub.List)
+}
+
+// decodeSubscription decodes the subscription of user to list.
+func decodeSubscription(sub *database.Subscription, list string, user, v []byte) error {
+	err := json.Unmarshal(v, sub)
+	if err != nil {
+		return errors.Wrapf(err, "strew/database/boltdb: invalid subscription of %q to %q", user, list)
+	}
+	sub.List = list
+	sub.Address = string(user)
+	return nil
+}
+
+func (db *store) Unsubscribe(ctx context.Context, user, list string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return unsubscribe(tx, user, list)
+	})
+}
+
+func unsubscribe(tx *bolt.Tx, user, list string) error {
+	err := checkList(tx, list)
+	if err != nil {
+		return err
+	}
+	b := tx.Bucket(subBucket).Bucket([]byte(list))
+	if b == nil || b.Get([]byte(user)) == nil {
+		return errors.Wrapf(database.ErrNotSubscribed, "user=%q, list=%q", user, list)
+	}
+	err = b.Delete([]byte(user))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return unindex(tx, user, list)
+}
+
+// Apply applies batch in a single write transaction.
+func (db *store) Apply(ctx context.Context, batch *database.Batch) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		for _, op := range batch.Ops {
+			var err error
+			switch op.Kind {
+			case database.OpAddList:
+				err = addList(tx, op.List)
+			case database.OpDelList:
+				err = delList(tx, op.List)
+			case database.OpSubscribe:
+				err = subscribe(tx, op.User, op.List)
+			case database.OpUnsubscribe:
+				err = unsubscribe(tx, op.User, op.List)
+			case database.OpAddSubscription:
+				err = addSubscription(tx, op.Sub)
+			case database.OpSetListState:
+				err = setListState(tx, op.List, op.State)
+			case database.OpPurgeList:
+				err = purgeList(tx, op.List)
+			case database.OpSetKey:
+				err = setKey(tx, op.User, op.List, op.Key)
+			default:
+				err = errors.WithStack(database.ErrInvalidOp)
+			}
+			if err != nil {
+				return err
 			}
 		}
-		users = append(users, user)
-		sort.Sort(byteSlice(users))
+		return nil
+	})
+}
+
+// index records the subscription of user to list in the users bucket.
+func index(tx *bolt.Tx, user, list string) error {
+	b, err := tx.Bucket(usrBucket).CreateBucketIfNotExists([]byte(user))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(b.Put([]byte(list), []byte{}))
+}
 
-		return b.Put(k, bytes.Join(users, []byte(",")))
+// unindex removes the subscription of user to list from the users bucket,
+// and the user once it has no subscriptions left.
+func unindex(tx *bolt.Tx, user, list string) error {
+	users := tx.Bucket(usrBucket)
+	b := users.Bucket([]byte(user))
+	if b == nil {
+		return nil
+	}
+	err := b.Delete([]byte(list))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if k, _ := b.Cursor().First(); k != nil {
+		return nil
+	}
+	return errors.WithStack(users.DeleteBucket([]byte(user)))
+}
+
+func (db *store) Lists(ctx context.Context) ([]string, error) {
+	var lists []string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		lists, err = listIDs(tx)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	return lists, nil
 }
 
-func (db *store) Unsubscribe(user, list string) error {
-	k := []byte(list)
-	return db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(subBucket)
-		v := b.Get(k)
-		vs := bytes.Split(v, []byte(","))
-		user := []byte(user)
-		users := make([][]byte, 0, len(vs))
-		for _, v := range vs {
-			if !bytes.Equal(v, user) {
-				users = append(users, v)
-			}
+// listIDs returns the IDs of the lists that are not deleted.
+func listIDs(tx *bolt.Tx) ([]string, error) {
+	var lists []string
+	err := tx.Bucket(lstBucket).ForEach(func(k, v []byte) error {
+		if database.ListState(v) != database.ListDeleted {
+			lists = append(lists, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return lists, nil
+}
+
+func (db *store) Users(ctx context.Context) ([]string, error) {
+	var users []string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(usrBucket).ForEach(func(k, v []byte) error {
+			users = append(users, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (db *store) Subscriptions(ctx context.Context, user string) ([]string, error) {
+	var lists []string
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(usrBucket).Bucket([]byte(user))
+		if b == nil {
+			return nil
 		}
-		sort.Sort(byteSlice(users))
-		return b.Put(k, bytes.Join(users, []byte(",")))
+		return b.ForEach(func(k, v []byte) error {
+			lists = append(lists, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+func (db *store) SetKey(ctx context.Context, user, list string, key []byte) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return setKey(tx, user, list, key)
+	})
+}
+
+func setKey(tx *bolt.Tx, user, list string, key []byte) error {
+	err := checkList(tx, list)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(tx.Bucket(keyBucket).Put(keyID(user, list), key))
+}
+
+func (db *store) Key(ctx context.Context, user, list string) ([]byte, error) {
+	var key []byte
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		key, err = getKey(tx, user, list)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func getKey(tx *bolt.Tx, user, list string) ([]byte, error) {
+	v := tx.Bucket(keyBucket).Get(keyID(user, list))
+	if v == nil {
+		return nil, errors.WithStack(database.ErrNoKey)
+	}
+	return append([]byte(nil), v...), nil
 }
 
-func (db *store) Lists() ([]string, error) {
+func (db *store) Keys(ctx context.Context, list string) (map[string][]byte, error) {
+	var keys map[string][]byte
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		keys, err = listKeys(tx, list)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// listKeys returns the keys registered for list, by address.
+func listKeys(tx *bolt.Tx, list string) (map[string][]byte, error) {
+	err := checkList(tx, list)
+	if err != nil {
+		return nil, err
+	}
 	var (
-		lists []string
+		keys   = make(map[string][]byte)
+		prefix = keyID("", list)
+		c      = tx.Bucket(keyBucket).Cursor()
 	)
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		keys[string(k[len(prefix):])] = append([]byte(nil), v...)
+	}
+	return keys, nil
+}
+
+// Snapshot calls fn with a Reader of a single read transaction.
+func (db *store) Snapshot(ctx context.Context, fn func(r database.Reader) error) error {
+	return db.view(ctx, func(tx *bolt.Tx) error {
+		return fn(snapshot{tx})
+	})
+}
+
+// snapshot reads the database in a read transaction.
+type snapshot struct {
+	tx *bolt.Tx
+}
+
+func (s snapshot) Lists(ctx context.Context) ([]string, error) {
+	return listIDs(s.tx)
+}
+
+func (s snapshot) ListState(ctx context.Context, list string) (database.ListState, error) {
+	return listState(s.tx, list)
+}
+
+func (s snapshot) Members(ctx context.Context, list string) ([]database.Subscription, error) {
+	return members(s.tx, list)
+}
 
-	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(lstBucket)
+func (s snapshot) Keys(ctx context.Context, list string) (map[string][]byte, error) {
+	return listKeys(s.tx, list)
+}
+
+func (db *store) Block(ctx context.Context, key string, until time.Time) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(blkBucket)
+		return b.Put([]byte(key), []byte(until.UTC().Format(time.RFC3339Nano)))
+	})
+}
+
+func (db *store) Unblock(ctx context.Context, key string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(blkBucket)
+		return b.Delete([]byte(key))
+	})
+}
+
+func (db *store) Blocked(ctx context.Context) (map[string]time.Time, error) {
+	blocked := make(map[string]time.Time)
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(blkBucket)
 		return b.ForEach(func(k, v []byte) error {
-			if bytes.Equal(v, []byte("1")) {
-				lists = append(lists, string(k))
+			until, err := time.Parse(time.RFC3339Nano, string(v))
+			if err != nil {
+				return errors.Wrapf(err, "strew/database/boltdb: invalid block of %q", k)
 			}
+			blocked[string(k)] = until
 			return nil
 		})
 	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-	return lists, nil
+	return blocked, nil
+}
+
+// Backup writes a copy of the database to w, from a read transaction:
+// writes to the database may continue during the backup.
+func (db *store) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	var n int64
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Close closes the underlying bolt database.
+func (db *store) Close() error {
+	return errors.WithStack(db.db.Close())
+}
+
+// keyID returns the key of the public key of user for list.
+func keyID(user, list string) []byte {
+	return []byte(list + "\x00" + user)
+}
+
+// migrate upgrades the layout of the database to the current version.
+func migrate(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists(metBucket)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	v := 1
+	if raw := b.Get(versionKey); raw != nil {
+		v, err = strconv.Atoi(string(raw))
+		if err != nil {
+			return errors.Wrapf(err, "strew/database/boltdb: invalid layout version %q", raw)
+		}
+	}
+	if v > version {
+		return fmt.Errorf("strew/database/boltdb: layout version %d is newer than supported version %d", v, version)
+	}
+
+	if v < 2 {
+		err = migrateNestedSubscriptions(tx)
+		if err != nil {
+			return errors.WithMessage(err, "strew/database/boltdb: could not migrate to version 2")
+		}
+	}
+	if v < 3 {
+		err = migrateUsersIndex(tx)
+		if err != nil {
+			return errors.WithMessage(err, "strew/database/boltdb: could not migrate to version 3")
+		}
+	}
+	if v < 4 {
+		err = migrateSubscriptionRecords(tx)
+		if err != nil {
+			return errors.WithMessage(err, "strew/database/boltdb: could not migrate to version 4")
+		}
+	}
+	if v < 5 {
+		err = migrateListStates(tx)
+		if err != nil {
+			return errors.WithMessage(err, "strew/database/boltdb: could not migrate to version 5")
+		}
+	}
+
+	return b.Put(versionKey, []byte(strconv.Itoa(version)))
 }
 
-func (db *store) Users() ([]string, error) {
-	panic("not implemented")
+// migrateNestedSubscriptions moves the comma-separated subscribers of each
+// list to a nested bucket.
+func migrateNestedSubscriptions(tx *bolt.Tx) error {
+	b := tx.Bucket(subBucket)
+	old := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			old[string(k)] = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	meta, err := json.Marshal(subscriptionV2{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for list, users := range old {
+		err = b.Delete([]byte(list))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		lb, err := b.CreateBucket([]byte(list))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, user := range bytes.Split(users, []byte(",")) {
+			if len(user) == 0 {
+				continue
+			}
+			err = lb.Put(user, meta)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateUsersIndex builds the users index from the subscriptions.
+func migrateUsersIndex(tx *bolt.Tx) error {
+	subs := tx.Bucket(subBucket)
+	return subs.ForEach(func(list, v []byte) error {
+		b := subs.Bucket(list)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(user, v []byte) error {
+			return index(tx, string(user), string(list))
+		})
+	})
+}
+
+// migrateSubscriptionRecords converts the metadata of subscriptions to
+// database.Subscription records.
+func migrateSubscriptionRecords(tx *bolt.Tx) error {
+	subs := tx.Bucket(subBucket)
+	return subs.ForEach(func(list, v []byte) error {
+		b := subs.Bucket(list)
+		if b == nil {
+			return nil
+		}
+		recs := make(map[string][]byte)
+		err := b.ForEach(func(user, v []byte) error {
+			var old subscriptionV2
+			err := json.Unmarshal(v, &old)
+			if err != nil {
+				return errors.Wrapf(err, "strew/database/boltdb: invalid subscription of %q to %q", user, list)
+			}
+			rec, err := json.Marshal(database.Subscription{
+				List:         string(list),
+				Address:      string(user),
+				SubscribedAt: old.Since,
+			})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			recs[string(user)] = rec
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for user, rec := range recs {
+			err = b.Put([]byte(user), rec)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+}
+
+// migrateListStates converts the "1" (active) and "0" (deleted) values of
+// the lists bucket to database.ListState values.
+func migrateListStates(tx *bolt.Tx) error {
+	b := tx.Bucket(lstBucket)
+	states := make(map[string]database.ListState)
+	err := b.ForEach(func(k, v []byte) error {
+		switch string(v) {
+		case "1":
+			states[string(k)] = database.ListActive
+		case "0":
+			states[string(k)] = database.ListDeleted
+		default:
+			return errors.Errorf("strew/database/boltdb: invalid state %q of list %q", v, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for list, state := range states {
+		err = b.Put([]byte(list), []byte(state))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
 }
 
 func init() {
 	database.Register("boltdb", func(src string) (database.Store, error) {
-		db, err := bolt.Open(src, 0600, nil)
+		db, err := bolt.Open(src, 0600, &bolt.Options{Timeout: time.Second})
+		if err == bolt.ErrTimeout {
+			return nil, errors.Errorf("strew/database/boltdb: database %q is locked by another process", src)
+		}
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -138,6 +827,9 @@ func init() {
 		for _, bckt := range [][]byte{
 			subBucket,
 			lstBucket,
+			keyBucket,
+			blkBucket,
+			usrBucket,
 		} {
 			err = db.Update(func(tx *bolt.Tx) error {
 				_, err := tx.CreateBucketIfNotExists(bckt)
@@ -147,21 +839,23 @@ func init() {
 				return nil
 			})
 			if err != nil {
+				db.Close()
 				return nil, errors.WithMessage(err, string(bckt))
 			}
 		}
+
+		err = db.Update(migrate)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
 		return &store{db: db}, nil
 	})
 }
 
-type byteSlice [][]byte
-
-func (p byteSlice) Len() int      { return len(p) }
-func (p byteSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
-func (p byteSlice) Less(i, j int) bool {
-	return bytes.Compare(p[i], p[j]) == -1
-}
-
 var (
-	_ database.Store = (*store)(nil)
+	_ database.Store       = (*store)(nil)
+	_ database.BlockList   = (*store)(nil)
+	_ database.Backuper    = (*store)(nil)
+	_ database.Snapshotter = (*store)(nil)
 )
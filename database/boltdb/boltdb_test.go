@@ -0,0 +1,211 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boltdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+func tempDB(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "strew-boltdb-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "strew.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestMigrateNestedSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	fname, cleanup := tempDB(t)
+	defer cleanup()
+
+	// create a database with the comma-separated layout.
+	bdb, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		lists, err := tx.CreateBucket(lstBucket)
+		if err != nil {
+			return err
+		}
+		subs, err := tx.CreateBucket(subBucket)
+		if err != nil {
+			return err
+		}
+		for _, kv := range []struct{ list, users string }{
+			{"golang", "alice@example.com,bob@example.com"},
+			{"rust", ""},
+		} {
+			lists.Put([]byte(kv.list), []byte("1"))
+			subs.Put([]byte(kv.list), []byte(kv.users))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb.Close()
+
+	db, err := database.Open("boltdb", fname)
+	if err != nil {
+		t.Fatalf("could not migrate database: %+v", err)
+	}
+	defer db.(*store).Close()
+
+	for _, tc := range []struct {
+		list string
+		want []string
+	}{
+		{"golang", []string{"alice@example.com", "bob@example.com"}},
+		{"rust", nil},
+	} {
+		subs, err := db.Subscribers(ctx, tc.list)
+		if err != nil {
+			t.Fatalf("could not get subscribers of %q: %+v", tc.list, err)
+		}
+		if !reflect.DeepEqual(subs, tc.want) {
+			t.Fatalf("invalid subscribers of %q: got=%q, want=%q", tc.list, subs, tc.want)
+		}
+	}
+
+	err = db.Subscribe(ctx, "carol@example.com", "rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := db.Subscribers(ctx, "rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"carol@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers: got=%q, want=%q", subs, want)
+	}
+
+	lists, err := db.Subscriptions(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid subscriptions: got=%q, want=%q", lists, want)
+	}
+
+	sub, err := db.Subscription(ctx, "alice@example.com", "golang")
+	if err != nil {
+		t.Fatalf("could not get migrated subscription: %+v", err)
+	}
+	if want := (database.Subscription{List: "golang", Address: "alice@example.com"}); !reflect.DeepEqual(sub, want) {
+		t.Fatalf("invalid subscription: got=%+v, want=%+v", sub, want)
+	}
+
+	var v []byte
+	db.(*store).db.View(func(tx *bolt.Tx) error {
+		v = append(v, tx.Bucket(metBucket).Get(versionKey)...)
+		return nil
+	})
+	if got, want := string(v), strconv.Itoa(version); got != want {
+		t.Fatalf("invalid layout version: got=%q, want=%q", got, want)
+	}
+}
+
+func TestMigrateSubscriptionRecords(t *testing.T) {
+	ctx := context.Background()
+	fname, cleanup := tempDB(t)
+	defer cleanup()
+
+	since := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	bdb, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, bckt := range [][]byte{lstBucket, subBucket, usrBucket, metBucket} {
+			_, err := tx.CreateBucket(bckt)
+			if err != nil {
+				return err
+			}
+		}
+		tx.Bucket(metBucket).Put(versionKey, []byte("3"))
+		tx.Bucket(lstBucket).Put([]byte("golang"), []byte("1"))
+		b, err := tx.Bucket(subBucket).CreateBucket([]byte("golang"))
+		if err != nil {
+			return err
+		}
+		b.Put([]byte("alice@example.com"), []byte(`{"since":"`+since.Format(time.RFC3339)+`"}`))
+		return index(tx, "alice@example.com", "golang")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb.Close()
+
+	db, err := database.Open("boltdb", fname)
+	if err != nil {
+		t.Fatalf("could not migrate database: %+v", err)
+	}
+	defer db.(*store).Close()
+
+	sub, err := db.Subscription(ctx, "alice@example.com", "golang")
+	if err != nil {
+		t.Fatalf("could not get migrated subscription: %+v", err)
+	}
+	want := database.Subscription{List: "golang", Address: "alice@example.com", SubscribedAt: since}
+	if !reflect.DeepEqual(sub, want) {
+		t.Fatalf("invalid subscription: got=%+v, want=%+v", sub, want)
+	}
+}
+
+func TestMigrateListStates(t *testing.T) {
+	ctx := context.Background()
+	fname, cleanup := tempDB(t)
+	defer cleanup()
+
+	bdb, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, bckt := range [][]byte{lstBucket, subBucket, usrBucket, metBucket} {
+			_, err := tx.CreateBucket(bckt)
+			if err != nil {
+				return err
+			}
+		}
+		tx.Bucket(metBucket).Put(versionKey, []byte("4"))
+		tx.Bucket(lstBucket).Put([]byte("golang"), []byte("1"))
+		tx.Bucket(lstBucket).Put([]byte("rust"), []byte("0"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb.Close()
+
+	db, err := database.Open("boltdb", fname)
+	if err != nil {
+		t.Fatalf("could not migrate database: %+v", err)
+	}
+	defer db.(*store).Close()
+
+	states, err := db.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]database.ListState{
+		"golang": database.ListActive,
+		"rust":   database.ListDeleted,
+	}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("invalid list states: got=%v, want=%v", states, want)
+	}
+}
@@ -0,0 +1,782 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+	_ "github.com/sbinet-alt63/strew/database/boltdb"
+	_ "github.com/sbinet-alt63/strew/database/memdb"
+	_ "github.com/sbinet-alt63/strew/database/sqldb"
+)
+
+// sources return the data source name of an empty database for each
+// registered driver, and a function removing it.
+var sources = map[string]func(t *testing.T) (string, func()){
+	"boltdb":   tempSource,
+	"sqlite":   tempSource,
+	"memory":   func(t *testing.T) (string, func()) { return "", func() {} },
+	"postgres": postgresSource,
+}
+
+func tempSource(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "strew-database-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "strew.db"), func() { os.RemoveAll(dir) }
+}
+
+// postgresSource returns the STREW_POSTGRES_DSN connection string, such as
+// "postgres://strew@localhost/strew_test", after dropping the tables of
+// strew. Tests are skipped if it is not set.
+func postgresSource(t *testing.T) (string, func()) {
+	dsn := os.Getenv("STREW_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("STREW_POSTGRES_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, table := range []string{"schema_version", "lists", "subscriptions", "pgp_keys", "blocks"} {
+		_, err = db.Exec("DROP TABLE IF EXISTS " + table)
+		if err != nil {
+			t.Fatalf("could not drop table %q: %v", table, err)
+		}
+	}
+	return dsn, func() {}
+}
+
+// TestConformance runs the conformance tests against every registered
+// driver.
+func TestConformance(t *testing.T) {
+	for _, name := range database.Drivers() {
+		source, ok := sources[name]
+		if !ok {
+			t.Errorf("no test data source for driver %q", name)
+			continue
+		}
+		name := name
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range []struct {
+				name string
+				test func(t *testing.T, db database.Store)
+			}{
+				{"Lists", testLists},
+				{"Subscriptions", testSubscriptions},
+				{"Users", testUsers},
+				{"Keys", testKeys},
+				{"Batch", testBatch},
+				{"Lifecycle", testLifecycle},
+				{"BlockList", testBlockList},
+				{"Context", testContext},
+				{"Backup", func(t *testing.T, db database.Store) { testBackup(t, name, db) }},
+				{"Snapshot", testSnapshot},
+			} {
+				tc := tc
+				t.Run(tc.name, func(t *testing.T) {
+					src, cleanup := source(t)
+					defer cleanup()
+
+					db, err := database.Open(name, src)
+					if err != nil {
+						t.Fatalf("could not open database: %+v", err)
+					}
+					if c, ok := db.(io.Closer); ok {
+						defer c.Close()
+					}
+					tc.test(t, db)
+				})
+			}
+		})
+	}
+}
+
+// is reports whether the cause of err is want.
+func is(err, want error) bool {
+	return errors.Cause(err) == want
+}
+
+func testLists(t *testing.T, db database.Store) {
+	ctx := context.Background()
+	for _, list := range []string{"golang", "rust", "haskell", "golang"} {
+		err := db.AddList(ctx, list)
+		if err != nil {
+			t.Fatalf("could not add list %q: %+v", list, err)
+		}
+	}
+	err := db.DelList(ctx, "rust")
+	if err != nil {
+		t.Fatalf("could not delete list: %+v", err)
+	}
+	lists, err := db.Lists(ctx)
+	if err != nil {
+		t.Fatalf("could not get lists: %+v", err)
+	}
+	if want := []string{"golang", "haskell"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid lists: got=%q, want=%q", lists, want)
+	}
+
+	subs, err := db.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatalf("could not get subscribers: %+v", err)
+	}
+	if len(subs) != 0 {
+		t.Fatalf("invalid subscribers of a fresh list: %q", subs)
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"Subscribers", func() error { _, err := db.Subscribers(ctx, "cobol"); return err }()},
+		{"Members", func() error { _, err := db.Members(ctx, "cobol"); return err }()},
+		{"ListState", func() error { _, err := db.ListState(ctx, "cobol"); return err }()},
+		{"DelList", db.DelList(ctx, "cobol")},
+		{"SetListState", db.SetListState(ctx, "cobol", database.ListClosed)},
+		{"PurgeList", db.PurgeList(ctx, "cobol")},
+		{"Subscribe", db.Subscribe(ctx, "alice@example.com", "cobol")},
+		{"Unsubscribe", db.Unsubscribe(ctx, "alice@example.com", "cobol")},
+		{"AddSubscription", db.AddSubscription(ctx, database.Subscription{List: "cobol", Address: "alice@example.com"})},
+		{"Subscription", func() error { _, err := db.Subscription(ctx, "alice@example.com", "cobol"); return err }()},
+		{"SetKey", db.SetKey(ctx, "alice@example.com", "cobol", []byte("key"))},
+	} {
+		if !is(tc.err, database.ErrListNotFound) {
+			t.Fatalf("%s: invalid error for an unknown list: got=%v, want=%v", tc.name, tc.err, database.ErrListNotFound)
+		}
+	}
+}
+
+func testSubscriptions(t *testing.T, db database.Store) {
+	ctx := context.Background()
+	for _, list := range []string{"golang", "rust"} {
+		err := db.AddList(ctx, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sub := range []struct{ user, list string }{
+		{"bob@example.com", "golang"},
+		{"alice@example.com", "golang"},
+		{"carol,dave@example.com", "golang"},
+		{"carol,dave@example.com", "rust"},
+	} {
+		err := db.Subscribe(ctx, sub.user, sub.list)
+		if err != nil {
+			t.Fatalf("could not subscribe %q to %q: %+v", sub.user, sub.list, err)
+		}
+	}
+	err := db.Subscribe(ctx, "alice@example.com", "golang")
+	if !is(err, database.ErrAlreadySubscribed) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrAlreadySubscribed)
+	}
+	subs, err := db.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com", "bob@example.com", "carol,dave@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers: got=%q, want=%q", subs, want)
+	}
+
+	err = db.Unsubscribe(ctx, "bob@example.com", "golang")
+	if err != nil {
+		t.Fatalf("could not unsubscribe: %+v", err)
+	}
+	err = db.Unsubscribe(ctx, "bob@example.com", "golang")
+	if !is(err, database.ErrNotSubscribed) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrNotSubscribed)
+	}
+	_, err = db.Subscription(ctx, "bob@example.com", "golang")
+	if !is(err, database.ErrNotSubscribed) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrNotSubscribed)
+	}
+
+	want := database.Subscription{
+		List:         "golang",
+		Address:      "dave@example.com",
+		Name:         "Dave",
+		SubscribedAt: time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC),
+		ConfirmedAt:  time.Date(2018, 1, 2, 3, 5, 0, 0, time.UTC),
+		Source:       database.SourceImport,
+		Delivery:     database.DeliveryDigest,
+		Moderated:    true,
+		BounceScore:  1.5,
+	}
+	for i := 0; i < 2; i++ {
+		err = db.AddSubscription(ctx, want)
+		if err != nil {
+			t.Fatalf("could not add subscription: %+v", err)
+		}
+	}
+	sub, err := db.Subscription(ctx, "dave@example.com", "golang")
+	if err != nil {
+		t.Fatalf("could not get subscription: %+v", err)
+	}
+	if !reflect.DeepEqual(sub, want) {
+		t.Fatalf("invalid subscription:\ngot= %+v\nwant=%+v", sub, want)
+	}
+
+	members, err := db.Members(ctx, "golang")
+	if err != nil {
+		t.Fatalf("could not get members: %+v", err)
+	}
+	var addrs []string
+	for _, m := range members {
+		addrs = append(addrs, m.Address)
+	}
+	if want := []string{"alice@example.com", "carol,dave@example.com", "dave@example.com"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("invalid members: got=%q, want=%q", addrs, want)
+	}
+	if members[0].List != "golang" || members[0].SubscribedAt.IsZero() || !reflect.DeepEqual(members[2], want) {
+		t.Fatalf("invalid members: %+v", members)
+	}
+}
+
+func testUsers(t *testing.T, db database.Store) {
+	ctx := context.Background()
+	for _, list := range []string{"golang", "rust"} {
+		err := db.AddList(ctx, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []struct{ user, list string }{
+		{"bob@example.com", "golang"},
+		{"alice@example.com", "golang"},
+		{"alice@example.com", "rust"},
+		{"carol@example.com", "rust"},
+		{"Dave@example.com", "golang"},
+	} {
+		err := db.Subscribe(ctx, sub.user, sub.list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []struct{ user, list string }{
+		{"carol@example.com", "rust"},
+		{"alice@example.com", "golang"},
+	} {
+		err := db.Unsubscribe(ctx, sub.user, sub.list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err := db.Users(ctx)
+	if err != nil {
+		t.Fatalf("could not get users: %+v", err)
+	}
+	// addresses are sorted by bytes, whatever the collation of the database.
+	if want := []string{"Dave@example.com", "alice@example.com", "bob@example.com"}; !reflect.DeepEqual(users, want) {
+		t.Fatalf("invalid users: got=%q, want=%q", users, want)
+	}
+	subs, err := db.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatalf("could not get subscribers: %+v", err)
+	}
+	if want := []string{"Dave@example.com", "bob@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers: got=%q, want=%q", subs, want)
+	}
+
+	for _, tc := range []struct {
+		user string
+		want []string
+	}{
+		{"alice@example.com", []string{"rust"}},
+		{"bob@example.com", []string{"golang"}},
+		{"carol@example.com", nil},
+	} {
+		lists, err := db.Subscriptions(ctx, tc.user)
+		if err != nil {
+			t.Fatalf("could not get subscriptions of %q: %+v", tc.user, err)
+		}
+		if len(lists) == 0 && len(tc.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(lists, tc.want) {
+			t.Fatalf("invalid subscriptions of %q: got=%q, want=%q", tc.user, lists, tc.want)
+		}
+	}
+}
+
+func testKeys(t *testing.T, db database.Store) {
+	ctx := context.Background()
+	err := db.AddList(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Key(ctx, "alice@example.com", "golang")
+	if !is(err, database.ErrNoKey) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrNoKey)
+	}
+	for _, key := range []string{"key-1", "key-2"} {
+		err = db.SetKey(ctx, "alice@example.com", "golang", []byte(key))
+		if err != nil {
+			t.Fatalf("could not set key: %+v", err)
+		}
+	}
+	key, err := db.Key(ctx, "alice@example.com", "golang")
+	if err != nil {
+		t.Fatalf("could not get key: %+v", err)
+	}
+	if got, want := string(key), "key-2"; got != want {
+		t.Fatalf("invalid key: got=%q, want=%q", got, want)
+	}
+
+	// the store does not keep the slices of callers.
+	key[0] = 'K'
+	key, err = db.Key(ctx, "alice@example.com", "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(key), "key-2"; got != want {
+		t.Fatalf("invalid key: got=%q, want=%q", got, want)
+	}
+
+	// keys are listed under the address they were registered with, whether
+	// it is the address of a subscription or not.
+	err = db.Subscribe(ctx, "Foo+tag@Example.COM", "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, key := range map[string]string{
+		"foo@example.com":      "key-foo",
+		"nomember@example.com": "key-nomember",
+	} {
+		err = db.SetKey(ctx, user, "golang", []byte(key))
+		if err != nil {
+			t.Fatalf("could not set key: %+v", err)
+		}
+	}
+	keys, err := db.Keys(ctx, "golang")
+	if err != nil {
+		t.Fatalf("could not get keys: %+v", err)
+	}
+	if want := map[string][]byte{
+		"alice@example.com":    []byte("key-2"),
+		"foo@example.com":      []byte("key-foo"),
+		"nomember@example.com": []byte("key-nomember"),
+	}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("invalid keys: got=%q, want=%q", keys, want)
+	}
+	_, err = db.Keys(ctx, "cobol")
+	if !is(err, database.ErrListNotFound) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrListNotFound)
+	}
+
+	// all keys are exported.
+	buf := new(bytes.Buffer)
+	err = database.Export(ctx, buf, db)
+	if err != nil {
+		t.Fatalf("could not export: %+v", err)
+	}
+	var dump database.Dump
+	err = json.Unmarshal(buf.Bytes(), &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []database.DumpKey{
+		{List: "golang", Address: "alice@example.com", Key: []byte("key-2")},
+		{List: "golang", Address: "foo@example.com", Key: []byte("key-foo")},
+		{List: "golang", Address: "nomember@example.com", Key: []byte("key-nomember")},
+	}; !reflect.DeepEqual(dump.Keys, want) {
+		t.Fatalf("invalid exported keys:\ngot= %q\nwant=%q", dump.Keys, want)
+	}
+}
+
+func testBatch(t *testing.T, db database.Store) {
+	ctx := context.Background()
+	batch := new(database.Batch)
+	batch.AddList("golang")
+	batch.AddList("rust")
+	for i := 0; i < 100; i++ {
+		batch.Subscribe(fmt.Sprintf("user%03d@example.com", i), "golang")
+	}
+	batch.Unsubscribe("user042@example.com", "golang")
+	batch.AddSubscription(database.Subscription{List: "rust", Address: "alice@example.com", Source: database.SourceImport})
+	batch.DelList("rust")
+	batch.SetKey("user000@example.com", "golang", []byte("key"))
+	if got, want := batch.Len(), 106; got != want {
+		t.Fatalf("invalid batch length: got=%d, want=%d", got, want)
+	}
+	err := db.Apply(ctx, batch)
+	if err != nil {
+		t.Fatalf("could not apply batch: %+v", err)
+	}
+
+	subs, err := db.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 99 || subs[42] != "user043@example.com" {
+		t.Fatalf("invalid subscribers: %q", subs)
+	}
+	lists, err := db.Lists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid lists: got=%q, want=%q", lists, want)
+	}
+	sub, err := db.Subscription(ctx, "alice@example.com", "rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Source != database.SourceImport {
+		t.Fatalf("invalid subscription: %+v", sub)
+	}
+	key, err := db.Key(ctx, "user000@example.com", "golang")
+	if err != nil || string(key) != "key" {
+		t.Fatalf("invalid key: %q, %v", key, err)
+	}
+
+	// a failing batch is not applied.
+	for _, tc := range []struct {
+		op  database.Op
+		err error
+	}{
+		{database.Op{Kind: -1}, database.ErrInvalidOp},
+		{database.Op{Kind: database.OpSubscribe, List: "golang", User: "user001@example.com"}, database.ErrAlreadySubscribed},
+		{database.Op{Kind: database.OpUnsubscribe, List: "golang", User: "user042@example.com"}, database.ErrNotSubscribed},
+		{database.Op{Kind: database.OpSubscribe, List: "cobol", User: "bob@example.com"}, database.ErrListNotFound},
+		{database.Op{Kind: database.OpSetListState, List: "golang", State: "frozen"}, database.ErrInvalidState},
+		{database.Op{Kind: database.OpSetKey, List: "cobol", User: "bob@example.com"}, database.ErrListNotFound},
+	} {
+		batch = new(database.Batch)
+		batch.AddList("haskell")
+		batch.Subscribe("bob@example.com", "golang")
+		batch.Unsubscribe("user000@example.com", "golang")
+		batch.PurgeList("rust")
+		batch.SetKey("user001@example.com", "golang", []byte("key"))
+		batch.Ops = append(batch.Ops, tc.op)
+		err = db.Apply(ctx, batch)
+		if !is(err, tc.err) {
+			t.Fatalf("invalid error: got=%v, want=%v", err, tc.err)
+		}
+
+		subs, err := db.Subscribers(ctx, "golang")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subs) != 99 || subs[0] != "user000@example.com" {
+			t.Fatalf("failed batch was applied: %q", subs)
+		}
+		states, err := db.ListStates(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]database.ListState{
+			"golang": database.ListActive,
+			"rust":   database.ListDeleted,
+		}; !reflect.DeepEqual(states, want) {
+			t.Fatalf("failed batch was applied: got=%v, want=%v", states, want)
+		}
+		_, err = db.Subscription(ctx, "alice@example.com", "rust")
+		if err != nil {
+			t.Fatalf("failed batch was applied: %v", err)
+		}
+		_, err = db.Key(ctx, "user001@example.com", "golang")
+		if !is(err, database.ErrNoKey) {
+			t.Fatalf("failed batch was applied: %v", err)
+		}
+	}
+}
+
+func testLifecycle(t *testing.T, db database.Store) {
+	ctx := context.Background()
+	for _, list := range []string{"golang", "rust"} {
+		err := db.AddList(ctx, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []struct{ user, list string }{
+		{"alice@example.com", "golang"},
+		{"alice@example.com", "rust"},
+		{"bob@example.com", "rust"},
+	} {
+		err := db.Subscribe(ctx, sub.user, sub.list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.SetKey(ctx, "alice@example.com", "rust", []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.SetListState(ctx, "golang", database.ListClosed)
+	if err != nil {
+		t.Fatalf("could not close list: %+v", err)
+	}
+	err = db.DelList(ctx, "rust")
+	if err != nil {
+		t.Fatalf("could not delete list: %+v", err)
+	}
+	lists, err := db.Lists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid lists: got=%q, want=%q", lists, want)
+	}
+	states, err := db.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]database.ListState{
+		"golang": database.ListClosed,
+		"rust":   database.ListDeleted,
+	}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("invalid list states: got=%v, want=%v", states, want)
+	}
+
+	// a deleted list keeps its subscriptions, until purged.
+	err = db.AddList(ctx, "rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := db.ListState(ctx, "rust")
+	if err != nil || state != database.ListActive {
+		t.Fatalf("invalid state of restored list: %q (err=%v)", state, err)
+	}
+	subs, err := db.Subscribers(ctx, "rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com", "bob@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers of restored list: got=%q, want=%q", subs, want)
+	}
+
+	err = db.PurgeList(ctx, "rust")
+	if err != nil {
+		t.Fatalf("could not purge list: %+v", err)
+	}
+	_, err = db.ListState(ctx, "rust")
+	if !is(err, database.ErrListNotFound) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrListNotFound)
+	}
+	users, err := db.Users(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com"}; !reflect.DeepEqual(users, want) {
+		t.Fatalf("invalid users: got=%q, want=%q", users, want)
+	}
+	lists, err = db.Subscriptions(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid subscriptions: got=%q, want=%q", lists, want)
+	}
+	_, err = db.Key(ctx, "alice@example.com", "rust")
+	if !is(err, database.ErrNoKey) {
+		t.Fatalf("key of purged list was kept: %v", err)
+	}
+
+	// a purged list is created afresh.
+	err = db.AddList(ctx, "rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err = db.Subscribers(ctx, "rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 0 {
+		t.Fatalf("invalid subscribers of re-created list: %q", subs)
+	}
+
+	err = db.SetListState(ctx, "golang", "frozen")
+	if !is(err, database.ErrInvalidState) {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrInvalidState)
+	}
+}
+
+func testBlockList(t *testing.T, db database.Store) {
+	bl, ok := db.(database.BlockList)
+	if !ok {
+		t.Skip("driver does not persist block lists")
+	}
+
+	ctx := context.Background()
+	until := time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC)
+	for _, key := range []string{"ip:192.0.2.1", "from:mallory@example.com"} {
+		err := bl.Block(ctx, key, until)
+		if err != nil {
+			t.Fatalf("could not block: %+v", err)
+		}
+	}
+	err := bl.Unblock(ctx, "ip:192.0.2.1")
+	if err != nil {
+		t.Fatalf("could not unblock: %+v", err)
+	}
+	blocked, err := bl.Blocked(ctx)
+	if err != nil {
+		t.Fatalf("could not get block list: %+v", err)
+	}
+	if want := map[string]time.Time{"from:mallory@example.com": until}; !reflect.DeepEqual(blocked, want) {
+		t.Fatalf("invalid block list: got=%v, want=%v", blocked, want)
+	}
+}
+
+// testBackup checks the copy written by drivers implementing
+// database.Backuper can be opened with the same driver.
+func testBackup(t *testing.T, name string, db database.Store) {
+	ctx := context.Background()
+	bkp, ok := db.(database.Backuper)
+	if !ok {
+		t.Skipf("driver %q does not implement database.Backuper", name)
+	}
+	if name == "postgres" {
+		t.Skip("PostgreSQL databases are saved with pg_dump")
+	}
+	db.AddList(ctx, "golang")
+	db.Subscribe(ctx, "alice@example.com", "golang")
+
+	fname, cleanup := tempSource(t)
+	defer cleanup()
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bkp.Backup(ctx, f)
+	if err != nil {
+		t.Fatalf("could not backup database: %+v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpy, err := database.Open(name, fname)
+	if err != nil {
+		t.Fatalf("could not open backup: %+v", err)
+	}
+	if c, ok := cpy.(io.Closer); ok {
+		defer c.Close()
+	}
+	subs, err := cpy.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers: got=%q, want=%q", subs, want)
+	}
+}
+
+// testSnapshot checks the Reader of drivers implementing
+// database.Snapshotter does not see the writes made while it is in use.
+func testSnapshot(t *testing.T, db database.Store) {
+	ctx := context.Background()
+	snap, ok := db.(database.Snapshotter)
+	if !ok {
+		t.Skip("driver does not implement database.Snapshotter")
+	}
+	db.AddList(ctx, "golang")
+	db.Subscribe(ctx, "alice@example.com", "golang")
+	db.SetKey(ctx, "alice@example.com", "golang", []byte("key"))
+
+	done := make(chan error, 1)
+	err := snap.Snapshot(ctx, func(r database.Reader) error {
+		lists, err := r.Lists(ctx)
+		if err != nil {
+			return err
+		}
+		if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+			t.Errorf("invalid lists: got=%q, want=%q", lists, want)
+		}
+
+		// the write may have to wait for the end of the snapshot.
+		go func() { done <- db.Subscribe(ctx, "bob@example.com", "golang") }()
+		select {
+		case err := <-done:
+			done <- err
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		subs, err := r.Members(ctx, "golang")
+		if err != nil {
+			return err
+		}
+		if len(subs) != 1 || subs[0].Address != "alice@example.com" {
+			t.Errorf("snapshot sees concurrent writes: %+v", subs)
+		}
+		keys, err := r.Keys(ctx, "golang")
+		if err != nil || string(keys["alice@example.com"]) != "key" {
+			t.Errorf("invalid keys: %q, %v", keys, err)
+		}
+		state, err := r.ListState(ctx, "golang")
+		if err != nil || state != database.ListActive {
+			t.Errorf("invalid state: %q, %v", state, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not read snapshot: %+v", err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("could not subscribe: %+v", err)
+	}
+	subs, err := db.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com", "bob@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers: got=%q, want=%q", subs, want)
+	}
+}
+
+func testContext(t *testing.T, db database.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	err := db.AddList(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"AddList", db.AddList(ctx, "rust")},
+		{"Subscribe", db.Subscribe(ctx, "alice@example.com", "golang")},
+		{"Apply", db.Apply(ctx, &database.Batch{Ops: []database.Op{{Kind: database.OpAddList, List: "rust"}}})},
+		{"Lists", func() error { _, err := db.Lists(ctx); return err }()},
+		{"Subscribers", func() error { _, err := db.Subscribers(ctx, "golang"); return err }()},
+	} {
+		if !is(tc.err, context.Canceled) {
+			t.Fatalf("%s: invalid error: got=%v, want=%v", tc.name, tc.err, context.Canceled)
+		}
+	}
+
+	lists, err := db.Lists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("canceled operations were applied: got=%q, want=%q", lists, want)
+	}
+}
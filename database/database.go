@@ -7,20 +7,235 @@
 package database
 
 import (
-	"errors"
+	"context"
+	"io"
 	"sort"
 	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 // Store defines how to interact with a concrete database.
+//
+// Methods return the error of ctx once it is done, and drivers abort
+// pending operations when they can. Errors wrap one of the Err* errors
+// of this package where they apply, such as ErrListNotFound for lists
+// that were never added or were purged: use errors.Cause to test them.
 type Store interface {
-	AddList(list string) error
-	DelList(list string) error
-	Subscribers(list string) ([]string, error)
-	Subscribe(user, list string) error
-	Unsubscribe(user, list string) error
-	Lists() ([]string, error)
-	Users() ([]string, error)
+	// AddList creates list, or makes it active again, keeping its
+	// subscriptions.
+	AddList(ctx context.Context, list string) error
+	// DelList marks list as deleted. Its subscriptions are kept until
+	// PurgeList, so that AddList may restore it.
+	DelList(ctx context.Context, list string) error
+	// Lists returns the IDs of the lists that are not deleted, sorted.
+	Lists(ctx context.Context) ([]string, error)
+	// ListStates returns the state of all lists, deleted ones included,
+	// by list ID.
+	ListStates(ctx context.Context) (map[string]ListState, error)
+	// ListState returns the state of list.
+	ListState(ctx context.Context, list string) (ListState, error)
+	// SetListState changes the state of list.
+	SetListState(ctx context.Context, list string, state ListState) error
+	// PurgeList removes list along with its subscriptions and keys.
+	PurgeList(ctx context.Context, list string) error
+
+	// Subscribers returns the addresses subscribed to list, sorted.
+	Subscribers(ctx context.Context, list string) ([]string, error)
+	// Subscribe subscribes user to list, or returns ErrAlreadySubscribed.
+	Subscribe(ctx context.Context, user, list string) error
+	// Unsubscribe unsubscribes user from list, or returns
+	// ErrNotSubscribed.
+	Unsubscribe(ctx context.Context, user, list string) error
+	// Users returns the addresses subscribed to at least one list, sorted.
+	Users(ctx context.Context) ([]string, error)
+	// Subscriptions returns the IDs of the lists user is subscribed to,
+	// sorted.
+	Subscriptions(ctx context.Context, user string) ([]string, error)
+
+	// AddSubscription subscribes sub.Address to sub.List, replacing the
+	// metadata of an existing subscription.
+	AddSubscription(ctx context.Context, sub Subscription) error
+	// Subscription returns the subscription of user to list, or
+	// ErrNotSubscribed.
+	Subscription(ctx context.Context, user, list string) (Subscription, error)
+	// Members returns the subscriptions to list, sorted by address.
+	Members(ctx context.Context, list string) ([]Subscription, error)
+
+	// Apply applies the operations of batch in order, in a single
+	// transaction: either all of them are applied, or none.
+	// Operations fail as the corresponding methods would.
+	Apply(ctx context.Context, batch *Batch) error
+
+	// SetKey registers the OpenPGP public key of user for list.
+	SetKey(ctx context.Context, user, list string, key []byte) error
+	// Key returns the OpenPGP public key of user for list, or ErrNoKey.
+	Key(ctx context.Context, user, list string) ([]byte, error)
+	// Keys returns the OpenPGP public keys registered for list, by
+	// address, whether their owners are subscribed or not.
+	Keys(ctx context.Context, list string) (map[string][]byte, error)
+}
+
+// BlockList is implemented by Stores able to persist the block list of
+// abusive senders.
+type BlockList interface {
+	// Block blocks key until the provided time.
+	Block(ctx context.Context, key string, until time.Time) error
+	// Unblock removes key from the block list.
+	Unblock(ctx context.Context, key string) error
+	// Blocked returns the blocked keys, with the end of their block.
+	Blocked(ctx context.Context) (map[string]time.Time, error)
+}
+
+// ListState is the state of a list in its lifecycle.
+type ListState string
+
+const (
+	ListActive   ListState = "active"   // accepts posts and subscriptions.
+	ListClosed   ListState = "closed"   // refuses posts and new subscriptions.
+	ListArchived ListState = "archived" // closed, and no longer advertised.
+	ListDeleted  ListState = "deleted"  // removed, until purged or added again.
+)
+
+// Valid reports whether st is one of the defined list states.
+func (st ListState) Valid() bool {
+	switch st {
+	case ListActive, ListClosed, ListArchived, ListDeleted:
+		return true
+	}
+	return false
+}
+
+// Subscription is the subscription of an address to a list.
+type Subscription struct {
+	List         string    `json:"list"`
+	Address      string    `json:"address"`
+	Name         string    `json:"name,omitempty"`     // display name of the subscriber.
+	SubscribedAt time.Time `json:"subscribed_at"`      // zero if unknown.
+	ConfirmedAt  time.Time `json:"confirmed_at"`       // zero if unconfirmed.
+	Source       Source    `json:"source,omitempty"`   // how the subscription was made.
+	Delivery     Delivery  `json:"delivery,omitempty"` // how posts are delivered.
+	Moderated    bool      `json:"moderated,omitempty"`
+	BounceScore  float64   `json:"bounce_score,omitempty"`
+}
+
+// Source describes how a subscription was made.
+type Source string
+
+const (
+	SourceEmail  Source = "email"  // subscribe command.
+	SourceAdmin  Source = "admin"  // list administrator.
+	SourceAPI    Source = "api"    // command socket or other program.
+	SourceImport Source = "import" // import from another database.
+)
+
+// Delivery is the delivery mode of a subscription.
+type Delivery string
+
+const (
+	DeliveryRegular Delivery = "regular" // one message per post.
+	DeliveryDigest  Delivery = "digest"  // periodic digests of posts.
+	DeliveryNoMail  Delivery = "nomail"  // no posts are delivered.
+)
+
+// OpKind is the kind of an operation of a Batch.
+type OpKind int
+
+const (
+	OpAddList         OpKind = iota + 1 // Store.AddList(List)
+	OpDelList                           // Store.DelList(List)
+	OpSubscribe                         // Store.Subscribe(User, List)
+	OpUnsubscribe                       // Store.Unsubscribe(User, List)
+	OpAddSubscription                   // Store.AddSubscription(Sub)
+	OpSetListState                      // Store.SetListState(List, State)
+	OpPurgeList                         // Store.PurgeList(List)
+	OpSetKey                            // Store.SetKey(User, List, Key)
+)
+
+// Op is an operation of a Batch.
+type Op struct {
+	Kind  OpKind
+	List  string
+	User  string
+	Sub   Subscription
+	State ListState
+	Key   []byte
+}
+
+// Batch is a sequence of operations applied atomically by Store.Apply.
+type Batch struct {
+	Ops []Op
+}
+
+// AddList adds an operation creating list, or making it active again.
+func (b *Batch) AddList(list string) {
+	b.Ops = append(b.Ops, Op{Kind: OpAddList, List: list})
+}
+
+// DelList adds an operation marking list as deleted.
+func (b *Batch) DelList(list string) {
+	b.Ops = append(b.Ops, Op{Kind: OpDelList, List: list})
+}
+
+// Subscribe adds an operation subscribing user to list.
+func (b *Batch) Subscribe(user, list string) {
+	b.Ops = append(b.Ops, Op{Kind: OpSubscribe, List: list, User: user})
+}
+
+// Unsubscribe adds an operation unsubscribing user from list.
+func (b *Batch) Unsubscribe(user, list string) {
+	b.Ops = append(b.Ops, Op{Kind: OpUnsubscribe, List: list, User: user})
+}
+
+// AddSubscription adds an operation storing sub, replacing an existing
+// subscription.
+func (b *Batch) AddSubscription(sub Subscription) {
+	b.Ops = append(b.Ops, Op{Kind: OpAddSubscription, List: sub.List, User: sub.Address, Sub: sub})
+}
+
+// SetListState adds an operation changing the state of list.
+func (b *Batch) SetListState(list string, state ListState) {
+	b.Ops = append(b.Ops, Op{Kind: OpSetListState, List: list, State: state})
+}
+
+// PurgeList adds an operation removing list with its subscriptions and keys.
+func (b *Batch) PurgeList(list string) {
+	b.Ops = append(b.Ops, Op{Kind: OpPurgeList, List: list})
+}
+
+// SetKey adds an operation registering the OpenPGP public key of user for
+// list.
+func (b *Batch) SetKey(user, list string, key []byte) {
+	b.Ops = append(b.Ops, Op{Kind: OpSetKey, List: list, User: user, Key: key})
+}
+
+// Len returns the number of operations of the batch.
+func (b *Batch) Len() int { return len(b.Ops) }
+
+// Backuper is implemented by Stores able to write a consistent copy of their
+// database while in use.
+type Backuper interface {
+	// Backup writes a copy of the database to w, in the native format of
+	// the driver, and returns the number of bytes written.
+	Backup(ctx context.Context, w io.Writer) (int64, error)
+}
+
+// Reader is the part of a Store read by Export.
+type Reader interface {
+	Lists(ctx context.Context) ([]string, error)
+	ListState(ctx context.Context, list string) (ListState, error)
+	Members(ctx context.Context, list string) ([]Subscription, error)
+	Keys(ctx context.Context, list string) (map[string][]byte, error)
+}
+
+// Snapshotter is implemented by Stores able to read a consistent snapshot of
+// their database while in use.
+type Snapshotter interface {
+	// Snapshot calls fn with a Reader of the database as it was when
+	// Snapshot was called, unaffected by concurrent writes.
+	// The Reader must not be used once fn has returned.
+	Snapshot(ctx context.Context, fn func(r Reader) error) error
 }
 
 var (
@@ -29,7 +244,13 @@ var (
 )
 
 var (
-	ErrUnknownDriver = errors.New("strew/database: unknown driver name")
+	ErrUnknownDriver     = errors.New("strew/database: unknown driver name")
+	ErrNoKey             = errors.New("strew/database: no key registered")
+	ErrNotSubscribed     = errors.New("strew/database: not subscribed")
+	ErrAlreadySubscribed = errors.New("strew/database: already subscribed")
+	ErrInvalidOp         = errors.New("strew/database: invalid batch operation")
+	ErrListNotFound      = errors.New("strew/database: list not found")
+	ErrInvalidState      = errors.New("strew/database: invalid list state")
 )
 
 // Open opens a database specified by its database driver name and a
@@ -51,6 +272,8 @@ type Driver func(src string) (Store, error)
 // Register makes a database driver available by the provided name.
 // If Register is called twice with the same name or if driver is nil,
 // it panics.
+// Drivers of this repository are checked by the conformance tests of this
+// package, which run against every registered driver.
 func Register(name string, driver Driver) {
 	driversMu.Lock()
 	defer driversMu.Unlock()
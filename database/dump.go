@@ -0,0 +1,169 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DumpVersion is the current version of the Dump format.
+const DumpVersion = 1
+
+// Dump is the driver-independent JSON representation of a Store, written by
+// Export and read by Import:
+//
+//	{
+//	  "version": 1,
+//	  "lists": ["golang", "rust"],
+//	  "states": {"rust": "archived"},
+//	  "subscriptions": [
+//	    {
+//	      "list": "golang",
+//	      "address": "alice@example.com",
+//	      "name": "Alice",
+//	      "subscribed_at": "2018-01-02T03:04:05Z",
+//	      "confirmed_at": "0001-01-01T00:00:00Z",
+//	      "source": "email",
+//	      "delivery": "regular"
+//	    }
+//	  ],
+//	  "keys": [
+//	    {"list": "golang", "address": "alice@example.com", "key": "<base64>"}
+//	  ]
+//	}
+//
+// States records the lists that are not active, subscriptions are encoded
+// as Subscription values, and keys are the OpenPGP public keys registered
+// with SetKey, including those of users who are not subscribed.
+// Deleted lists and block lists are not exported.
+type Dump struct {
+	Version       int                  `json:"version"`
+	Lists         []string             `json:"lists"`
+	States        map[string]ListState `json:"states,omitempty"`
+	Subscriptions []Subscription       `json:"subscriptions"`
+	Keys          []DumpKey            `json:"keys,omitempty"`
+}
+
+// DumpKey is the OpenPGP public key of a subscriber.
+type DumpKey struct {
+	List    string `json:"list"`
+	Address string `json:"address"`
+	Key     []byte `json:"key"`
+}
+
+// Export writes the content of db to w, in the Dump format.
+// Stores implementing Snapshotter are read in a single consistent snapshot.
+func Export(ctx context.Context, w io.Writer, db Store) error {
+	var (
+		dump *Dump
+		err  error
+	)
+	read := func(r Reader) error {
+		dump, err = newDump(ctx, r)
+		return err
+	}
+	if s, ok := db.(Snapshotter); ok {
+		err = s.Snapshot(ctx, read)
+	} else {
+		err = read(db)
+	}
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.WithStack(enc.Encode(dump))
+}
+
+// newDump reads the lists, subscriptions and keys of r.
+func newDump(ctx context.Context, r Reader) (*Dump, error) {
+	lists, err := r.Lists(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dump := &Dump{
+		Version:       DumpVersion,
+		Lists:         lists,
+		Subscriptions: []Subscription{},
+	}
+	for _, list := range lists {
+		state, err := r.ListState(ctx, list)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if state != ListActive {
+			if dump.States == nil {
+				dump.States = make(map[string]ListState)
+			}
+			dump.States[list] = state
+		}
+
+		subs, err := r.Members(ctx, list)
+		if err != nil {
+			return nil, errors.WithMessage(err, "strew/database: could not export list "+list)
+		}
+		dump.Subscriptions = append(dump.Subscriptions, subs...)
+
+		keys, err := r.Keys(ctx, list)
+		if err != nil {
+			return nil, errors.WithMessage(err, "strew/database: could not export keys of list "+list)
+		}
+		users := make([]string, 0, len(keys))
+		for user := range keys {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		for _, user := range users {
+			dump.Keys = append(dump.Keys, DumpKey{List: list, Address: user, Key: keys[user]})
+		}
+	}
+	return dump, nil
+}
+
+// Import adds the lists, subscriptions and keys of the Dump read from r to
+// db, in a single batch.
+// Existing subscriptions are replaced by the ones of the dump.
+func Import(ctx context.Context, db Store, r io.Reader) error {
+	var dump Dump
+	err := json.NewDecoder(r).Decode(&dump)
+	if err != nil {
+		return errors.Wrap(err, "strew/database: could not decode dump")
+	}
+	if dump.Version != DumpVersion {
+		return fmt.Errorf("strew/database: unsupported dump version %d", dump.Version)
+	}
+
+	batch := new(Batch)
+	for _, list := range dump.Lists {
+		batch.AddList(list)
+	}
+	for list, state := range dump.States {
+		batch.SetListState(list, state)
+	}
+	for _, sub := range dump.Subscriptions {
+		if sub.List == "" || sub.Address == "" {
+			return fmt.Errorf("strew/database: invalid subscription of %q to %q", sub.Address, sub.List)
+		}
+		batch.AddSubscription(sub)
+	}
+	for _, key := range dump.Keys {
+		if key.List == "" || key.Address == "" {
+			return fmt.Errorf("strew/database: invalid key of %q for %q", key.Address, key.List)
+		}
+		batch.SetKey(key.Address, key.List, key.Key)
+	}
+	err = db.Apply(ctx, batch)
+	if err != nil {
+		return errors.WithMessage(err, "strew/database: could not import dump")
+	}
+	return nil
+}
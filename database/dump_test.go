@@ -0,0 +1,122 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database_test
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-alt63/strew/database"
+	_ "github.com/sbinet-alt63/strew/database/memdb"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.AddList(ctx, "golang")
+	src.AddList(ctx, "rust")
+	src.AddList(ctx, "haskell")
+	src.DelList(ctx, "haskell")
+	src.SetListState(ctx, "rust", database.ListArchived)
+	subs := []database.Subscription{
+		{
+			List:         "golang",
+			Address:      "alice@example.com",
+			Name:         "Alice",
+			SubscribedAt: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+			Source:       database.SourceEmail,
+			Delivery:     database.DeliveryRegular,
+		},
+		{List: "golang", Address: "bob@example.com", Moderated: true},
+		{List: "rust", Address: "alice@example.com", BounceScore: 2},
+	}
+	for _, sub := range subs {
+		src.AddSubscription(ctx, sub)
+	}
+	src.SetKey(ctx, "bob@example.com", "golang", []byte("key"))
+
+	buf := new(bytes.Buffer)
+	err = database.Export(ctx, buf, src)
+	if err != nil {
+		t.Fatalf("could not export: %+v", err)
+	}
+
+	dst, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.Import(ctx, dst, buf)
+	if err != nil {
+		t.Fatalf("could not import: %+v", err)
+	}
+
+	lists, err := dst.Lists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang", "rust"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid lists: got=%q, want=%q", lists, want)
+	}
+	states, err := dst.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]database.ListState{
+		"golang": database.ListActive,
+		"rust":   database.ListArchived,
+	}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("invalid list states: got=%v, want=%v", states, want)
+	}
+	var got []database.Subscription
+	for _, list := range lists {
+		members, err := dst.Members(ctx, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, members...)
+	}
+	if !reflect.DeepEqual(got, subs) {
+		t.Fatalf("invalid subscriptions:\ngot= %+v\nwant=%+v", got, subs)
+	}
+	key, err := dst.Key(ctx, "bob@example.com", "golang")
+	if err != nil {
+		t.Fatalf("could not get imported key: %+v", err)
+	}
+	if string(key) != "key" {
+		t.Fatalf("invalid key: %q", key)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dump := range []string{
+		`{`,
+		`{"version": 42, "lists": ["golang"]}`,
+		`{"version": 1, "lists": ["golang"], "subscriptions": [{"list": "golang"}]}`,
+	} {
+		err = database.Import(ctx, db, strings.NewReader(dump))
+		if err == nil {
+			t.Fatalf("%s: expected an error", dump)
+		}
+	}
+	lists, err := db.Lists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 0 {
+		t.Fatalf("invalid dumps were imported: %q", lists)
+	}
+}
@@ -0,0 +1,572 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// package memdb implements a database.Store held in memory.
+//
+// The "memory" driver takes an optional path to a JSON snapshot as data
+// source name. The snapshot is loaded when the database is opened, if it
+// exists, and written when the database is closed.
+package memdb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+type store struct {
+	mu     sync.RWMutex
+	fname  string                                      // path to the JSON snapshot, if any.
+	lists  map[string]database.ListState               // state of lists, by list ID.
+	subs   map[string]map[string]database.Subscription // subscriptions, by list ID and address.
+	keys   map[string]map[string][]byte                // public keys of subscribers, by list ID.
+	blocks map[string]time.Time
+}
+
+// snapshot is the JSON representation of a store.
+type snapshot struct {
+	Lists         map[string]snapshotState           `json:"lists"`
+	Subscriptions map[string][]database.Subscription `json:"subscriptions"`
+	Keys          map[string]map[string][]byte       `json:"keys,omitempty"`
+	Blocks        map[string]time.Time               `json:"blocks,omitempty"`
+}
+
+// snapshotState is the state of a list in a snapshot.
+// Older snapshots recorded whether lists were active as a boolean.
+type snapshotState database.ListState
+
+func (st *snapshotState) UnmarshalJSON(data []byte) error {
+	var active bool
+	if json.Unmarshal(data, &active) == nil {
+		*st = snapshotState(database.ListActive)
+		if !active {
+			*st = snapshotState(database.ListDeleted)
+		}
+		return nil
+	}
+	return json.Unmarshal(data, (*database.ListState)(st))
+}
+
+func open(fname string) (*store, error) {
+	db := &store{
+		fname:  fname,
+		lists:  make(map[string]database.ListState),
+		subs:   make(map[string]map[string]database.Subscription),
+		keys:   make(map[string]map[string][]byte),
+		blocks: make(map[string]time.Time),
+	}
+	if fname == "" {
+		return db, nil
+	}
+
+	raw, err := ioutil.ReadFile(fname)
+	switch {
+	case os.IsNotExist(err):
+		return db, nil
+	case err != nil:
+		return nil, errors.WithStack(err)
+	}
+
+	var snap snapshot
+	err = json.Unmarshal(raw, &snap)
+	if err != nil {
+		return nil, errors.Wrapf(err, "strew/database/memdb: could not decode snapshot %q", fname)
+	}
+	for list, state := range snap.Lists {
+		db.lists[list] = database.ListState(state)
+	}
+	for list, subs := range snap.Subscriptions {
+		db.subs[list] = make(map[string]database.Subscription, len(subs))
+		for _, sub := range subs {
+			db.subs[list][sub.Address] = sub
+		}
+	}
+	for list, keys := range snap.Keys {
+		db.keys[list] = keys
+	}
+	for key, until := range snap.Blocks {
+		db.blocks[key] = until
+	}
+	return db, nil
+}
+
+func (db *store) AddList(ctx context.Context, list string) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpAddList, List: list})
+}
+
+func (db *store) DelList(ctx context.Context, list string) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpDelList, List: list})
+}
+
+func (db *store) ListState(ctx context.Context, list string) (database.ListState, error) {
+	if err := ctx.Err(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	err := db.checkList(list)
+	if err != nil {
+		return "", err
+	}
+	return db.lists[list], nil
+}
+
+func (db *store) ListStates(ctx context.Context) (map[string]database.ListState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	states := make(map[string]database.ListState, len(db.lists))
+	for list, state := range db.lists {
+		states[list] = state
+	}
+	return states, nil
+}
+
+func (db *store) SetListState(ctx context.Context, list string, state database.ListState) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpSetListState, List: list, State: state})
+}
+
+func (db *store) PurgeList(ctx context.Context, list string) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpPurgeList, List: list})
+}
+
+// checkList returns ErrListNotFound if list does not exist.
+func (db *store) checkList(list string) error {
+	if _, ok := db.lists[list]; !ok {
+		return errors.Wrapf(database.ErrListNotFound, "list=%q", list)
+	}
+	return nil
+}
+
+// Apply applies batch while holding the lock of the store.
+// The changes made by the operations are recorded, and undone if one of
+// them fails, so that a batch is applied entirely or not at all.
+func (db *store) Apply(ctx context.Context, batch *database.Batch) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var undo []func()
+	for _, op := range batch.Ops {
+		err := db.apply(op, &undo)
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// apply1 applies the single operation op.
+func (db *store) apply1(ctx context.Context, op database.Op) error {
+	return db.Apply(ctx, &database.Batch{Ops: []database.Op{op}})
+}
+
+// apply applies op, appending to undo the functions reverting its changes.
+func (db *store) apply(op database.Op, undo *[]func()) error {
+	switch op.Kind {
+	case database.OpAddList:
+		db.setList(op.List, database.ListActive, undo)
+		return nil
+	case database.OpAddSubscription:
+		err := db.checkList(op.Sub.List)
+		if err != nil {
+			return err
+		}
+		db.put(op.Sub, undo)
+		return nil
+	case database.OpDelList, database.OpSetListState, database.OpPurgeList,
+		database.OpSubscribe, database.OpUnsubscribe, database.OpSetKey:
+		// operations on an existing list.
+	default:
+		return errors.WithStack(database.ErrInvalidOp)
+	}
+
+	err := db.checkList(op.List)
+	if err != nil {
+		return err
+	}
+	switch op.Kind {
+	case database.OpDelList:
+		db.setList(op.List, database.ListDeleted, undo)
+	case database.OpSetListState:
+		if !op.State.Valid() {
+			return errors.Wrapf(database.ErrInvalidState, "state=%q", op.State)
+		}
+		db.setList(op.List, op.State, undo)
+	case database.OpPurgeList:
+		var (
+			state = db.lists[op.List]
+			subs  = db.subs[op.List]
+			keys  = db.keys[op.List]
+		)
+		delete(db.lists, op.List)
+		delete(db.subs, op.List)
+		delete(db.keys, op.List)
+		*undo = append(*undo, func() {
+			db.lists[op.List] = state
+			if subs != nil {
+				db.subs[op.List] = subs
+			}
+			if keys != nil {
+				db.keys[op.List] = keys
+			}
+		})
+	case database.OpSubscribe:
+		if _, ok := db.subs[op.List][op.User]; ok {
+			return errors.Wrapf(database.ErrAlreadySubscribed, "user=%q, list=%q", op.User, op.List)
+		}
+		db.put(database.Subscription{
+			List:         op.List,
+			Address:      op.User,
+			SubscribedAt: time.Now().UTC(),
+		}, undo)
+	case database.OpUnsubscribe:
+		sub, ok := db.subs[op.List][op.User]
+		if !ok {
+			return errors.Wrapf(database.ErrNotSubscribed, "user=%q, list=%q", op.User, op.List)
+		}
+		delete(db.subs[op.List], op.User)
+		*undo = append(*undo, func() { db.subs[op.List][op.User] = sub })
+	case database.OpSetKey:
+		keys, ok := db.keys[op.List]
+		if !ok {
+			keys = make(map[string][]byte)
+			db.keys[op.List] = keys
+		}
+		old, ok := keys[op.User]
+		keys[op.User] = append([]byte(nil), op.Key...)
+		*undo = append(*undo, func() {
+			if ok {
+				keys[op.User] = old
+			} else {
+				delete(keys, op.User)
+			}
+		})
+	}
+	return nil
+}
+
+// setList sets the state of list, creating it if needed.
+func (db *store) setList(list string, state database.ListState, undo *[]func()) {
+	old, ok := db.lists[list]
+	db.lists[list] = state
+	*undo = append(*undo, func() {
+		if ok {
+			db.lists[list] = old
+		} else {
+			delete(db.lists, list)
+		}
+	})
+}
+
+// put stores sub, replacing an existing subscription.
+func (db *store) put(sub database.Subscription, undo *[]func()) {
+	subs, ok := db.subs[sub.List]
+	if !ok {
+		subs = make(map[string]database.Subscription)
+		db.subs[sub.List] = subs
+	}
+	old, ok := subs[sub.Address]
+	subs[sub.Address] = sub
+	*undo = append(*undo, func() {
+		if ok {
+			subs[sub.Address] = old
+		} else {
+			delete(subs, sub.Address)
+		}
+	})
+}
+
+func (db *store) Subscribers(ctx context.Context, list string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	err := db.checkList(list)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(db.subs[list]))
+	for user := range db.subs[list] {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (db *store) Subscribe(ctx context.Context, user, list string) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpSubscribe, List: list, User: user})
+}
+
+func (db *store) AddSubscription(ctx context.Context, sub database.Subscription) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpAddSubscription, List: sub.List, User: sub.Address, Sub: sub})
+}
+
+func (db *store) Subscription(ctx context.Context, user, list string) (database.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Subscription{}, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	err := db.checkList(list)
+	if err != nil {
+		return database.Subscription{}, err
+	}
+	sub, ok := db.subs[list][user]
+	if !ok {
+		return sub, errors.WithStack(database.ErrNotSubscribed)
+	}
+	return sub, nil
+}
+
+func (db *store) Members(ctx context.Context, list string) ([]database.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	err := db.checkList(list)
+	if err != nil {
+		return nil, err
+	}
+	return db.members(list), nil
+}
+
+// members returns the subscriptions to list, sorted by address.
+func (db *store) members(list string) []database.Subscription {
+	subs := make([]database.Subscription, 0, len(db.subs[list]))
+	for _, sub := range db.subs[list] {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Address < subs[j].Address })
+	return subs
+}
+
+func (db *store) Unsubscribe(ctx context.Context, user, list string) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpUnsubscribe, List: list, User: user})
+}
+
+func (db *store) Lists(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	lists := make([]string, 0, len(db.lists))
+	for list, state := range db.lists {
+		if state != database.ListDeleted {
+			lists = append(lists, list)
+		}
+	}
+	sort.Strings(lists)
+	return lists, nil
+}
+
+func (db *store) Users(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	set := make(map[string]bool)
+	for _, subs := range db.subs {
+		for user := range subs {
+			set[user] = true
+		}
+	}
+	users := make([]string, 0, len(set))
+	for user := range set {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (db *store) Subscriptions(ctx context.Context, user string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var lists []string
+	for list, subs := range db.subs {
+		if _, ok := subs[user]; ok {
+			lists = append(lists, list)
+		}
+	}
+	sort.Strings(lists)
+	return lists, nil
+}
+
+func (db *store) SetKey(ctx context.Context, user, list string, key []byte) error {
+	return db.apply1(ctx, database.Op{Kind: database.OpSetKey, List: list, User: user, Key: key})
+}
+
+func (db *store) Key(ctx context.Context, user, list string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	key, ok := db.keys[list][user]
+	if !ok {
+		return nil, errors.WithStack(database.ErrNoKey)
+	}
+	return append([]byte(nil), key...), nil
+}
+
+func (db *store) Keys(ctx context.Context, list string) (map[string][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	err := db.checkList(list)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(db.keys[list]))
+	for user, key := range db.keys[list] {
+		keys[user] = append([]byte(nil), key...)
+	}
+	return keys, nil
+}
+
+func (db *store) Block(ctx context.Context, key string, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.blocks[key] = until
+	return nil
+}
+
+func (db *store) Unblock(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.blocks, key)
+	return nil
+}
+
+func (db *store) Blocked(ctx context.Context) (map[string]time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	blocked := make(map[string]time.Time, len(db.blocks))
+	for key, until := range db.blocks {
+		blocked[key] = until
+	}
+	return blocked, nil
+}
+
+// Snapshot calls fn with a copy of the lists, subscriptions and keys of the
+// store.
+func (db *store) Snapshot(ctx context.Context, fn func(r database.Reader) error) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	db.mu.RLock()
+	snap := &store{
+		lists: make(map[string]database.ListState, len(db.lists)),
+		subs:  make(map[string]map[string]database.Subscription, len(db.subs)),
+		keys:  make(map[string]map[string][]byte, len(db.keys)),
+	}
+	for list, state := range db.lists {
+		snap.lists[list] = state
+	}
+	for list, subs := range db.subs {
+		snap.subs[list] = make(map[string]database.Subscription, len(subs))
+		for user, sub := range subs {
+			snap.subs[list][user] = sub
+		}
+	}
+	// keys are copied by SetKey, and never modified in place.
+	for list, keys := range db.keys {
+		snap.keys[list] = make(map[string][]byte, len(keys))
+		for user, key := range keys {
+			snap.keys[list][user] = key
+		}
+	}
+	db.mu.RUnlock()
+	return fn(snap)
+}
+
+// Close writes the snapshot of the database, if it has one.
+func (db *store) Close() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.fname == "" {
+		return nil
+	}
+
+	snap := snapshot{
+		Lists:         make(map[string]snapshotState, len(db.lists)),
+		Subscriptions: make(map[string][]database.Subscription, len(db.subs)),
+		Keys:          db.keys,
+		Blocks:        db.blocks,
+	}
+	for list, state := range db.lists {
+		snap.Lists[list] = snapshotState(state)
+	}
+	for list := range db.subs {
+		snap.Subscriptions[list] = db.members(list)
+	}
+	raw, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// write to a temporary file first, so a failed write does not
+	// clobber the previous snapshot.
+	f, err := ioutil.TempFile(filepath.Dir(db.fname), filepath.Base(db.fname)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(raw)
+	if err != nil {
+		return errors.Wrapf(err, "strew/database/memdb: could not write snapshot %q", db.fname)
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "strew/database/memdb: could not write snapshot %q", db.fname)
+	}
+	return errors.WithStack(os.Rename(f.Name(), db.fname))
+}
+
+func init() {
+	database.Register("memory", func(src string) (database.Store, error) {
+		return open(src)
+	})
+}
+
+var (
+	_ database.Store       = (*store)(nil)
+	_ database.BlockList   = (*store)(nil)
+	_ database.Snapshotter = (*store)(nil)
+)
@@ -0,0 +1,100 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sbinet-alt63/strew/database"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "strew-memdb-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "strew.json")
+	until := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	db, err := open(fname)
+	if err != nil {
+		t.Fatalf("could not open database: %+v", err)
+	}
+	db.AddList(ctx, "golang")
+	db.AddList(ctx, "rust")
+	db.DelList(ctx, "rust")
+	db.Subscribe(ctx, "alice@example.com", "golang")
+	db.Subscribe(ctx, "bob@example.com", "golang")
+	db.SetKey(ctx, "alice@example.com", "golang", []byte("key"))
+	db.Block(ctx, "ip:192.0.2.1", until)
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not write snapshot: %+v", err)
+	}
+
+	db, err = open(fname)
+	if err != nil {
+		t.Fatalf("could not load snapshot: %+v", err)
+	}
+	lists, _ := db.Lists(ctx)
+	if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid lists: got=%q, want=%q", lists, want)
+	}
+	subs, _ := db.Subscribers(ctx, "rust")
+	if len(subs) != 0 {
+		t.Fatalf("invalid subscribers: %q", subs)
+	}
+	subs, _ = db.Subscribers(ctx, "golang")
+	if want := []string{"alice@example.com", "bob@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers: got=%q, want=%q", subs, want)
+	}
+	key, _ := db.Key(ctx, "alice@example.com", "golang")
+	if want := "key"; string(key) != want {
+		t.Fatalf("invalid key: got=%q, want=%q", key, want)
+	}
+	blocked, _ := db.Blocked(ctx)
+	if want := map[string]time.Time{"ip:192.0.2.1": until}; !reflect.DeepEqual(blocked, want) {
+		t.Fatalf("invalid block list: got=%v, want=%v", blocked, want)
+	}
+}
+
+func TestSnapshotListStates(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "strew-memdb-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "strew.json")
+
+	// snapshots used to record whether lists were active.
+	err = ioutil.WriteFile(fname, []byte(`{
+		"lists": {"golang": true, "rust": false, "haskell": "archived"},
+		"subscriptions": {}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := open(fname)
+	if err != nil {
+		t.Fatalf("could not load snapshot: %+v", err)
+	}
+	states, _ := db.ListStates(ctx)
+	if want := map[string]database.ListState{
+		"golang":  database.ListActive,
+		"rust":    database.ListDeleted,
+		"haskell": database.ListArchived,
+	}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("invalid list states: got=%v, want=%v", states, want)
+	}
+}
@@ -0,0 +1,809 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// package sqldb implements a database.Store backed by a SQL database.
+//
+// Two drivers are registered:
+//   - "sqlite", with a path to a SQLite database as data source name,
+//   - "postgres", with a PostgreSQL connection string as data source name.
+package sqldb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"           // PostgreSQL driver.
+	_ "github.com/mattn/go-sqlite3" // SQLite driver.
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+// dialect describes the differences between the supported SQL databases.
+type dialect struct {
+	driver string   // name of the database/sql driver.
+	blob   string   // type of binary columns.
+	init   []string // statements run when the database is opened.
+	dollar bool     // whether placeholders are $1, $2, ... instead of ?.
+
+	// collate is the collation comparing text by bytes, if the default
+	// collation of the database does not.
+	collate string
+
+	// lock are the statements starting the transaction of schema
+	// migrations, excluding concurrent migrations until it ends.
+	lock []string
+
+	// snapshot are the options of the transactions of Snapshot.
+	snapshot *sql.TxOptions
+}
+
+// migrationLock is the key of the PostgreSQL advisory lock taken during
+// schema migrations.
+const migrationLock = 0x73747265 // "stre"
+
+var (
+	sqlite = dialect{
+		driver: "sqlite3",
+		blob:   "BLOB",
+		init: []string{
+			"PRAGMA busy_timeout = 5000",
+			"PRAGMA journal_mode = WAL",
+			"PRAGMA foreign_keys = ON",
+		},
+		lock: []string{"BEGIN IMMEDIATE"},
+	}
+	postgres = dialect{
+		driver:  "postgres",
+		blob:    "BYTEA",
+		dollar:  true,
+		collate: `"C"`,
+		lock: []string{
+			"BEGIN",
+			fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", migrationLock),
+		},
+		snapshot: &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+	}
+)
+
+// migrations are the successive versions of the schema.
+// Existing migrations must not be modified: add new ones instead.
+var migrations = []string{
+	// version 1.
+	`CREATE TABLE lists (
+		id     TEXT PRIMARY KEY,
+		active BOOLEAN NOT NULL
+	);
+	CREATE TABLE subscriptions (
+		list    TEXT NOT NULL,
+		address TEXT NOT NULL,
+		PRIMARY KEY (list, address)
+	);
+	CREATE INDEX subscriptions_address ON subscriptions (address);
+	CREATE TABLE pgp_keys (
+		list    TEXT NOT NULL,
+		address TEXT NOT NULL,
+		key     {{blob}} NOT NULL,
+		PRIMARY KEY (list, address)
+	);
+	CREATE TABLE blocks (
+		key   TEXT PRIMARY KEY,
+		until BIGINT NOT NULL
+	);`,
+	// version 2: metadata of subscriptions. Times are in nanoseconds since
+	// the Unix epoch, 0 if unknown.
+	`ALTER TABLE subscriptions ADD COLUMN name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE subscriptions ADD COLUMN subscribed_at BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE subscriptions ADD COLUMN confirmed_at BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE subscriptions ADD COLUMN source TEXT NOT NULL DEFAULT '';
+	ALTER TABLE subscriptions ADD COLUMN delivery TEXT NOT NULL DEFAULT '';
+	ALTER TABLE subscriptions ADD COLUMN moderated BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE subscriptions ADD COLUMN bounce_score DOUBLE PRECISION NOT NULL DEFAULT 0;`,
+	// version 3: lifecycle of lists, replacing their active flag.
+	`ALTER TABLE lists ADD COLUMN state TEXT NOT NULL DEFAULT 'active';
+	UPDATE lists SET state = 'deleted' WHERE NOT active;
+	ALTER TABLE lists DROP COLUMN active;`,
+}
+
+type store struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func open(d dialect, src string) (*store, error) {
+	db, err := sql.Open(d.driver, src)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if d.driver == sqlite.driver {
+		// SQLite allows a single writer: serialize accesses from this
+		// process, and wait for other processes.
+		db.SetMaxOpenConns(1)
+	}
+	for _, stmt := range d.init {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrapf(err, "strew/database/sqldb: could not run %q", stmt)
+		}
+	}
+
+	s := &store{db: db, dialect: d}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate upgrades the schema of the database to the last version.
+// Migrations run in a single transaction, locked against the migrations of
+// other processes opening the same database: the schema version is only
+// read once the lock is held.
+func (db *store) migrate() error {
+	ctx := context.Background()
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	for i, stmt := range db.dialect.lock {
+		_, err = conn.ExecContext(ctx, stmt)
+		if err != nil {
+			if i > 0 {
+				conn.ExecContext(ctx, "ROLLBACK")
+			}
+			return errors.Wrap(err, "strew/database/sqldb: could not lock schema")
+		}
+	}
+	err = db.migrateLocked(ctx, conn)
+	if err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return errors.Wrap(err, "strew/database/sqldb: could not commit schema migrations")
+}
+
+func (db *store) migrateLocked(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return errors.Wrap(err, "strew/database/sqldb: could not create schema_version")
+	}
+
+	var version int
+	err = conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return errors.Wrap(err, "strew/database/sqldb: could not read schema version")
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("strew/database/sqldb: schema version %d is newer than supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		stmts := strings.Replace(migrations[i], "{{blob}}", db.dialect.blob, -1)
+		for _, stmt := range strings.Split(stmts, ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			_, err = conn.ExecContext(ctx, stmt)
+			if err != nil {
+				return errors.Wrapf(err, "strew/database/sqldb: could not migrate schema to version %d", i+1)
+			}
+		}
+		_, err = conn.ExecContext(ctx, db.rebind(`INSERT INTO schema_version (version) VALUES (?)`), i+1)
+		if err != nil {
+			return errors.Wrapf(err, "strew/database/sqldb: could not migrate schema to version %d", i+1)
+		}
+	}
+	return nil
+}
+
+// tx runs fn in a transaction, committed if fn succeeds.
+func (db *store) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+// rebind converts the ? placeholders of query to the dialect.
+func (db *store) rebind(query string) string {
+	if !db.dialect.dollar {
+		return query
+	}
+	var (
+		buf = new(bytes.Buffer)
+		n   = 0
+	)
+	for _, c := range query {
+		if c != '?' {
+			buf.WriteRune(c)
+			continue
+		}
+		n++
+		fmt.Fprintf(buf, "$%d", n)
+	}
+	return buf.String()
+}
+
+// rower is implemented by *sql.DB, *sql.Tx and *batchTx.
+type rower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// execer is implemented by *sql.DB, *sql.Tx and *batchTx.
+type execer interface {
+	rower
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (db *store) exec(ctx context.Context, x execer, query string, args ...interface{}) error {
+	_, err := x.ExecContext(ctx, db.rebind(query), args...)
+	return errors.WithStack(err)
+}
+
+// execRow runs query, inserting, updating or deleting a single row, and
+// returns none if no row was affected.
+func (db *store) execRow(ctx context.Context, x execer, none error, query string, args ...interface{}) error {
+	res, err := x.ExecContext(ctx, db.rebind(query), args...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n == 0 {
+		return none
+	}
+	return nil
+}
+
+// checkList returns ErrListNotFound if list does not exist.
+func (db *store) checkList(ctx context.Context, x rower, list string) error {
+	var one int
+	err := x.QueryRowContext(ctx, db.rebind(`SELECT 1 FROM lists WHERE id = ?`), list).Scan(&one)
+	if err == sql.ErrNoRows {
+		return errors.Wrapf(database.ErrListNotFound, "list=%q", list)
+	}
+	return errors.WithStack(err)
+}
+
+// batchTx is a transaction preparing each distinct statement once.
+// Prepared statements are closed with the transaction.
+type batchTx struct {
+	tx    *sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+func (b *batchTx) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	stmt, ok := b.stmts[query]
+	if !ok {
+		var err error
+		stmt, err = b.tx.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		b.stmts[query] = stmt
+	}
+	return stmt, nil
+}
+
+func (b *batchTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := b.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (b *batchTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	stmt, err := b.stmt(ctx, query)
+	if err != nil {
+		// let Scan report the error.
+		return b.tx.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// orderBy returns the ORDER BY clause sorting the rows by the bytes of col,
+// as the other drivers do.
+func (db *store) orderBy(col string) string {
+	if db.dialect.collate == "" {
+		return "ORDER BY " + col
+	}
+	return "ORDER BY " + col + " COLLATE " + db.dialect.collate
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	rower
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// strings returns the single column of strings selected by query.
+func (db *store) strings(ctx context.Context, q queryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, db.rebind(query), args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var vs []string
+	for rows.Next() {
+		var v string
+		err = rows.Scan(&v)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		vs = append(vs, v)
+	}
+	return vs, errors.WithStack(rows.Err())
+}
+
+func (db *store) AddList(ctx context.Context, list string) error {
+	return db.addList(ctx, db.db, list)
+}
+
+func (db *store) addList(ctx context.Context, x execer, list string) error {
+	return db.exec(ctx, x, `INSERT INTO lists (id, state) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET state = excluded.state`, list, string(database.ListActive))
+}
+
+func (db *store) DelList(ctx context.Context, list string) error {
+	return db.delList(ctx, db.db, list)
+}
+
+func (db *store) delList(ctx context.Context, x execer, list string) error {
+	return db.setListState(ctx, x, list, database.ListDeleted)
+}
+
+func (db *store) ListState(ctx context.Context, list string) (database.ListState, error) {
+	return db.listState(ctx, db.db, list)
+}
+
+func (db *store) listState(ctx context.Context, q queryer, list string) (database.ListState, error) {
+	var state database.ListState
+	err := q.QueryRowContext(ctx, db.rebind(`SELECT state FROM lists WHERE id = ?`), list).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", errors.Wrapf(database.ErrListNotFound, "list=%q", list)
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return state, nil
+}
+
+func (db *store) ListStates(ctx context.Context) (map[string]database.ListState, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT id, state FROM lists`)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	states := make(map[string]database.ListState)
+	for rows.Next() {
+		var (
+			list  string
+			state database.ListState
+		)
+		err = rows.Scan(&list, &state)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		states[list] = state
+	}
+	return states, errors.WithStack(rows.Err())
+}
+
+func (db *store) SetListState(ctx context.Context, list string, state database.ListState) error {
+	return db.setListState(ctx, db.db, list, state)
+}
+
+func (db *store) setListState(ctx context.Context, x execer, list string, state database.ListState) error {
+	if !state.Valid() {
+		return errors.Wrapf(database.ErrInvalidState, "state=%q", state)
+	}
+	return db.execRow(ctx, x, errors.Wrapf(database.ErrListNotFound, "list=%q", list),
+		`UPDATE lists SET state = ? WHERE id = ?`, string(state), list)
+}
+
+func (db *store) PurgeList(ctx context.Context, list string) error {
+	return db.tx(ctx, func(tx *sql.Tx) error {
+		return db.purgeList(ctx, tx, list)
+	})
+}
+
+func (db *store) purgeList(ctx context.Context, x execer, list string) error {
+	err := db.execRow(ctx, x, errors.Wrapf(database.ErrListNotFound, "list=%q", list),
+		`DELETE FROM lists WHERE id = ?`, list)
+	if err != nil {
+		return err
+	}
+	err = db.exec(ctx, x, `DELETE FROM subscriptions WHERE list = ?`, list)
+	if err != nil {
+		return err
+	}
+	return db.exec(ctx, x, `DELETE FROM pgp_keys WHERE list = ?`, list)
+}
+
+func (db *store) Subscribers(ctx context.Context, list string) ([]string, error) {
+	err := db.checkList(ctx, db.db, list)
+	if err != nil {
+		return nil, err
+	}
+	return db.strings(ctx, db.db, `SELECT address FROM subscriptions WHERE list = ? `+db.orderBy("address"), list)
+}
+
+func (db *store) Subscribe(ctx context.Context, user, list string) error {
+	return db.tx(ctx, func(tx *sql.Tx) error {
+		return db.subscribe(ctx, tx, user, list)
+	})
+}
+
+func (db *store) subscribe(ctx context.Context, x execer, user, list string) error {
+	err := db.checkList(ctx, x, list)
+	if err != nil {
+		return err
+	}
+	return db.execRow(ctx, x, errors.Wrapf(database.ErrAlreadySubscribed, "user=%q, list=%q", user, list),
+		`INSERT INTO subscriptions (list, address, subscribed_at) VALUES (?, ?, ?)
+		ON CONFLICT (list, address) DO NOTHING`, list, user, unixNano(time.Now()))
+}
+
+func (db *store) AddSubscription(ctx context.Context, sub database.Subscription) error {
+	return db.tx(ctx, func(tx *sql.Tx) error {
+		return db.addSubscription(ctx, tx, sub)
+	})
+}
+
+func (db *store) addSubscription(ctx context.Context, x execer, sub database.Subscription) error {
+	err := db.checkList(ctx, x, sub.List)
+	if err != nil {
+		return err
+	}
+	return db.exec(ctx, x, `INSERT INTO subscriptions
+		(list, address, name, subscribed_at, confirmed_at, source, delivery, moderated, bounce_score)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (list, address) DO UPDATE SET
+			name = excluded.name,
+			subscribed_at = excluded.subscribed_at,
+			confirmed_at = excluded.confirmed_at,
+			source = excluded.source,
+			delivery = excluded.delivery,
+			moderated = excluded.moderated,
+			bounce_score = excluded.bounce_score`,
+		sub.List, sub.Address, sub.Name,
+		unixNano(sub.SubscribedAt), unixNano(sub.ConfirmedAt),
+		string(sub.Source), string(sub.Delivery), sub.Moderated, sub.BounceScore,
+	)
+}
+
+// subscriptionColumns are the columns scanned by scanSubscription.
+const subscriptionColumns = `list, address, name, subscribed_at, confirmed_at, source, delivery, moderated, bounce_score`
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (database.Subscription, error) {
+	var (
+		sub        database.Subscription
+		subscribed int64
+		confirmed  int64
+	)
+	err := row.Scan(
+		&sub.List, &sub.Address, &sub.Name, &subscribed, &confirmed,
+		&sub.Source, &sub.Delivery, &sub.Moderated, &sub.BounceScore,
+	)
+	sub.SubscribedAt = fromUnixNano(subscribed)
+	sub.ConfirmedAt = fromUnixNano(confirmed)
+	return sub, err
+}
+
+func (db *store) Subscription(ctx context.Context, user, list string) (database.Subscription, error) {
+	row := db.db.QueryRowContext(ctx, db.rebind(`SELECT `+subscriptionColumns+`
+		FROM subscriptions WHERE list = ? AND address = ?`), list, user)
+	sub, err := scanSubscription(row)
+	if err == sql.ErrNoRows {
+		err = db.checkList(ctx, db.db, list)
+		if err != nil {
+			return sub, err
+		}
+		return sub, errors.WithStack(database.ErrNotSubscribed)
+	}
+	if err != nil {
+		return sub, errors.WithStack(err)
+	}
+	return sub, nil
+}
+
+func (db *store) Members(ctx context.Context, list string) ([]database.Subscription, error) {
+	return db.members(ctx, db.db, list)
+}
+
+func (db *store) members(ctx context.Context, q queryer, list string) ([]database.Subscription, error) {
+	err := db.checkList(ctx, q, list)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.QueryContext(ctx, db.rebind(`SELECT `+subscriptionColumns+`
+		FROM subscriptions WHERE list = ? `+db.orderBy("address")), list)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var subs []database.Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, errors.WithStack(rows.Err())
+}
+
+func (db *store) Unsubscribe(ctx context.Context, user, list string) error {
+	return db.tx(ctx, func(tx *sql.Tx) error {
+		return db.unsubscribe(ctx, tx, user, list)
+	})
+}
+
+func (db *store) unsubscribe(ctx context.Context, x execer, user, list string) error {
+	err := db.checkList(ctx, x, list)
+	if err != nil {
+		return err
+	}
+	return db.execRow(ctx, x, errors.Wrapf(database.ErrNotSubscribed, "user=%q, list=%q", user, list),
+		`DELETE FROM subscriptions WHERE list = ? AND address = ?`, list, user)
+}
+
+// Apply applies batch in a single transaction.
+func (db *store) Apply(ctx context.Context, batch *database.Batch) error {
+	return db.tx(ctx, func(tx *sql.Tx) error {
+		x := &batchTx{tx: tx, stmts: make(map[string]*sql.Stmt)}
+		for _, op := range batch.Ops {
+			var err error
+			switch op.Kind {
+			case database.OpAddList:
+				err = db.addList(ctx, x, op.List)
+			case database.OpDelList:
+				err = db.delList(ctx, x, op.List)
+			case database.OpSubscribe:
+				err = db.subscribe(ctx, x, op.User, op.List)
+			case database.OpUnsubscribe:
+				err = db.unsubscribe(ctx, x, op.User, op.List)
+			case database.OpAddSubscription:
+				err = db.addSubscription(ctx, x, op.Sub)
+			case database.OpSetListState:
+				err = db.setListState(ctx, x, op.List, op.State)
+			case database.OpPurgeList:
+				err = db.purgeList(ctx, x, op.List)
+			case database.OpSetKey:
+				err = db.setKey(ctx, x, op.User, op.List, op.Key)
+			default:
+				err = errors.WithStack(database.ErrInvalidOp)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *store) Lists(ctx context.Context) ([]string, error) {
+	return db.lists(ctx, db.db)
+}
+
+func (db *store) lists(ctx context.Context, q queryer) ([]string, error) {
+	return db.strings(ctx, q, `SELECT id FROM lists WHERE state <> ? `+db.orderBy("id"), string(database.ListDeleted))
+}
+
+func (db *store) Users(ctx context.Context) ([]string, error) {
+	return db.strings(ctx, db.db, `SELECT address FROM subscriptions GROUP BY address `+db.orderBy("address"))
+}
+
+func (db *store) Subscriptions(ctx context.Context, user string) ([]string, error) {
+	return db.strings(ctx, db.db, `SELECT list FROM subscriptions WHERE address = ? `+db.orderBy("list"), user)
+}
+
+func (db *store) SetKey(ctx context.Context, user, list string, key []byte) error {
+	return db.tx(ctx, func(tx *sql.Tx) error {
+		return db.setKey(ctx, tx, user, list, key)
+	})
+}
+
+func (db *store) setKey(ctx context.Context, x execer, user, list string, key []byte) error {
+	err := db.checkList(ctx, x, list)
+	if err != nil {
+		return err
+	}
+	return db.exec(ctx, x, `INSERT INTO pgp_keys (list, address, key) VALUES (?, ?, ?)
+		ON CONFLICT (list, address) DO UPDATE SET key = excluded.key`, list, user, key)
+}
+
+func (db *store) Key(ctx context.Context, user, list string) ([]byte, error) {
+	var key []byte
+	err := db.db.QueryRowContext(ctx, db.rebind(`SELECT key FROM pgp_keys WHERE list = ? AND address = ?`), list, user).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, errors.WithStack(database.ErrNoKey)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return key, nil
+}
+
+func (db *store) Block(ctx context.Context, key string, until time.Time) error {
+	return db.exec(ctx, db.db, `INSERT INTO blocks (key, until) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET until = excluded.until`, key, until.UnixNano())
+}
+
+func (db *store) Unblock(ctx context.Context, key string) error {
+	return db.exec(ctx, db.db, `DELETE FROM blocks WHERE key = ?`, key)
+}
+
+func (db *store) Blocked(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT key, until FROM blocks`)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	blocked := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			key   string
+			until int64
+		)
+		err = rows.Scan(&key, &until)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		blocked[key] = time.Unix(0, until).UTC()
+	}
+	return blocked, errors.WithStack(rows.Err())
+}
+
+func (db *store) Keys(ctx context.Context, list string) (map[string][]byte, error) {
+	return db.keys(ctx, db.db, list)
+}
+
+func (db *store) keys(ctx context.Context, q queryer, list string) (map[string][]byte, error) {
+	err := db.checkList(ctx, q, list)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.QueryContext(ctx, db.rebind(`SELECT address, key FROM pgp_keys WHERE list = ?`), list)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	keys := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			user string
+			key  []byte
+		)
+		err = rows.Scan(&user, &key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys[user] = key
+	}
+	return keys, errors.WithStack(rows.Err())
+}
+
+// Snapshot calls fn with a Reader of a single read transaction, isolated
+// from concurrent writes.
+func (db *store) Snapshot(ctx context.Context, fn func(r database.Reader) error) error {
+	tx, err := db.db.BeginTx(ctx, db.dialect.snapshot)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tx.Rollback()
+	return fn(snapshot{db: db, tx: tx})
+}
+
+// snapshot reads the database in a transaction.
+type snapshot struct {
+	db *store
+	tx *sql.Tx
+}
+
+func (s snapshot) Lists(ctx context.Context) ([]string, error) {
+	return s.db.lists(ctx, s.tx)
+}
+
+func (s snapshot) ListState(ctx context.Context, list string) (database.ListState, error) {
+	return s.db.listState(ctx, s.tx, list)
+}
+
+func (s snapshot) Members(ctx context.Context, list string) ([]database.Subscription, error) {
+	return s.db.members(ctx, s.tx, list)
+}
+
+func (s snapshot) Keys(ctx context.Context, list string) (map[string][]byte, error) {
+	return s.db.keys(ctx, s.tx, list)
+}
+
+// unixNano returns t in nanoseconds since the Unix epoch, or 0 if t is zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano.
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// Backup writes a copy of a SQLite database to w, with VACUUM INTO.
+// PostgreSQL databases should be saved with pg_dump instead.
+func (db *store) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	if db.dialect.driver != sqlite.driver {
+		return 0, errors.New("strew/database/sqldb: backups are only supported for SQLite, use pg_dump for PostgreSQL")
+	}
+
+	dir, err := ioutil.TempDir("", "strew-backup-")
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "backup.db")
+	err = db.exec(ctx, db.db, `VACUUM INTO ?`, fname)
+	if err != nil {
+		return 0, errors.Wrap(err, "strew/database/sqldb: could not backup database")
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer f.Close()
+	n, err := io.Copy(w, f)
+	return n, errors.WithStack(err)
+}
+
+// Close closes the underlying database.
+func (db *store) Close() error {
+	return db.db.Close()
+}
+
+func init() {
+	database.Register("sqlite", func(src string) (database.Store, error) {
+		return open(sqlite, src)
+	})
+	database.Register("postgres", func(src string) (database.Store, error) {
+		return open(postgres, src)
+	})
+}
+
+var (
+	_ database.Store       = (*store)(nil)
+	_ database.BlockList   = (*store)(nil)
+	_ database.Backuper    = (*store)(nil)
+	_ database.Snapshotter = (*store)(nil)
+)
@@ -0,0 +1,139 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sbinet-alt63/strew/database"
+)
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "strew-sqldb-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "strew.db")
+	db, err := database.Open("sqlite", fname)
+	if err != nil {
+		t.Fatalf("could not open database: %+v", err)
+	}
+	err = db.AddList(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.(*store).Close()
+
+	// re-opening an up-to-date database is a no-op.
+	db, err = database.Open("sqlite", fname)
+	if err != nil {
+		t.Fatalf("could not re-open database: %+v", err)
+	}
+	defer db.(*store).Close()
+
+	lists, err := db.Lists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang"}; !reflect.DeepEqual(lists, want) {
+		t.Fatalf("invalid lists: got=%q, want=%q", lists, want)
+	}
+}
+
+func TestMigrateListStates(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "strew-sqldb-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "strew.db")
+
+	raw, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE schema_version (version INTEGER NOT NULL)`,
+		`INSERT INTO schema_version (version) VALUES (1)`,
+		`CREATE TABLE lists (id TEXT PRIMARY KEY, active BOOLEAN NOT NULL)`,
+		`CREATE TABLE subscriptions (list TEXT NOT NULL, address TEXT NOT NULL, PRIMARY KEY (list, address))`,
+		`CREATE TABLE pgp_keys (list TEXT NOT NULL, address TEXT NOT NULL, key BLOB NOT NULL, PRIMARY KEY (list, address))`,
+		`CREATE TABLE blocks (key TEXT PRIMARY KEY, until BIGINT NOT NULL)`,
+		`INSERT INTO lists (id, active) VALUES ('golang', 1), ('rust', 0)`,
+	} {
+		_, err = raw.Exec(stmt)
+		if err != nil {
+			t.Fatalf("could not run %q: %v", stmt, err)
+		}
+	}
+	raw.Close()
+
+	db, err := database.Open("sqlite", fname)
+	if err != nil {
+		t.Fatalf("could not migrate database: %+v", err)
+	}
+	defer db.(*store).Close()
+
+	states, err := db.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]database.ListState{
+		"golang": database.ListActive,
+		"rust":   database.ListDeleted,
+	}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("invalid list states: got=%v, want=%v", states, want)
+	}
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strew-sqldb-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "strew.db")
+
+	const n = 4
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			db, err := open(sqlite, fname)
+			if err == nil {
+				db.Close()
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("could not open database: %+v", err)
+		}
+	}
+
+	raw, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var versions int
+	err = raw.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions != len(migrations) {
+		t.Fatalf("invalid number of applied migrations: got=%d, want=%d", versions, len(migrations))
+	}
+}
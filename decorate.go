@@ -0,0 +1,422 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// listData is the data available to the header and footer templates of a list.
+type listData struct {
+	ID             string
+	Name           string
+	Description    string
+	Address        string
+	CommandAddress string
+	Subscriber     string // recipient of the post. Only set for personalized lists.
+}
+
+// parseTemplates compiles the header and footer templates of the list.
+func (list *List) parseTemplates() error {
+	var err error
+	if list.Header != "" {
+		list.header, err = template.New(list.ID + "-header").Parse(list.Header)
+		if err != nil {
+			return errors.Wrapf(err, "strew: invalid header template for list %q", list.ID)
+		}
+	}
+	if list.Footer != "" {
+		list.footer, err = template.New(list.ID + "-footer").Parse(list.Footer)
+		if err != nil {
+			return errors.Wrapf(err, "strew: invalid footer template for list %q", list.ID)
+		}
+	}
+	return nil
+}
+
+// decoration renders the header and footer of a list post sent to rcpt.
+func (srv *Server) decoration(list *List, rcpt string) (header, footer string, err error) {
+	data := listData{
+		ID:             list.ID,
+		Name:           list.Name,
+		Description:    list.Description,
+		Address:        list.Address,
+		CommandAddress: srv.cfg.CommandAddress,
+		Subscriber:     rcpt,
+	}
+
+	render := func(tmpl *template.Template) (string, error) {
+		if tmpl == nil {
+			return "", nil
+		}
+		buf := new(bytes.Buffer)
+		err := tmpl.Execute(buf, data)
+		if err != nil {
+			return "", errors.Wrapf(err, "strew: could not render %s", tmpl.Name())
+		}
+		return crlf(buf.String()), nil
+	}
+
+	header, err = render(list.header)
+	if err != nil {
+		return "", "", err
+	}
+	footer, err = render(list.footer)
+	if err != nil {
+		return "", "", err
+	}
+	return header, footer, nil
+}
+
+// decorate returns a copy of msg with the given header and footer inserted.
+//
+// Text is added in place to text/plain bodies and as extra parts to
+// multipart/mixed bodies.
+// Other bodies are wrapped into a new multipart/mixed body.
+// Signed and encrypted messages are returned untouched, as are messages
+// with an invalid content type.
+func decorate(msg *Message, header, footer string) (*Message, error) {
+	if header == "" && footer == "" {
+		return msg, nil
+	}
+
+	ctype := msg.ContentType
+	if ctype == "" {
+		ctype = "text/plain"
+	}
+	media, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return msg, nil
+	}
+
+	switch media {
+	case "multipart/signed", "multipart/encrypted",
+		"application/pkcs7-mime", "application/x-pkcs7-mime":
+		return msg, nil
+	case "text/plain":
+		if canDecorateText(params, msg.Encoding, header+footer) {
+			return decorateText(msg, params, header, footer)
+		}
+	case "multipart/mixed":
+		out, ok, err := decorateMixed(msg, params["boundary"], header, footer)
+		if err != nil || ok {
+			return out, err
+		}
+	}
+	return wrapMixed(msg, header, footer)
+}
+
+// canDecorateText reports whether text can be added in place to a text/plain
+// body with the given content type parameters and transfer encoding.
+func canDecorateText(params map[string]string, enc, text string) bool {
+	switch strings.ToLower(params["charset"]) {
+	case "", "us-ascii", "utf-8":
+	default:
+		return false
+	}
+
+	switch strings.ToLower(enc) {
+	case "quoted-printable", "8bit", "binary":
+		return true
+	case "", "7bit":
+		return isASCII(text)
+	}
+	return false
+}
+
+func decorateText(msg *Message, params map[string]string, header, footer string) (*Message, error) {
+	var (
+		r, n = msg.bodyReaderAt()
+		body = new(spool)
+		qp   = strings.ToLower(msg.Encoding) == "quoted-printable"
+	)
+
+	write := func(txt string) error {
+		if qp {
+			txt = qpEncode(txt)
+		}
+		_, err := io.WriteString(body, txt)
+		return err
+	}
+
+	if header != "" {
+		err := write(header)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+	_, err := io.Copy(body, io.NewSectionReader(r, 0, n))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if footer != "" {
+		if n > 0 && !endsWithEOL(r, n) {
+			_, err = io.WriteString(body, "\r\n")
+			if err != nil {
+				body.Close()
+				return nil, err
+			}
+		}
+		err = write(footer)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+
+	out := msg.withBody(body)
+	if !isASCII(header + footer) {
+		params["charset"] = "utf-8"
+		out.ContentType = mime.FormatMediaType("text/plain", params)
+	}
+	return out, nil
+}
+
+// decorateMixed inserts header and footer as the first and last parts of
+// a multipart/mixed body.
+// It reports false if the part delimiters could not be located.
+func decorateMixed(msg *Message, boundary, header, footer string) (*Message, bool, error) {
+	if boundary == "" {
+		return nil, false, nil
+	}
+
+	const window = 64 << 10
+	var (
+		r, n  = msg.bodyReaderAt()
+		delim = []byte("--" + boundary)
+		beg   = int64(0) // insertion point of the header part.
+		end   = n        // insertion point of the footer part.
+	)
+
+	if header != "" {
+		head, err := readAt(r, 0, min64(n, window))
+		if err != nil {
+			return nil, false, err
+		}
+		i := indexLine(head, delim)
+		if i < 0 {
+			return nil, false, nil
+		}
+		beg = int64(i)
+	}
+
+	if footer != "" {
+		size := min64(n, window)
+		tail, err := readAt(r, n-size, size)
+		if err != nil {
+			return nil, false, err
+		}
+		i := lastIndexLine(tail, append(delim, '-', '-'))
+		if i < 0 {
+			return nil, false, nil
+		}
+		// the CRLF preceding the close delimiter is part of the delimiter.
+		if i > 0 && tail[i-1] == '\n' {
+			i--
+			if i > 0 && tail[i-1] == '\r' {
+				i--
+			}
+		}
+		end = n - size + int64(i)
+	}
+
+	if beg > end {
+		return nil, false, nil
+	}
+
+	body := new(spool)
+	err := writeAll(body,
+		io.NewSectionReader(r, 0, beg),
+		strings.NewReader(textPart(boundary, header, false)),
+		io.NewSectionReader(r, beg, end-beg),
+		strings.NewReader(textPart(boundary, footer, true)),
+		io.NewSectionReader(r, end, n-end),
+	)
+	if err != nil {
+		body.Close()
+		return nil, false, err
+	}
+	return msg.withBody(body), true, nil
+}
+
+// wrapMixed wraps the body of msg into a new multipart/mixed body, surrounded
+// by the header and footer parts.
+func wrapMixed(msg *Message, header, footer string) (*Message, error) {
+	var (
+		r, n     = msg.bodyReaderAt()
+		boundary = multipart.NewWriter(ioutil.Discard).Boundary()
+		ctype    = msg.ContentType
+		enc      = strings.ToLower(msg.Encoding)
+	)
+	if ctype == "" {
+		ctype = "text/plain"
+	}
+
+	orig := new(bytes.Buffer)
+	orig.WriteString("--" + boundary + "\r\n")
+	orig.WriteString("Content-Type: " + ctype + "\r\n")
+	if enc != "" {
+		orig.WriteString("Content-Transfer-Encoding: " + msg.Encoding + "\r\n")
+	}
+	orig.WriteString("\r\n")
+
+	body := new(spool)
+	err := writeAll(body,
+		strings.NewReader(strings.TrimPrefix(textPart(boundary, header, false), "\r\n")),
+		orig,
+		io.NewSectionReader(r, 0, n),
+		strings.NewReader(textPart(boundary, footer, true)),
+		strings.NewReader("\r\n--"+boundary+"--\r\n"),
+	)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	out := msg.withBody(body)
+	out.ContentType = mime.FormatMediaType("multipart/mixed", map[string]string{
+		"boundary": boundary,
+	})
+	out.Encoding = ""
+	switch enc {
+	case "8bit", "binary":
+		out.Encoding = enc
+	}
+	return out, nil
+}
+
+// textPart returns an inline text/plain MIME part holding txt.
+// Parts inserted before an existing delimiter end with a CRLF, parts
+// inserted before the CRLF of a delimiter start with one.
+func textPart(boundary, txt string, before bool) string {
+	if txt == "" {
+		return ""
+	}
+	part := "--" + boundary + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"\r\n" +
+		qpEncode(txt)
+	if before {
+		return "\r\n" + strings.TrimSuffix(part, "\r\n")
+	}
+	return part + "\r\n"
+}
+
+// withBody returns a copy of msg with the given body.
+func (msg *Message) withBody(body *spool) *Message {
+	out := *msg
+	out.Body = ""
+	out.spool = nil
+	switch {
+	case body.onDisk():
+		out.spool = body
+	default:
+		out.Body = body.String()
+	}
+	return &out
+}
+
+func qpEncode(txt string) string {
+	buf := new(bytes.Buffer)
+	w := quotedprintable.NewWriter(buf)
+	io.WriteString(w, txt)
+	w.Close()
+	return buf.String()
+}
+
+// crlf normalizes line endings to CRLF and makes sure a non-empty text ends
+// with one.
+func crlf(txt string) string {
+	if txt == "" {
+		return ""
+	}
+	txt = strings.Replace(txt, "\r\n", "\n", -1)
+	txt = strings.Replace(txt, "\n", "\r\n", -1)
+	if !strings.HasSuffix(txt, "\r\n") {
+		txt += "\r\n"
+	}
+	return txt
+}
+
+func isASCII(txt string) bool {
+	for i := 0; i < len(txt); i++ {
+		if txt[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func endsWithEOL(r io.ReaderAt, n int64) bool {
+	last, err := readAt(r, n-1, 1)
+	return err == nil && last[0] == '\n'
+}
+
+func readAt(r io.ReaderAt, off, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	_, err := r.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf, err
+}
+
+// indexLine returns the index of the first occurrence of sep starting a line
+// of buf, or -1.
+func indexLine(buf, sep []byte) int {
+	for i := 0; i < len(buf); {
+		j := bytes.Index(buf[i:], sep)
+		if j < 0 {
+			return -1
+		}
+		j += i
+		if j == 0 || buf[j-1] == '\n' {
+			return j
+		}
+		i = j + 1
+	}
+	return -1
+}
+
+// lastIndexLine returns the index of the last occurrence of sep starting
+// a line of buf, or -1.
+func lastIndexLine(buf, sep []byte) int {
+	for end := len(buf); end > 0; {
+		j := bytes.LastIndex(buf[:end], sep)
+		if j < 0 {
+			return -1
+		}
+		if j == 0 || buf[j-1] == '\n' {
+			return j
+		}
+		end = j + len(sep) - 1
+	}
+	return -1
+}
+
+func writeAll(w io.Writer, rs ...io.Reader) error {
+	_, err := io.Copy(w, io.MultiReader(rs...))
+	return err
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestDecorate(t *testing.T) {
+	const (
+		header = "Posted to golang\r\n"
+		footer = "-- \r\nTo unsubscribe, email lists@example.com\r\n"
+	)
+
+	for _, tc := range []struct {
+		name  string
+		msg   Message
+		parts []string // expected parts of a multipart/mixed result.
+		text  string   // expected body of a text/plain result.
+		same  bool     // whether the message should be left untouched.
+	}{
+		{
+			name: "text/plain",
+			msg:  Message{Body: "hello\r\n"},
+			text: header + "hello\r\n" + footer,
+		},
+		{
+			name: "text/plain-no-eol",
+			msg:  Message{ContentType: "text/plain; charset=us-ascii", Body: "hello"},
+			text: header + "hello\r\n" + footer,
+		},
+		{
+			name: "text/plain-base64",
+			msg:  Message{ContentType: "text/plain", Encoding: "base64", Body: "aGVsbG8NCg==\r\n"},
+			parts: []string{
+				header,
+				"hello\r\n",
+				footer,
+			},
+		},
+		{
+			name: "multipart/mixed",
+			msg: Message{
+				ContentType: `multipart/mixed; boundary="xxx"`,
+				Body: "preamble\r\n" +
+					"--xxx\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+					"--xxx\r\nContent-Type: text/x-go\r\n\r\npackage main\r\n" +
+					"--xxx--\r\n",
+			},
+			parts: []string{
+				header,
+				"hello",
+				"package main",
+				footer,
+			},
+		},
+		{
+			name: "text/html",
+			msg:  Message{ContentType: "text/html", Body: "<p>hello</p>"},
+			parts: []string{
+				header,
+				"<p>hello</p>",
+				footer,
+			},
+		},
+		{
+			name: "multipart/signed",
+			msg: Message{
+				ContentType: `multipart/signed; boundary="xxx"; protocol="application/pgp-signature"`,
+				Body:        "--xxx\r\n\r\nhello\r\n--xxx\r\n\r\nsig\r\n--xxx--\r\n",
+			},
+			same: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &tc.msg
+			out, err := decorate(msg, header, footer)
+			if err != nil {
+				t.Fatalf("could not decorate message: %v", err)
+			}
+			defer out.Close()
+
+			if tc.same {
+				if out != msg {
+					t.Fatalf("message should have been left untouched")
+				}
+				return
+			}
+
+			if tc.parts == nil {
+				if got, want := out.Body, tc.text; got != want {
+					t.Fatalf("invalid body:\ngot= %q\nwant=%q", got, want)
+				}
+				return
+			}
+
+			media, params, err := mime.ParseMediaType(out.ContentType)
+			if err != nil {
+				t.Fatalf("invalid content type %q: %v", out.ContentType, err)
+			}
+			if media != "multipart/mixed" {
+				t.Fatalf("invalid content type %q", media)
+			}
+			mr := multipart.NewReader(out.BodyReader(), params["boundary"])
+			var parts []string
+			for {
+				p, err := mr.NextPart()
+				if err != nil {
+					break
+				}
+				raw, err := ioutil.ReadAll(p)
+				if err != nil {
+					t.Fatalf("could not read part: %v", err)
+				}
+				if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+					raw, _ = ioutil.ReadAll(base64Reader(string(raw)))
+				}
+				parts = append(parts, string(raw))
+			}
+			if len(parts) != len(tc.parts) {
+				t.Fatalf("invalid number of parts: got=%d, want=%d\n%q", len(parts), len(tc.parts), parts)
+			}
+			for i := range parts {
+				if !strings.Contains(parts[i], strings.TrimSpace(tc.parts[i])) {
+					t.Fatalf("invalid part #%d:\ngot= %q\nwant=%q", i, parts[i], tc.parts[i])
+				}
+			}
+		})
+	}
+}
+
+func base64Reader(s string) io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, strings.NewReader(s))
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ChainStatus is the validation status of an ARC chain (RFC 8617).
+type ChainStatus string
+
+const (
+	ChainNone ChainStatus = "none"
+	ChainPass ChainStatus = "pass"
+	ChainFail ChainStatus = "fail"
+)
+
+// maxInstance is the maximum number of ARC sets of a message.
+const maxInstance = 50
+
+// arcSet holds the header fields of an ARC set.
+type arcSet struct {
+	aar, ams, as *Field
+}
+
+// VerifyChain validates the ARC chain of the message made of the header
+// section hdr and the body of the given size.
+// It returns the status of the chain and the instance of its last ARC set.
+func VerifyChain(ctx context.Context, r Resolver, hdr []byte, body io.ReaderAt, size int64) (ChainStatus, int) {
+	sets, n, err := arcSets(ParseHeader(hdr))
+	switch {
+	case err != nil:
+		return ChainFail, n
+	case n == 0:
+		return ChainNone, 0
+	}
+
+	for i := 1; i <= n; i++ {
+		tags, err := parseTags(sets[i].as.Value())
+		if err != nil {
+			return ChainFail, n
+		}
+		cv := ChainStatus(strings.ToLower(tags["cv"]))
+		switch {
+		case i == 1 && cv != ChainNone:
+			return ChainFail, n
+		case i > 1 && cv != ChainPass:
+			return ChainFail, n
+		}
+	}
+
+	fields := ParseHeader(hdr)
+	ams, err := parseSignature(*sets[n].ams, true)
+	if err != nil {
+		return ChainFail, n
+	}
+	st, _ := ams.verify(ctx, r, fields, body, size)
+	if st != Pass {
+		return ChainFail, n
+	}
+
+	for i := n; i >= 1; i-- {
+		st, _ := verifySeal(ctx, r, sets, i)
+		if st != Pass {
+			return ChainFail, n
+		}
+	}
+	return ChainPass, n
+}
+
+// arcSets collects the ARC sets of a message, by instance.
+// It returns the highest instance found.
+func arcSets(fields []Field) (map[int]*arcSet, int, error) {
+	var (
+		sets = make(map[int]*arcSet)
+		n    = 0
+	)
+	for i := range fields {
+		f := &fields[i]
+		var slot **Field
+		name := strings.ToLower(f.Name)
+		switch name {
+		case "arc-authentication-results", "arc-message-signature", "arc-seal":
+		default:
+			continue
+		}
+		inst, err := instance(f.Value())
+		if err != nil {
+			return nil, n, err
+		}
+		if inst > n {
+			n = inst
+		}
+		set, ok := sets[inst]
+		if !ok {
+			set = new(arcSet)
+			sets[inst] = set
+		}
+		switch name {
+		case "arc-authentication-results":
+			slot = &set.aar
+		case "arc-message-signature":
+			slot = &set.ams
+		case "arc-seal":
+			slot = &set.as
+		}
+		if *slot != nil {
+			return nil, n, fmt.Errorf("strew/dkim: duplicate %s header field for instance %d", f.Name, inst)
+		}
+		*slot = f
+	}
+
+	if n > maxInstance {
+		return nil, n, fmt.Errorf("strew/dkim: too many ARC sets (%d)", n)
+	}
+	for i := 1; i <= n; i++ {
+		set, ok := sets[i]
+		if !ok || set.aar == nil || set.ams == nil || set.as == nil {
+			return nil, n, fmt.Errorf("strew/dkim: incomplete ARC set %d", i)
+		}
+	}
+	return sets, n, nil
+}
+
+// instance returns the value of the i= tag starting an ARC header field.
+func instance(v string) (int, error) {
+	tag := strings.TrimSpace(strings.SplitN(v, ";", 2)[0])
+	if !strings.HasPrefix(tag, "i=") {
+		return 0, errors.New("strew/dkim: missing ARC instance tag")
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(tag[2:]))
+	if err != nil || i < 1 {
+		return 0, fmt.Errorf("strew/dkim: invalid ARC instance %q", tag)
+	}
+	return i, nil
+}
+
+// sealHash returns the hash signed by the ARC-Seal of instance n: the ARC
+// sets 1 to n, the last ARC-Seal having an empty b= tag.
+func sealHash(sets map[int]*arcSet, n int, seal string) []byte {
+	h := sha256.New()
+	for i := 1; i <= n; i++ {
+		set := sets[i]
+		io.WriteString(h, relaxedHeader(set.aar.Raw))
+		io.WriteString(h, relaxedHeader(set.ams.Raw))
+		if i < n {
+			io.WriteString(h, relaxedHeader(set.as.Raw))
+		}
+	}
+	io.WriteString(h, strings.TrimSuffix(relaxedHeader(seal), "\r\n"))
+	return h.Sum(nil)
+}
+
+func verifySeal(ctx context.Context, r Resolver, sets map[int]*arcSet, n int) (Status, error) {
+	as := sets[n].as
+	tags, err := parseTags(as.Value())
+	if err != nil {
+		return PermError, err
+	}
+	algo := strings.ToLower(tags["a"])
+	switch algo {
+	case "rsa-sha256", "ed25519-sha256":
+	default:
+		return PermError, fmt.Errorf("strew/dkim: unsupported algorithm %q", algo)
+	}
+	b, err := decodeB64(tags["b"])
+	if err != nil {
+		return PermError, err
+	}
+
+	key, st, err := lookupKey(ctx, r, tags["s"], strings.ToLower(tags["d"]))
+	if err != nil {
+		return st, err
+	}
+	return verifySum(key, algo, sealHash(sets, n, stripB(as.Raw)), b)
+}
+
+// Seal computes a new ARC set for the message made of the header section
+// hdr (including the previous ARC sets, if any) and body.
+//
+// cv is the validation status of the current ARC chain, as reported by
+// VerifyChain, and i the instance of the new set.
+// results holds the authentication results of the message, formatted as the
+// value of an Authentication-Results header field ("authserv-id; results").
+//
+// Seal returns the ARC-Seal, ARC-Message-Signature and
+// ARC-Authentication-Results header fields to prepend to the message,
+// including their trailing CRLF.
+func (s *Signer) Seal(hdr []byte, body io.Reader, i int, cv ChainStatus, results string) (string, error) {
+	if i < 1 || i > maxInstance {
+		return "", fmt.Errorf("strew/dkim: invalid ARC instance %d", i)
+	}
+
+	algo, err := algorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	bh, err := BodyHash(body)
+	if err != nil {
+		return "", err
+	}
+
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+	fields := ParseHeader(hdr)
+	signed := selectHeaders(fields, names)
+	var hnames []string
+	for _, f := range signed {
+		hnames = append(hnames, strings.ToLower(f.Name))
+	}
+	t := fmt.Sprintf("%d", s.time().Unix())
+
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s", i, results)
+	ams := fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed;\r\n", i, algo) +
+		"\td=" + s.Domain + "; s=" + s.Selector + "; t=" + t + ";\r\n" +
+		"\th=" + strings.Join(hnames, ":") + ";\r\n" +
+		"\tbh=" + bh + ";\r\n" +
+		"\tb="
+	b, err := sign(s.Key, signed, ams)
+	if err != nil {
+		return "", err
+	}
+	ams += fold(b)
+
+	sets, n, err := arcSets(fields)
+	if err != nil || n != i-1 {
+		// a broken chain is sealed with cv=fail.
+		cv = ChainFail
+		sets, n = make(map[int]*arcSet), 0
+	}
+	if i == 1 {
+		cv = ChainNone
+	}
+
+	as := fmt.Sprintf("ARC-Seal: i=%d; a=%s; t=%s; cv=%s;\r\n", i, algo, t, cv) +
+		"\td=" + s.Domain + "; s=" + s.Selector + ";\r\n" +
+		"\tb="
+	var prev map[int]*arcSet
+	switch {
+	case cv == ChainFail:
+		// only the new set is signed for a failed chain. (RFC 8617, 5.1.2)
+		prev = map[int]*arcSet{1: {aar: &Field{Raw: aar}, ams: &Field{Raw: ams}}}
+	default:
+		prev = sets
+		prev[i] = &arcSet{aar: &Field{Raw: aar}, ams: &Field{Raw: ams}}
+	}
+	sum := sealHash(prev, len(prev), as)
+	sb, err := signSum(s.Key, sum)
+	if err != nil {
+		return "", err
+	}
+	as += fold(sb)
+
+	return as + "\r\n" + ams + "\r\n" + aar + "\r\n", nil
+}
+
+func decodeB64(v string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "strew/dkim: invalid signature data")
+	}
+	return b, nil
+}
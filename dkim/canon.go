@@ -0,0 +1,146 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Field is a header field, as it appears in a message.
+type Field struct {
+	Name string // name of the field, as written.
+	Raw  string // whole field, including its name and folding whitespace. No trailing CRLF.
+}
+
+// Value returns the unfolded value of the field.
+func (f Field) Value() string {
+	i := strings.Index(f.Raw, ":")
+	v := strings.Replace(f.Raw[i+1:], "\r\n", "", -1)
+	return strings.TrimSpace(v)
+}
+
+// ParseHeader splits the header section of a message into fields.
+func ParseHeader(hdr []byte) []Field {
+	var fields []Field
+	for _, line := range strings.SplitAfter(string(hdr), "\n") {
+		if line == "" || line == "\r\n" || line == "\n" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			// continuation line.
+			fields[len(fields)-1].Raw += "\r\n" + trimEOL(line)
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		fields = append(fields, Field{
+			Name: strings.TrimSpace(line[:i]),
+			Raw:  trimEOL(line),
+		})
+	}
+	return fields
+}
+
+func trimEOL(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r")
+}
+
+// relaxedHeader returns the relaxed canonicalization of a header field,
+// including its trailing CRLF. (RFC 6376, 3.4.2)
+func relaxedHeader(raw string) string {
+	i := strings.Index(raw, ":")
+	name := strings.ToLower(strings.TrimSpace(raw[:i]))
+	value := raw[i+1:]
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	value = strings.TrimSpace(compressWSP(value))
+	return name + ":" + value + "\r\n"
+}
+
+// compressWSP replaces runs of whitespace with a single space.
+func compressWSP(s string) string {
+	var (
+		out = make([]byte, 0, len(s))
+		wsp = false
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t':
+			wsp = true
+		default:
+			if wsp {
+				out = append(out, ' ')
+				wsp = false
+			}
+			out = append(out, c)
+		}
+	}
+	if wsp {
+		out = append(out, ' ')
+	}
+	return string(out)
+}
+
+// relaxedBody is a writer applying the relaxed body canonicalization
+// to the data written to it. (RFC 6376, 3.4.4)
+type relaxedBody struct {
+	w     io.Writer
+	line  []byte
+	empty int // number of pending empty lines.
+	err   error
+}
+
+func (rb *relaxedBody) Write(p []byte) (int, error) {
+	if rb.err != nil {
+		return 0, rb.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			rb.line = append(rb.line, p...)
+			break
+		}
+		rb.line = append(rb.line, p[:i]...)
+		rb.flush()
+		p = p[i+1:]
+	}
+	return n, rb.err
+}
+
+func (rb *relaxedBody) flush() {
+	line := bytes.TrimSuffix(rb.line, []byte("\r"))
+	line = []byte(strings.TrimRight(compressWSP(string(line)), " "))
+	rb.line = rb.line[:0]
+	if len(line) == 0 {
+		rb.empty++
+		return
+	}
+	for ; rb.empty > 0; rb.empty-- {
+		rb.write([]byte("\r\n"))
+	}
+	rb.write(line)
+	rb.write([]byte("\r\n"))
+}
+
+func (rb *relaxedBody) write(p []byte) {
+	if rb.err != nil {
+		return
+	}
+	_, rb.err = rb.w.Write(p)
+}
+
+// Close flushes the last, incomplete, line.
+// Trailing empty lines are dropped.
+func (rb *relaxedBody) Close() error {
+	if len(rb.line) > 0 {
+		rb.flush()
+	}
+	return rb.err
+}
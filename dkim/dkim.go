@@ -0,0 +1,217 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dkim implements DKIM (RFC 6376) signatures of messages,
+// with the rsa-sha256 and ed25519-sha256 (RFC 8463) algorithms and the
+// relaxed/relaxed canonicalization.
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHeaders is the default list of signed header fields.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Sender", "Subject", "Date",
+	"To", "Cc", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-ID", "List-Post", "List-Unsubscribe", "List-Help", "X-Mailing-List",
+}
+
+// Signer signs messages on behalf of a domain.
+type Signer struct {
+	Domain   string        // signing domain (d=).
+	Selector string        // selector of the public key (s=).
+	Key      crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey.
+	Headers  []string      // names of the header fields to sign. DefaultHeaders if empty.
+
+	now func() time.Time
+}
+
+// LoadKey loads a PEM encoded RSA or Ed25519 private key from a file.
+func LoadKey(fname string) (crypto.Signer, error) {
+	raw, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ParseKey(raw)
+}
+
+// ParseKey parses a PEM encoded PKCS#1 RSA key or PKCS#8 RSA or Ed25519 key.
+func ParseKey(raw []byte) (crypto.Signer, error) {
+	blk, _ := pem.Decode(raw)
+	if blk == nil {
+		return nil, errors.New("strew/dkim: no PEM block found")
+	}
+	switch blk.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(blk.Bytes)
+		return key, errors.WithStack(err)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("strew/dkim: unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("strew/dkim: unsupported PEM block %q", blk.Type)
+}
+
+func algorithm(key crypto.Signer) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("strew/dkim: unsupported private key type %T", key)
+}
+
+// Sign computes the DKIM signature of the message made of the header section
+// hdr (without the empty line separating it from the body) and body.
+// It returns the DKIM-Signature header field to prepend to the message,
+// including its trailing CRLF.
+func (s *Signer) Sign(hdr []byte, body io.Reader) (string, error) {
+	algo, err := algorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+
+	bh, err := BodyHash(body)
+	if err != nil {
+		return "", err
+	}
+
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+	fields := ParseHeader(hdr)
+	signed := selectHeaders(fields, names)
+
+	var hnames []string
+	for _, f := range signed {
+		hnames = append(hnames, strings.ToLower(f.Name))
+	}
+
+	sig := "DKIM-Signature: v=1; a=" + algo + "; c=relaxed/relaxed;\r\n" +
+		"\td=" + s.Domain + "; s=" + s.Selector + "; t=" + fmt.Sprintf("%d", s.time().Unix()) + ";\r\n" +
+		"\th=" + strings.Join(hnames, ":") + ";\r\n" +
+		"\tbh=" + bh + ";\r\n" +
+		"\tb="
+
+	b, err := sign(s.Key, signed, sig)
+	if err != nil {
+		return "", err
+	}
+	return sig + fold(b) + "\r\n", nil
+}
+
+// BodyHash returns the base64 encoded SHA-256 hash of the relaxed
+// canonicalization of body.
+func BodyHash(body io.Reader) (string, error) {
+	h := sha256.New()
+	cb := &relaxedBody{w: h}
+	_, err := io.Copy(cb, body)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	err = cb.Close()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// selectHeaders returns the fields to sign, in the order of names.
+// Multiple instances of a field are signed from the bottom up.
+func selectHeaders(fields []Field, names []string) []Field {
+	var (
+		out  []Field
+		used = make(map[int]bool)
+	)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fields[i].Name, name) {
+				continue
+			}
+			used[i] = true
+			out = append(out, fields[i])
+			break
+		}
+	}
+	return out
+}
+
+// headerHash returns the SHA-256 hash of the canonicalized signed fields,
+// followed by the canonicalized signature field sig, whose b= tag is empty.
+func headerHash(signed []Field, sig string) []byte {
+	h := sha256.New()
+	for _, f := range signed {
+		io.WriteString(h, relaxedHeader(f.Raw))
+	}
+	io.WriteString(h, strings.TrimSuffix(relaxedHeader(sig), "\r\n"))
+	return h.Sum(nil)
+}
+
+func (s *Signer) time() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func sign(key crypto.Signer, signed []Field, sig string) (string, error) {
+	return signSum(key, headerHash(signed, sig))
+}
+
+// signSum signs the SHA-256 hash sum and returns the base64 encoded signature.
+func signSum(key crypto.Signer, sum []byte) (string, error) {
+	var (
+		b   []byte
+		err error
+	)
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		b, err = key.Sign(rand.Reader, sum, crypto.Hash(0))
+	default:
+		b, err = key.Sign(rand.Reader, sum, crypto.SHA256)
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// fold folds a base64 value over multiple lines.
+func fold(v string) string {
+	const width = 72
+	var parts []string
+	for len(v) > width {
+		parts = append(parts, v[:width])
+		v = v[width:]
+	}
+	parts = append(parts, v)
+	return strings.Join(parts, "\r\n\t ")
+}
@@ -0,0 +1,294 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalization(t *testing.T) {
+	// example from RFC 6376, section 3.4.5.
+	hdr := "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	var got string
+	for _, f := range ParseHeader([]byte(hdr)) {
+		got += relaxedHeader(f.Raw)
+	}
+	if want := "a:X\r\nb:Y Z\r\n"; got != want {
+		t.Fatalf("invalid header canonicalization:\ngot= %q\nwant=%q", got, want)
+	}
+
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{" C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n"},
+		{"", ""},
+		{"\r\n\r\n", ""},
+		{"no eol", "no eol\r\n"},
+		{"bare\nlf\n\nx", "bare\r\nlf\r\n\r\nx\r\n"},
+	} {
+		buf := new(bytes.Buffer)
+		rb := &relaxedBody{w: buf}
+		// write byte per byte to exercise line buffering.
+		for i := 0; i < len(tc.body); i++ {
+			rb.Write([]byte{tc.body[i]})
+		}
+		rb.Close()
+		if got := buf.String(); got != tc.want {
+			t.Fatalf("invalid body canonicalization of %q:\ngot= %q\nwant=%q", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		hdr = "From: Alice <alice@example.com>\r\n" +
+			"To: golang@example.com\r\n" +
+			"Subject: [golang]  hello\r\n" +
+			"List-ID: golang <golang@example.com>\r\n"
+		body = "hello  world \r\n\r\n"
+	)
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		s := &Signer{
+			Domain:   "example.com",
+			Selector: "strew",
+			Key:      key,
+			Headers:  []string{"From", "To", "Subject", "List-ID", "Cc"},
+			now:      func() time.Time { return time.Unix(1500000000, 0) },
+		}
+		sig, err := s.Sign([]byte(hdr), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not sign: %v", err)
+		}
+
+		if !strings.Contains(sig, "h=from:to:subject:list-id;") {
+			t.Fatalf("invalid signed headers:\n%s", sig)
+		}
+		bh, _ := BodyHash(strings.NewReader("hello world\r\n"))
+		if !strings.Contains(sig, "bh="+bh+";") {
+			t.Fatalf("invalid body hash:\n%s", sig)
+		}
+
+		// check the signature itself.
+		re := regexp.MustCompile(`(?s)b=(.*)\r\n$`)
+		m := re.FindStringSubmatch(sig)
+		if m == nil {
+			t.Fatalf("no signature found:\n%s", sig)
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.NewReplacer("\r\n", "", "\t", "", " ", "").Replace(m[1]))
+		if err != nil {
+			t.Fatalf("could not decode signature: %v", err)
+		}
+		unsigned := strings.TrimSuffix(sig, m[0]) + "b="
+		sum := headerHash(selectHeaders(ParseHeader([]byte(hdr)), s.Headers), unsigned)
+
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum, b)
+			if err != nil {
+				t.Fatalf("invalid rsa signature: %v", err)
+			}
+		case ed25519.PrivateKey:
+			if !ed25519.Verify(key.Public().(ed25519.PublicKey), sum, b) {
+				t.Fatalf("invalid ed25519 signature")
+			}
+		}
+	}
+}
+
+type fakeDNS map[string][]string
+
+func (dns fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, ok := dns[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return v, nil
+}
+
+func publish(t *testing.T, dns fakeDNS, s *Signer) {
+	t.Helper()
+	var rec string
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PrivateKey:
+		rec = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	}
+	dns[s.Selector+"._domainkey."+s.Domain] = []string{rec}
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		hdr = "From: Alice <alice@example.com>\r\n" +
+			"To: golang@example.com\r\n" +
+			"Subject: hello\r\n"
+		body = "hello world\r\n"
+	)
+
+	dns := make(fakeDNS)
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		s := &Signer{Domain: "example.com", Selector: "sel", Key: key}
+		publish(t, dns, s)
+
+		sig, err := s.Sign([]byte(hdr), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not sign: %v", err)
+		}
+
+		for _, tc := range []struct {
+			hdr  string
+			body string
+			want Status
+		}{
+			{hdr, body, Pass},
+			{hdr, "hello  world \r\n\r\n", Pass},
+			{hdr, "hello world!\r\n", Fail},
+			{strings.Replace(hdr, "hello", "HELLO", 1), body, Fail},
+			{"X-Added: ok\r\n" + hdr, body, Pass},
+		} {
+			res := Verify(context.Background(), dns, []byte(sig+tc.hdr), strings.NewReader(tc.body), int64(len(tc.body)))
+			if len(res) != 1 {
+				t.Fatalf("invalid number of results: %d", len(res))
+			}
+			if res[0].Status != tc.want {
+				t.Fatalf("%T: invalid status for %q/%q: got=%q, want=%q (err=%v)", key, tc.hdr, tc.body, res[0].Status, tc.want, res[0].Err)
+			}
+		}
+	}
+
+	// unknown key.
+	s := &Signer{Domain: "example.org", Selector: "sel", Key: rsaKey}
+	sig, err := s.Sign([]byte(hdr), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := Verify(context.Background(), dns, []byte(sig+hdr), strings.NewReader(body), int64(len(body)))
+	if res[0].Status != PermError {
+		t.Fatalf("invalid status for an unknown key: %q", res[0].Status)
+	}
+}
+
+func TestVerifyBodyLength(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Signer{Domain: "example.com", Selector: "sel", Key: key}
+	dns := make(fakeDNS)
+	publish(t, dns, s)
+
+	const (
+		hdr  = "From: Alice <alice@example.com>\r\nSubject: hello\r\n"
+		body = "hello world\r\n"
+	)
+	bh, err := BodyHash(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed; d=example.com; s=sel;\r\n" +
+		"\th=from:subject; l=13; bh=" + bh + "; b="
+	b, err := sign(key, selectHeaders(ParseHeader([]byte(hdr)), []string{"from", "subject"}), sig)
+	if err != nil {
+		t.Fatalf("could not sign: %v", err)
+	}
+	sig += b + "\r\n"
+
+	for _, tc := range []struct {
+		body string
+		want Status
+	}{
+		{body, Pass},
+		{body + "\r\n", Pass}, // trailing empty lines are not part of the canonical body.
+		{body + "click here\r\n", PermError},
+	} {
+		res := Verify(context.Background(), dns, []byte(sig+hdr), strings.NewReader(tc.body), int64(len(tc.body)))
+		if len(res) != 1 || res[0].Status != tc.want {
+			t.Fatalf("invalid results for %q: got=%+v, want=%q", tc.body, res, tc.want)
+		}
+	}
+}
+
+func TestARC(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dns := make(fakeDNS)
+	s1 := &Signer{Domain: "lists.example.com", Selector: "arc", Key: key}
+	s2 := &Signer{Domain: "relay.example.org", Selector: "arc", Key: key}
+	publish(t, dns, s1)
+	publish(t, dns, s2)
+
+	var (
+		hdr  = "From: Alice <alice@example.com>\r\nTo: golang@example.com\r\nSubject: hello\r\n"
+		body = "hello world\r\n"
+		ctx  = context.Background()
+	)
+
+	verify := func() (ChainStatus, int) {
+		return VerifyChain(ctx, dns, []byte(hdr), strings.NewReader(body), int64(len(body)))
+	}
+
+	cv, n := verify()
+	if cv != ChainNone || n != 0 {
+		t.Fatalf("invalid chain for a message without ARC sets: cv=%q, n=%d", cv, n)
+	}
+
+	for i, s := range []*Signer{s1, s2} {
+		set, err := s.Seal([]byte(hdr), strings.NewReader(body), n+1, cv, "lists.example.com; dkim=pass header.d=example.com")
+		if err != nil {
+			t.Fatalf("could not seal message: %v", err)
+		}
+		hdr = set + hdr
+		cv, n = verify()
+		if cv != ChainPass || n != i+1 {
+			t.Fatalf("invalid chain after %d seals: cv=%q, n=%d", i+1, cv, n)
+		}
+	}
+
+	// altering the message after it was sealed breaks the chain.
+	body = "hello world!\r\n"
+	cv, n = verify()
+	if cv != ChainFail || n != 2 {
+		t.Fatalf("invalid chain for an altered message: cv=%q, n=%d", cv, n)
+	}
+}
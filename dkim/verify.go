@@ -0,0 +1,429 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Status is the outcome of the verification of a signature.
+type Status string
+
+const (
+	None      Status = "none"
+	Pass      Status = "pass"
+	Fail      Status = "fail"
+	Neutral   Status = "neutral"
+	TempError Status = "temperror"
+	PermError Status = "permerror"
+)
+
+// Resolver looks up DNS TXT records.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Result is the outcome of the verification of a DKIM-Signature.
+type Result struct {
+	Domain   string // signing domain (d=).
+	Selector string // selector (s=).
+	Status   Status
+	Err      error // reason of a failed verification.
+}
+
+// Verify verifies the DKIM signatures of the message made of the header
+// section hdr and the body of the given size.
+// It returns one result per DKIM-Signature header field.
+func Verify(ctx context.Context, r Resolver, hdr []byte, body io.ReaderAt, size int64) []Result {
+	var (
+		fields = ParseHeader(hdr)
+		res    []Result
+	)
+	for _, f := range fields {
+		if !strings.EqualFold(f.Name, "DKIM-Signature") {
+			continue
+		}
+		sig, err := parseSignature(f, false)
+		if err != nil {
+			res = append(res, Result{Status: PermError, Err: err})
+			continue
+		}
+		st, err := sig.verify(ctx, r, fields, body, size)
+		res = append(res, Result{
+			Domain:   sig.domain,
+			Selector: sig.selector,
+			Status:   st,
+			Err:      err,
+		})
+	}
+	return res
+}
+
+// signature is a parsed DKIM-Signature or ARC-Message-Signature field.
+type signature struct {
+	field    Field
+	algo     string
+	domain   string
+	selector string
+	headers  []string
+	hcanon   string
+	bcanon   string
+	length   int64 // number of signed body bytes. -1 for the whole body.
+	bh       []byte
+	b        []byte
+}
+
+func parseSignature(f Field, arc bool) (*signature, error) {
+	tags, err := parseTags(f.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	if !arc && tags["v"] != "1" {
+		return nil, fmt.Errorf("strew/dkim: unsupported signature version %q", tags["v"])
+	}
+	for _, k := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[k]; !ok {
+			return nil, fmt.Errorf("strew/dkim: missing required tag %q", k)
+		}
+	}
+
+	sig := &signature{
+		field:    f,
+		algo:     strings.ToLower(tags["a"]),
+		domain:   strings.ToLower(tags["d"]),
+		selector: tags["s"],
+		hcanon:   "simple",
+		bcanon:   "simple",
+		length:   -1,
+	}
+
+	switch sig.algo {
+	case "rsa-sha256", "ed25519-sha256":
+	default:
+		return nil, fmt.Errorf("strew/dkim: unsupported algorithm %q", sig.algo)
+	}
+
+	if c, ok := tags["c"]; ok {
+		cs := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.hcanon = cs[0]
+		if len(cs) == 2 {
+			sig.bcanon = cs[1]
+		}
+		for _, v := range []string{sig.hcanon, sig.bcanon} {
+			if v != "simple" && v != "relaxed" {
+				return nil, fmt.Errorf("strew/dkim: unsupported canonicalization %q", c)
+			}
+		}
+	}
+
+	for _, h := range strings.Split(tags["h"], ":") {
+		h = strings.TrimSpace(h)
+		if h != "" {
+			sig.headers = append(sig.headers, h)
+		}
+	}
+	hasFrom := false
+	for _, h := range sig.headers {
+		hasFrom = hasFrom || strings.EqualFold(h, "From")
+	}
+	if !arc && !hasFrom {
+		return nil, errors.New("strew/dkim: From header field is not signed")
+	}
+
+	if l, ok := tags["l"]; ok {
+		sig.length, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || sig.length < 0 {
+			return nil, fmt.Errorf("strew/dkim: invalid body length %q", l)
+		}
+	}
+
+	sig.bh, err = base64.StdEncoding.DecodeString(tags["bh"])
+	if err != nil {
+		return nil, errors.Wrap(err, "strew/dkim: invalid body hash")
+	}
+	sig.b, err = base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return nil, errors.Wrap(err, "strew/dkim: invalid signature data")
+	}
+	return sig, nil
+}
+
+func (sig *signature) verify(ctx context.Context, r Resolver, fields []Field, body io.ReaderAt, size int64) (Status, error) {
+	bh, err := bodyHash(sig.bcanon, sig.length, io.NewSectionReader(body, 0, size))
+	switch {
+	case err == errPartialBody:
+		return PermError, err
+	case err != nil:
+		return TempError, err
+	}
+	if subtle.ConstantTimeCompare(bh, sig.bh) != 1 {
+		return Fail, errors.New("strew/dkim: body hash mismatch")
+	}
+
+	h := sha256.New()
+	for _, f := range selectHeaders(fields, sig.headers) {
+		io.WriteString(h, canonHeader(sig.hcanon, f.Raw))
+	}
+	io.WriteString(h, strings.TrimSuffix(canonHeader(sig.hcanon, stripB(sig.field.Raw)), "\r\n"))
+
+	key, st, err := lookupKey(ctx, r, sig.selector, sig.domain)
+	if err != nil {
+		return st, err
+	}
+	return verifySum(key, sig.algo, h.Sum(nil), sig.b)
+}
+
+// lookupKey retrieves the public key published for selector in domain.
+func lookupKey(ctx context.Context, r Resolver, selector, domain string) (crypto.PublicKey, Status, error) {
+	txts, err := r.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && !e.Temporary() {
+			return nil, PermError, errors.Wrap(err, "strew/dkim: no key for signature")
+		}
+		return nil, TempError, errors.WithStack(err)
+	}
+	if len(txts) == 0 {
+		return nil, PermError, errors.New("strew/dkim: no key for signature")
+	}
+
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, PermError, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, PermError, fmt.Errorf("strew/dkim: invalid key record version %q", v)
+	}
+	if tags["p"] == "" {
+		return nil, PermError, errors.New("strew/dkim: key revoked")
+	}
+	raw, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, PermError, errors.Wrap(err, "strew/dkim: invalid public key")
+	}
+
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(raw)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(raw)
+			if err != nil {
+				return nil, PermError, errors.Wrap(err, "strew/dkim: invalid public key")
+			}
+		}
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, PermError, fmt.Errorf("strew/dkim: invalid RSA public key type %T", pub)
+		}
+		return key, Pass, nil
+	case "ed25519":
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, PermError, errors.New("strew/dkim: invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(raw), Pass, nil
+	default:
+		return nil, PermError, fmt.Errorf("strew/dkim: unsupported key type %q", k)
+	}
+}
+
+func verifySum(key crypto.PublicKey, algo string, sum, b []byte) (Status, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if algo != "rsa-sha256" {
+			return PermError, errors.New("strew/dkim: key and algorithm mismatch")
+		}
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum, b)
+		if err != nil {
+			return Fail, errors.Wrap(err, "strew/dkim: invalid signature")
+		}
+	case ed25519.PublicKey:
+		if algo != "ed25519-sha256" {
+			return PermError, errors.New("strew/dkim: key and algorithm mismatch")
+		}
+		if !ed25519.Verify(key, sum, b) {
+			return Fail, errors.New("strew/dkim: invalid signature")
+		}
+	}
+	return Pass, nil
+}
+
+// parseTags parses a DKIM tag-list. (RFC 6376, 3.2)
+// Whitespace is removed from the values.
+func parseTags(v string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(v, ";") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("strew/dkim: invalid tag %q", tag)
+		}
+		k := strings.TrimSpace(kv[0])
+		if _, dup := tags[k]; dup {
+			return nil, fmt.Errorf("strew/dkim: duplicate tag %q", k)
+		}
+		tags[k] = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, kv[1])
+	}
+	return tags, nil
+}
+
+var reB = regexp.MustCompile(`([:;][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// stripB removes the value of the b= tag of a signature field.
+func stripB(raw string) string {
+	return reB.ReplaceAllString(raw, "$1")
+}
+
+func canonHeader(canon, raw string) string {
+	if canon == "relaxed" {
+		return relaxedHeader(raw)
+	}
+	return raw + "\r\n"
+}
+
+// errPartialBody is returned for signatures whose body length limit (l=)
+// leaves part of the body unsigned: such signatures would let anyone append
+// content to a signed message.
+var errPartialBody = errors.New("strew/dkim: body length limit does not cover the whole body")
+
+// bodyHash returns the SHA-256 hash of the canonicalized body, limited to
+// length bytes if length is positive.
+// errPartialBody is returned if the canonicalized body is longer than length.
+func bodyHash(canon string, length int64, body io.Reader) ([]byte, error) {
+	var (
+		h  hash.Hash = sha256.New()
+		w  io.Writer = h
+		lw *limitWriter
+	)
+	if length >= 0 {
+		lw = &limitWriter{w: h, n: length}
+		w = lw
+	}
+
+	var cw io.WriteCloser
+	switch canon {
+	case "relaxed":
+		cw = &relaxedBody{w: w}
+	default:
+		cw = &simpleBody{w: w}
+	}
+	_, err := io.Copy(cw, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = cw.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if lw != nil && lw.dropped {
+		return nil, errPartialBody
+	}
+	return h.Sum(nil), nil
+}
+
+// simpleBody is a writer applying the simple body canonicalization to the
+// data written to it. (RFC 6376, 3.4.3)
+type simpleBody struct {
+	w     io.Writer
+	line  []byte
+	empty int  // number of pending empty lines.
+	n     bool // whether any line has been written.
+	err   error
+}
+
+func (sb *simpleBody) Write(p []byte) (int, error) {
+	if sb.err != nil {
+		return 0, sb.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		i := strings.IndexByte(string(p), '\n')
+		if i < 0 {
+			sb.line = append(sb.line, p...)
+			break
+		}
+		sb.line = append(sb.line, p[:i]...)
+		sb.flush()
+		p = p[i+1:]
+	}
+	return n, sb.err
+}
+
+func (sb *simpleBody) flush() {
+	line := strings.TrimSuffix(string(sb.line), "\r")
+	sb.line = sb.line[:0]
+	if len(line) == 0 {
+		sb.empty++
+		return
+	}
+	for ; sb.empty > 0; sb.empty-- {
+		sb.write("\r\n")
+	}
+	sb.write(line + "\r\n")
+}
+
+func (sb *simpleBody) write(s string) {
+	if sb.err != nil {
+		return
+	}
+	sb.n = true
+	_, sb.err = io.WriteString(sb.w, s)
+}
+
+// Close flushes the last, incomplete, line.
+// Trailing empty lines are dropped and an empty body is canonicalized
+// as a single CRLF.
+func (sb *simpleBody) Close() error {
+	if len(sb.line) > 0 {
+		sb.flush()
+	}
+	if !sb.n {
+		sb.write("\r\n")
+	}
+	return sb.err
+}
+
+// limitWriter discards data written past its first n bytes.
+type limitWriter struct {
+	w       io.Writer
+	n       int64
+	dropped bool // whether data was discarded.
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if int64(len(p)) > lw.n {
+		p = p[:lw.n]
+		lw.dropped = true
+	}
+	_, err := lw.w.Write(p)
+	lw.n -= int64(len(p))
+	return n, err
+}
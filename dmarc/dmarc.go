@@ -0,0 +1,183 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dmarc implements DMARC (RFC 7489) policy records lookup.
+package dmarc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Policy is a DMARC policy, as requested by a domain owner.
+type Policy string
+
+const (
+	None       Policy = "none"
+	Quarantine Policy = "quarantine"
+	Reject     Policy = "reject"
+)
+
+// Alignment is a DMARC identifier alignment mode.
+type Alignment string
+
+const (
+	Relaxed Alignment = "r"
+	Strict  Alignment = "s"
+)
+
+var (
+	ErrNoPolicy = errors.New("strew/dmarc: no DMARC policy")
+	ErrSyntax   = errors.New("strew/dmarc: invalid DMARC record")
+)
+
+// Resolver looks up DNS TXT records.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Record is a DMARC policy record.
+type Record struct {
+	Policy          Policy    // p=
+	SubdomainPolicy Policy    // sp=, defaults to Policy.
+	Percent         int       // pct=, defaults to 100.
+	DKIM            Alignment // adkim=, defaults to Relaxed.
+	SPF             Alignment // aspf=, defaults to Relaxed.
+}
+
+// Parse parses the content of a DMARC TXT record.
+func Parse(txt string) (*Record, error) {
+	rec := &Record{
+		Percent: 100,
+		DKIM:    Relaxed,
+		SPF:     Relaxed,
+	}
+
+	for i, tag := range strings.Split(txt, ";") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Wrapf(ErrSyntax, "tag %q", tag)
+		}
+		k := strings.TrimSpace(kv[0])
+		v := strings.TrimSpace(kv[1])
+		if i == 0 {
+			if k != "v" || v != "DMARC1" {
+				return nil, errors.Wrapf(ErrSyntax, "invalid version tag %q", tag)
+			}
+			continue
+		}
+
+		switch k {
+		case "p", "sp":
+			p, err := parsePolicy(v)
+			if err != nil {
+				return nil, err
+			}
+			if k == "p" {
+				rec.Policy = p
+			} else {
+				rec.SubdomainPolicy = p
+			}
+		case "pct":
+			pct, err := strconv.Atoi(v)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, errors.Wrapf(ErrSyntax, "invalid pct %q", v)
+			}
+			rec.Percent = pct
+		case "adkim", "aspf":
+			a := Alignment(strings.ToLower(v))
+			if a != Relaxed && a != Strict {
+				return nil, errors.Wrapf(ErrSyntax, "invalid alignment %q", tag)
+			}
+			if k == "adkim" {
+				rec.DKIM = a
+			} else {
+				rec.SPF = a
+			}
+		}
+	}
+
+	if rec.Policy == "" {
+		return nil, errors.Wrap(ErrSyntax, "missing policy")
+	}
+	if rec.SubdomainPolicy == "" {
+		rec.SubdomainPolicy = rec.Policy
+	}
+	return rec, nil
+}
+
+func parsePolicy(v string) (Policy, error) {
+	p := Policy(strings.ToLower(v))
+	switch p {
+	case None, Quarantine, Reject:
+		return p, nil
+	}
+	return "", errors.Wrapf(ErrSyntax, "invalid policy %q", v)
+}
+
+// Lookup retrieves the DMARC record applying to domain.
+// If domain publishes no record, the record of its organizational domain is
+// used, with its subdomain policy.
+// ErrNoPolicy is returned when no record could be found.
+func Lookup(ctx context.Context, r Resolver, domain string) (*Record, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	rec, err := lookup(ctx, r, domain)
+	if err != ErrNoPolicy {
+		return rec, err
+	}
+
+	org, err := OrganizationalDomain(domain)
+	if err != nil || org == domain {
+		return nil, ErrNoPolicy
+	}
+	rec, err = lookup(ctx, r, org)
+	if err != nil {
+		return nil, err
+	}
+	rec.Policy = rec.SubdomainPolicy
+	return rec, nil
+}
+
+func lookup(ctx context.Context, r Resolver, domain string) (*Record, error) {
+	txts, err := r.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && !e.Temporary() {
+			return nil, ErrNoPolicy
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	var recs []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			recs = append(recs, txt)
+		}
+	}
+	// a domain publishing more than one record has no policy. (RFC 7489, 6.6.3)
+	if len(recs) != 1 {
+		return nil, ErrNoPolicy
+	}
+	return Parse(recs[0])
+}
+
+// OrganizationalDomain returns the organizational domain of domain,
+// as defined in RFC 7489, section 3.2.
+func OrganizationalDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return org, nil
+}
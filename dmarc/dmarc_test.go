@@ -0,0 +1,70 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dmarc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type fakeDNS map[string][]string
+
+func (dns fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := dns[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func TestLookup(t *testing.T) {
+	dns := fakeDNS{
+		"_dmarc.example.com":     {"v=DMARC1; p=reject; sp=quarantine; adkim=s"},
+		"_dmarc.example.org":     {"v=DMARC1; p=none"},
+		"_dmarc.sub.example.org": {"v=DMARC1; p=reject"},
+		"_dmarc.example.net":     {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.example.co.uk":   {"v=DMARC1; p=quarantine"},
+		"_dmarc.invalid.com":     {"v=DMARC1; p=bogus"},
+	}
+
+	for _, tc := range []struct {
+		domain string
+		want   Policy
+		err    bool
+	}{
+		{domain: "example.com", want: Reject},
+		{domain: "EXAMPLE.com.", want: Reject},
+		{domain: "mail.example.com", want: Quarantine},
+		{domain: "example.org", want: None},
+		{domain: "sub.example.org", want: Reject},
+		{domain: "other.sub.example.org", want: None},
+		{domain: "example.net", want: ""},
+		{domain: "www.example.co.uk", want: Quarantine},
+		{domain: "example.io", want: ""},
+		{domain: "invalid.com", err: true},
+	} {
+		t.Run(tc.domain, func(t *testing.T) {
+			rec, err := Lookup(context.Background(), dns, tc.domain)
+			switch {
+			case tc.err:
+				if err == nil || err == ErrNoPolicy {
+					t.Fatalf("expected a syntax error, got %v", err)
+				}
+				return
+			case tc.want == "":
+				if err != ErrNoPolicy {
+					t.Fatalf("invalid error: got=%v, want=%v", err, ErrNoPolicy)
+				}
+				return
+			case err != nil:
+				t.Fatalf("could not look up policy: %v", err)
+			}
+			if rec.Policy != tc.want {
+				t.Fatalf("invalid policy: got=%q, want=%q", rec.Policy, tc.want)
+			}
+		})
+	}
+}
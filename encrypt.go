@@ -0,0 +1,357 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Posts to encrypted lists are PGP/MIME messages (RFC 3156) encrypted to the
+// list key. They are decrypted by strew and re-encrypted to the key each
+// subscriber registered with the setkey command.
+
+var errNotEncrypted = errors.New("strew: message is not encrypted")
+
+const (
+	pubKeyBegin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	pubKeyEnd   = "-----END PGP PUBLIC KEY BLOCK-----"
+)
+
+// newListKeys loads the secret keys of the encrypted lists, by list ID.
+func newListKeys(cfg Config) (map[string]*openpgp.Entity, error) {
+	keys := make(map[string]*openpgp.Entity)
+	for _, list := range cfg.Lists {
+		if !list.Encrypted {
+			continue
+		}
+		if list.SecretKey == "" {
+			return nil, fmt.Errorf("strew: encrypted list %q has no secret_key", list.ID)
+		}
+		key, err := loadSecretKey(list.SecretKey, list.SecretKeyPassphrase)
+		if err != nil {
+			return nil, errors.WithMessage(err, "list "+list.ID)
+		}
+		keys[list.ID] = key
+	}
+	return keys, nil
+}
+
+// loadSecretKey loads the first OpenPGP secret key of the keyring fname,
+// decrypting it with passphrase if needed.
+func loadSecretKey(fname, passphrase string) (*openpgp.Entity, error) {
+	raw, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(raw))
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "strew: could not read OpenPGP keyring %q", fname)
+	}
+
+	for _, key := range keys {
+		if key.PrivateKey == nil {
+			continue
+		}
+		if key.PrivateKey.Encrypted {
+			err = key.PrivateKey.Decrypt([]byte(passphrase))
+			if err != nil {
+				return nil, errors.Wrapf(err, "strew: could not decrypt secret key %q", fname)
+			}
+		}
+		for _, sub := range key.Subkeys {
+			if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+				err = sub.PrivateKey.Decrypt([]byte(passphrase))
+				if err != nil {
+					return nil, errors.Wrapf(err, "strew: could not decrypt secret key %q", fname)
+				}
+			}
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("strew: no secret key in %q", fname)
+}
+
+// decryptPost returns a copy of msg with its PGP/MIME encrypted body replaced
+// by the decrypted MIME entity.
+// Signatures made by the poster inside the encrypted data are neither
+// verified nor forwarded: posting rights are checked as for other lists, and
+// subscribers only get the signature of the list.
+func (srv *Server) decryptPost(msg *Message, list *List) (*Message, error) {
+	media, params, err := mime.ParseMediaType(msg.ContentType)
+	if err != nil || media != "multipart/encrypted" ||
+		!strings.EqualFold(params["protocol"], "application/pgp-encrypted") {
+		return nil, errNotEncrypted
+	}
+
+	body, err := ioutil.ReadAll(msg.BodyReader())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	parts := splitMultipart([]byte(crlf(string(body))), params["boundary"])
+	if len(parts) != 2 {
+		return nil, errors.New("strew: invalid multipart/encrypted message")
+	}
+	_, data, err := readPart(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: invalid encrypted part")
+	}
+
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: invalid encrypted part")
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{srv.listKeys[list.ID]}, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: could not decrypt message")
+	}
+	plain, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: could not decrypt message")
+	}
+
+	hdr, content, err := readPart([]byte(crlf(string(plain))))
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: invalid decrypted entity")
+	}
+
+	sp := new(spool)
+	_, err = sp.Write(content)
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	out := msg.withBody(sp)
+	out.ContentType = hdr.Get("Content-Type")
+	out.Encoding = hdr.Get("Content-Transfer-Encoding")
+	return out, nil
+}
+
+// encryptFor returns a copy of msg with its body encrypted to the key rcpt
+// registered for list, and signed with the list key.
+func (srv *Server) encryptFor(ctx context.Context, msg *Message, list *List, rcpt string) (*Message, error) {
+	user, err := srv.normalize(rcpt)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := srv.db.Key(ctx, user, list.ID)
+	if err != nil {
+		return nil, err
+	}
+	to, err := openpgp.ReadKeyRing(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrapf(err, "strew: invalid key for %q", rcpt)
+	}
+
+	entity := new(bytes.Buffer)
+	ctype := msg.ContentType
+	if ctype == "" {
+		ctype = "text/plain"
+	}
+	entity.WriteString("Content-Type: " + ctype + "\r\n")
+	if msg.Encoding != "" {
+		entity.WriteString("Content-Transfer-Encoding: " + msg.Encoding + "\r\n")
+	}
+	entity.WriteString("\r\n")
+
+	armored := new(bytes.Buffer)
+	aw, err := armor.Encode(armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pw, err := openpgp.Encrypt(aw, to, srv.listKeys[list.ID], nil, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "strew: could not encrypt message to %q", rcpt)
+	}
+	r, n := msg.bodyReaderAt()
+	err = writeAll(pw, entity, io.NewSectionReader(r, 0, n))
+	if err != nil {
+		return nil, err
+	}
+	err = pw.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = aw.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+	body := new(spool)
+	err = writeAll(body,
+		strings.NewReader("--"+boundary+"\r\n"+
+			"Content-Type: application/pgp-encrypted\r\n"+
+			"Content-Description: PGP/MIME version identification\r\n"+
+			"\r\n"+
+			"Version: 1\r\n"+
+			"\r\n"+
+			"--"+boundary+"\r\n"+
+			"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n"+
+			"Content-Description: OpenPGP encrypted message\r\n"+
+			"Content-Disposition: inline; filename=\"encrypted.asc\"\r\n"+
+			"\r\n"),
+		strings.NewReader(crlf(armored.String())),
+		strings.NewReader("\r\n--"+boundary+"--\r\n"),
+	)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	out := msg.withBody(body)
+	out.ContentType = mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": boundary,
+	})
+	out.Encoding = ""
+	return out, nil
+}
+
+// publicKey extracts the armored OpenPGP public key attached to msg.
+func publicKey(msg *Message) (*openpgp.Entity, error) {
+	body, err := ioutil.ReadAll(msg.BodyReader())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	beg := bytes.Index(body, []byte(pubKeyBegin))
+	end := bytes.Index(body, []byte(pubKeyEnd))
+	if beg < 0 || end < beg {
+		return nil, errors.New("strew: no OpenPGP public key found")
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(body[beg : end+len(pubKeyEnd)]))
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: invalid OpenPGP public key")
+	}
+	if len(keys) != 1 {
+		return nil, errors.New("strew: exactly one OpenPGP public key is expected")
+	}
+	return keys[0], nil
+}
+
+// verifyKeyProof checks msg, a setkey command, is PGP/MIME signed with the
+// key user already registered for list, or with key if there is none, proving
+// the sender holds the secret key. The From address alone can be forged.
+func (srv *Server) verifyKeyProof(ctx context.Context, msg *Message, user, list string, key *openpgp.Entity) error {
+	part, err := msg.signedPart()
+	if err != nil {
+		return err
+	}
+	if part.protocol != "application/pgp-signature" {
+		return errNotSigned
+	}
+
+	var keys openpgp.EntityList
+	raw, err := srv.db.Key(ctx, user, list)
+	switch errors.Cause(err) {
+	case nil:
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+		if err != nil {
+			return errors.Wrapf(err, "strew: invalid key for %q", user)
+		}
+	case database.ErrNoKey:
+		keys = openpgp.EntityList{key}
+	default:
+		return errors.WithStack(err)
+	}
+
+	_, err = openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(part.content), bytes.NewReader(part.sig))
+	if err != nil {
+		_, err = openpgp.CheckDetachedSignature(keys, bytes.NewReader(part.content), bytes.NewReader(part.sig))
+	}
+	if err != nil {
+		return errors.Wrap(errUnknownKey, err.Error())
+	}
+	return msg.checkSignedCommand()
+}
+
+func (srv *Server) handleSetKey(ctx context.Context, msg *Message) error {
+	listID := strings.TrimPrefix(msg.Subject, "setkey ")
+	list := srv.lookupList(listID)
+
+	reply := msg.Reply()
+	reply.From = srv.cfg.CommandAddress
+
+	switch {
+	case list == nil:
+		reply.Body = fmt.Sprintf("Unable to set your key for %s - it is not a valid mailing list.\r\n", listID)
+		return srv.send(reply, []string{msg.From})
+	case !list.Encrypted:
+		reply.Body = fmt.Sprintf("Unable to set your key for %s - it is not an encrypted mailing list.\r\n", list.ID)
+		return srv.send(reply, []string{msg.From})
+	}
+
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	key, err := publicKey(msg)
+	if err != nil {
+		reply.Body = fmt.Sprintf("Unable to set your key for %s: %v\r\n", list.ID, err)
+		return srv.send(reply, []string{msg.From})
+	}
+
+	owned := false
+	for _, id := range key.Identities {
+		if strings.EqualFold(id.UserId.Email, from.Address) {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		reply.Body = fmt.Sprintf("Unable to set your key for %s - it has no identity for %s.\r\n", list.ID, from.Address)
+		return srv.send(reply, []string{msg.From})
+	}
+
+	user, err := srv.normalize(msg.From)
+	if err != nil {
+		return rejection{"invalid address"}
+	}
+
+	err = srv.verifyKeyProof(ctx, msg, user, list.ID, key)
+	if err != nil {
+		reply.Body = fmt.Sprintf(
+			"Unable to set your key for %s - the command must be PGP/MIME signed with the key already registered, or with the new key for a first registration: %v\r\n",
+			list.ID, errors.Cause(err),
+		)
+		return srv.send(reply, []string{msg.From})
+	}
+
+	raw := new(bytes.Buffer)
+	err = key.Serialize(raw)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = srv.db.SetKey(ctx, user, list.ID, raw.Bytes())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	reply.Body = fmt.Sprintf("Your key %X is now registered for %s\r\n", key.PrimaryKey.Fingerprint, list.ID)
+	return srv.send(reply, []string{msg.From})
+}
+
+func (srv *Server) handleNotEncrypted(ctx context.Context, msg *Message, list *List, err error) error {
+	return srv.notify(msg, fmt.Sprintf(
+		"Posts to this mailing list (%s) must be PGP/MIME encrypted to the list key. Your message has not been delivered: %v\r\n",
+		list.Address, errors.Cause(err),
+	))
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// keyStore is a database.Store only holding public keys.
+type keyStore struct {
+	database.Store
+	keys map[string][]byte
+}
+
+func (db *keyStore) SetKey(ctx context.Context, user, list string, key []byte) error {
+	db.keys[list+"/"+user] = key
+	return nil
+}
+
+func (db *keyStore) Key(ctx context.Context, user, list string) ([]byte, error) {
+	key, ok := db.keys[list+"/"+user]
+	if !ok {
+		return nil, database.ErrNoKey
+	}
+	return key, nil
+}
+
+// newTestKey returns a new OpenPGP key, with a self-signature advertising
+// SHA-256 as preferred hash.
+func newTestKey(t *testing.T, name, email string) *openpgp.Entity {
+	t.Helper()
+	cfg := &packet.Config{DefaultHash: crypto.SHA256}
+	key, err := openpgp.NewEntity(name, "", email, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range key.Identities {
+		err = id.SelfSignature.SignUserId(id.UserId.Id, key.PrimaryKey, key.PrivateKey, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key
+}
+
+func TestEncryptedList(t *testing.T) {
+	ctx := context.Background()
+	listKey := newTestKey(t, "Secret list", "secret@example.com")
+	alice := newTestKey(t, "Alice", "alice@example.com")
+
+	db := &keyStore{keys: make(map[string][]byte)}
+	srv := &Server{
+		db:       db,
+		listKeys: map[string]*openpgp.Entity{"secret": listKey},
+	}
+	list := &List{ID: "secret", Address: "secret@example.com", Encrypted: true}
+
+	pub := new(bytes.Buffer)
+	aw, err := armor.Encode(pub, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.Serialize(aw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Close()
+
+	var setkey Message
+	_, err = setkey.ReadFrom(strings.NewReader(
+		"From: alice@example.com\r\nSubject: setkey secret\r\n\r\nmy key:\r\n" + crlf(pub.String()) + "\r\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := publicKey(&setkey)
+	if err != nil {
+		t.Fatalf("could not extract public key: %+v", err)
+	}
+	raw := new(bytes.Buffer)
+	key.Serialize(raw)
+	db.SetKey(ctx, "alice@example.com", "secret", raw.Bytes())
+
+	const entity = "Content-Type: text/plain; charset=utf-8\r\n\r\ntop secret\r\n"
+	enc := new(bytes.Buffer)
+	aw, err = armor.Encode(enc, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := openpgp.Encrypt(aw, openpgp.EntityList{listKey}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write([]byte(entity))
+	pw.Close()
+	aw.Close()
+
+	var post Message
+	_, err = post.ReadFrom(strings.NewReader(
+		"From: alice@example.com\r\n" +
+			"To: secret@example.com\r\n" +
+			"Subject: hello\r\n" +
+			"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"enc\"\r\n" +
+			"\r\n" +
+			"--enc\r\nContent-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n\r\n" +
+			"--enc\r\nContent-Type: application/octet-stream\r\n\r\n" + crlf(enc.String()) + "\r\n" +
+			"--enc--\r\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := srv.decryptPost(&post, list)
+	if err != nil {
+		t.Fatalf("could not decrypt post: %+v", err)
+	}
+	if got, want := plain.ContentType, "text/plain; charset=utf-8"; got != want {
+		t.Fatalf("invalid content type: got=%q, want=%q", got, want)
+	}
+	if got, want := plain.Body, "top secret\r\n"; got != want {
+		t.Fatalf("invalid body: got=%q, want=%q", got, want)
+	}
+
+	out, err := srv.encryptFor(ctx, plain, list, "alice@example.com")
+	if err != nil {
+		t.Fatalf("could not encrypt post: %+v", err)
+	}
+	media, params, err := mime.ParseMediaType(out.ContentType)
+	if err != nil || media != "multipart/encrypted" {
+		t.Fatalf("invalid content type: %q", out.ContentType)
+	}
+	parts := splitMultipart([]byte(out.Body), params["boundary"])
+	if len(parts) != 2 {
+		t.Fatalf("invalid number of parts: got=%d, want=2", len(parts))
+	}
+	_, data, err := readPart(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{alice, listKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("could not decrypt re-encrypted post: %+v", err)
+	}
+	got, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != entity {
+		t.Fatalf("invalid decrypted entity:\ngot= %q\nwant=%q", got, entity)
+	}
+	if md.SignatureError != nil || md.SignedBy == nil {
+		t.Fatalf("re-encrypted post is not signed by the list: %v", md.SignatureError)
+	}
+
+	_, err = srv.encryptFor(ctx, plain, list, "bob@example.com")
+	if errors.Cause(err) != database.ErrNoKey {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrNoKey)
+	}
+
+	var clear Message
+	clear.ReadFrom(strings.NewReader("From: alice@example.com\r\nSubject: hello\r\n\r\nhello\r\n"))
+	_, err = srv.decryptPost(&clear, list)
+	if err != errNotEncrypted {
+		t.Fatalf("invalid error: got=%v, want=%v", err, errNotEncrypted)
+	}
+}
+
+func TestSetKeyProof(t *testing.T) {
+	ctx := context.Background()
+	alice := newTestKey(t, "Alice", "alice@example.com")
+	renewed := newTestKey(t, "Alice", "alice@example.com")
+	mallory := newTestKey(t, "Mallory", "alice@example.com")
+
+	db := &keyStore{keys: make(map[string][]byte)}
+	srv := &Server{db: db}
+
+	armored := func(key *openpgp.Entity) string {
+		buf := new(bytes.Buffer)
+		aw, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = key.Serialize(aw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.Close()
+		return crlf(buf.String())
+	}
+	setkey := func(key, signer *openpgp.Entity, cmd string) *Message {
+		content := "Content-Type: text/plain\r\n\r\n" + cmd + "\r\n" + armored(key)
+		sig := new(bytes.Buffer)
+		err := openpgp.ArmoredDetachSign(sig, signer, strings.NewReader(content), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := signedMessage(t, "alice@example.com", "application/pgp-signature", content,
+			"Content-Type: application/pgp-signature\r\n\r\n"+crlf(sig.String()),
+		)
+		msg.Subject = "setkey secret"
+		return msg
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  *Message
+		key  *openpgp.Entity
+		ok   bool
+	}{
+		{
+			name: "self-signed",
+			msg:  setkey(alice, alice, "setkey secret"),
+			key:  alice,
+			ok:   true,
+		},
+		{
+			name: "other-signer",
+			msg:  setkey(alice, mallory, "setkey secret"),
+			key:  alice,
+		},
+		{
+			name: "unsigned",
+			msg: func() *Message {
+				var msg Message
+				msg.ReadFrom(strings.NewReader("From: alice@example.com\r\nSubject: setkey secret\r\n\r\n" + armored(mallory)))
+				return &msg
+			}(),
+			key: mallory,
+		},
+		{
+			name: "other-command",
+			msg:  setkey(alice, alice, "setkey public"),
+			key:  alice,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := srv.verifyKeyProof(ctx, tc.msg, "alice@example.com", "secret", tc.key)
+			if got, want := err == nil, tc.ok; got != want {
+				t.Fatalf("invalid proof: got=%v, want=%v (err=%v)", got, want, err)
+			}
+		})
+	}
+
+	// once registered, a key may only be replaced by signing with it.
+	raw := new(bytes.Buffer)
+	alice.Serialize(raw)
+	db.SetKey(ctx, "alice@example.com", "secret", raw.Bytes())
+
+	msg := setkey(renewed, alice, "setkey secret")
+	err := srv.verifyKeyProof(ctx, msg, "alice@example.com", "secret", renewed)
+	if err != nil {
+		t.Fatalf("could not replace key: %+v", err)
+	}
+	msg = setkey(mallory, mallory, "setkey secret")
+	err = srv.verifyKeyProof(ctx, msg, "alice@example.com", "secret", mallory)
+	if err == nil {
+		t.Fatalf("registered key replaced by a self-signed key")
+	}
+}
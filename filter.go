@@ -0,0 +1,423 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/dkim"
+	"github.com/sbinet-alt63/strew/spamd"
+)
+
+// Verdict is the outcome of a filter.
+type Verdict int
+
+const (
+	Accept Verdict = iota // deliver the post.
+	Hold                  // hold the post for moderation.
+	Reject                // refuse the post.
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Accept:
+		return "accept"
+	case Hold:
+		return "hold"
+	case Reject:
+		return "reject"
+	}
+	return fmt.Sprintf("Verdict(%d)", int(v))
+}
+
+// Filter inspects posts before they are sent to a list.
+type Filter interface {
+	// Filter returns the verdict for msg posted to list, and the reason
+	// of the verdict reported to the sender of held and refused posts.
+	Filter(ctx context.Context, msg *Message, list *List) (Verdict, string, error)
+}
+
+// FilterFunc adapts a function to the Filter interface.
+type FilterFunc func(ctx context.Context, msg *Message, list *List) (Verdict, string, error)
+
+func (f FilterFunc) Filter(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	return f(ctx, msg, list)
+}
+
+// HeaderFilter holds the settings of a [filter.<name>] section, matching
+// a header field against a regular expression.
+type HeaderFilter struct {
+	Header string   `ini:"header"`
+	Match  string   `ini:"match"`
+	Action string   `ini:"action"`          // hold or reject. (default: reject)
+	Lists  []string `ini:"lists,omitempty"` // IDs of the filtered lists. (default: all)
+
+	re *regexp.Regexp
+}
+
+// newFilters returns the filter chain of the server: the built-in rules,
+// the header filters, sorted by name, the spam checks and the filters of
+// cfg.
+func newFilters(cfg Config) ([]Filter, error) {
+	filters := []Filter{
+		FilterFunc(filterRecipients),
+		FilterFunc(filterTypes),
+		FilterFunc(filterHTML),
+	}
+
+	names := make([]string, 0, len(cfg.HeaderFilters))
+	for name := range cfg.HeaderFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hf := cfg.HeaderFilters[name]
+		if hf.Header == "" {
+			return nil, fmt.Errorf("strew: filter %q has no header", name)
+		}
+		if _, err := parseAction(hf.Action, Reject); err != nil {
+			return nil, errors.WithMessage(err, "filter "+name)
+		}
+		re, err := regexp.Compile(hf.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "strew: invalid match for filter %q", name)
+		}
+		hf.re = re
+		filters = append(filters, hf)
+	}
+
+	for _, list := range cfg.Lists {
+		if _, err := parseAction(list.SpamAction, Accept); err != nil {
+			return nil, errors.WithMessage(err, "list "+list.ID)
+		}
+	}
+	filters = append(filters, FilterFunc(filterSpamFlag))
+	if cfg.SpamdAddress != "" {
+		network, addr := "tcp", cfg.SpamdAddress
+		if strings.HasPrefix(addr, "unix:") {
+			network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		}
+		timeout := cfg.SpamdTimeout
+		if timeout <= 0 {
+			timeout = defaultSpamdTimeout
+		}
+		filters = append(filters, &spamdFilter{
+			client:   spamd.Client{Network: network, Addr: addr},
+			timeout:  timeout,
+			failOpen: cfg.SpamdFailOpen,
+		})
+	}
+
+	return append(filters, cfg.Filters...), nil
+}
+
+// parseAction parses the hold or reject action of a filter.
+func parseAction(action string, def Verdict) (Verdict, error) {
+	switch strings.ToLower(action) {
+	case "":
+		return def, nil
+	case "hold":
+		return Hold, nil
+	case "reject":
+		return Reject, nil
+	}
+	return Accept, fmt.Errorf("strew: invalid filter action %q", action)
+}
+
+// filter runs the filter chain on msg, stopping at the first rejection.
+// Held posts are refused when the server has no moderation queue.
+func (srv *Server) filter(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	var (
+		verdict = Accept
+		reason  string
+	)
+	for _, f := range srv.filters {
+		v, why, err := f.Filter(ctx, msg, list)
+		if err != nil {
+			return Accept, "", err
+		}
+		if v > verdict {
+			verdict, reason = v, why
+		}
+		if verdict == Reject {
+			break
+		}
+	}
+	if verdict == Hold && srv.cfg.HoldDir == "" {
+		verdict = Reject
+	}
+	return verdict, reason, nil
+}
+
+// filterRecipients refuses posts with more than list.MaxRecipients
+// recipients.
+func filterRecipients(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	if list.MaxRecipients <= 0 {
+		return Accept, "", nil
+	}
+	n := 0
+	for _, addrs := range []string{msg.To, msg.Cc} {
+		if addrs == "" {
+			continue
+		}
+		vs, err := mail.ParseAddressList(addrs)
+		if err != nil {
+			return Reject, "invalid recipient address", nil
+		}
+		n += len(vs)
+	}
+	if n > list.MaxRecipients {
+		return Reject, fmt.Sprintf("too many recipients (%d, at most %d allowed)", n, list.MaxRecipients), nil
+	}
+	return Accept, "", nil
+}
+
+// filterTypes refuses posts with parts matching list.BannedTypes, either by
+// media type (such as application/x-msdownload or application/*) or by file
+// name extension (such as .exe).
+func filterTypes(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	if len(list.BannedTypes) == 0 {
+		return Accept, "", nil
+	}
+	var banned string
+	err := walkParts(msg, func(media, fname string) {
+		ext := strings.ToLower(path.Ext(fname))
+		for _, pattern := range list.BannedTypes {
+			pattern = strings.ToLower(pattern)
+			var ok bool
+			if strings.HasPrefix(pattern, ".") {
+				ok = ext == pattern
+			} else {
+				ok, _ = path.Match(pattern, media)
+			}
+			if ok && banned == "" {
+				banned = media
+				if fname != "" {
+					banned = fname
+				}
+			}
+		}
+	})
+	if err != nil {
+		return Reject, "malformed MIME structure", nil
+	}
+	if banned != "" {
+		return Reject, fmt.Sprintf("attachments of this type are not allowed (%s)", banned), nil
+	}
+	return Accept, "", nil
+}
+
+// filterHTML refuses posts without a text/plain version when list.RejectHTML
+// is set.
+func filterHTML(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	if !list.RejectHTML {
+		return Accept, "", nil
+	}
+	var html, plain bool
+	err := walkParts(msg, func(media, fname string) {
+		if fname != "" {
+			return
+		}
+		switch media {
+		case "text/html":
+			html = true
+		case "text/plain":
+			plain = true
+		}
+	})
+	if err != nil {
+		return Reject, "malformed MIME structure", nil
+	}
+	if html && !plain {
+		return Reject, "HTML-only messages are not allowed, please send a plain text version", nil
+	}
+	return Accept, "", nil
+}
+
+// filterSpamFlag applies list.SpamAction to posts flagged as spam by an
+// upstream filter, with a X-Spam-Flag header field.
+func filterSpamFlag(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	action, _ := parseAction(list.SpamAction, Accept)
+	if action == Accept {
+		return Accept, "", nil
+	}
+	for _, f := range dkim.ParseHeader(msg.header) {
+		if strings.EqualFold(f.Name, "X-Spam-Flag") && strings.EqualFold(f.Value(), "yes") {
+			return action, "message was flagged as spam", nil
+		}
+	}
+	return Accept, "", nil
+}
+
+func (hf *HeaderFilter) Filter(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	if len(hf.Lists) > 0 && !contains(hf.Lists, list.ID) {
+		return Accept, "", nil
+	}
+	for _, f := range dkim.ParseHeader(msg.header) {
+		if strings.EqualFold(f.Name, hf.Header) && hf.re.MatchString(f.Value()) {
+			action, _ := parseAction(hf.Action, Reject)
+			return action, fmt.Sprintf("the %s header field is not allowed", f.Name), nil
+		}
+	}
+	return Accept, "", nil
+}
+
+// defaultSpamdTimeout is the maximum duration of a spam check, when
+// spamd_timeout is not set.
+const defaultSpamdTimeout = 30 * time.Second
+
+// spamdFilter applies list.SpamAction to posts classified as spam by a
+// spamd (or rspamd) server.
+// Posts that could not be checked are accepted if failOpen is set, and
+// refused with a temporary failure otherwise.
+type spamdFilter struct {
+	client   spamd.Client
+	timeout  time.Duration
+	failOpen bool
+}
+
+func (sf *spamdFilter) Filter(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+	action, _ := parseAction(list.SpamAction, Accept)
+	if action == Accept {
+		return Accept, "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, sf.timeout)
+	defer cancel()
+
+	hdr := msg.rawHeader()
+	body, n := msg.bodyReaderAt()
+	res, err := sf.client.Check(ctx,
+		io.MultiReader(bytes.NewReader(hdr), io.NewSectionReader(body, 0, n)),
+		int64(len(hdr))+n,
+	)
+	if err != nil {
+		if sf.failOpen {
+			log.Printf("server: could not check message %s for spam, accepting it: %v", msg.ID, err)
+			return Accept, "", nil
+		}
+		return Accept, "", errors.WithMessage(err, "strew: could not check message for spam")
+	}
+	if res.Spam {
+		return action, fmt.Sprintf("message was classified as spam (score %.1f)", res.Score), nil
+	}
+	return Accept, "", nil
+}
+
+// walkParts calls fn with the media type and file name of each leaf part
+// of msg. Attached messages are not inspected.
+func walkParts(msg *Message, fn func(media, fname string)) error {
+	return walkPart(msg.BodyReader(), msg.ContentType, "", fn)
+}
+
+func walkPart(r io.Reader, ctype, fname string, fn func(media, fname string)) error {
+	if ctype == "" {
+		ctype = "text/plain"
+	}
+	media, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		media = "application/octet-stream"
+	}
+	if fname == "" {
+		fname = params["name"]
+	}
+	if !strings.HasPrefix(media, "multipart/") {
+		fn(media, fname)
+		return nil
+	}
+
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = walkPart(part, part.Header.Get("Content-Type"), part.FileName(), fn)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rawHeader returns the header section of msg as received, or as marshaled
+// if msg was not received.
+func (msg *Message) rawHeader() []byte {
+	if msg.header != nil {
+		return msg.header
+	}
+	return msg.marshalHeader()
+}
+
+// hold saves msg in the moderation queue of list, hold_dir/<list-id>.
+func (srv *Server) hold(msg *Message, list *List) error {
+	if srv.cfg.HoldDir == "" {
+		return errors.New("strew: no hold_dir configured")
+	}
+	dir := filepath.Join(srv.cfg.HoldDir, list.ID)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := ioutil.TempFile(dir, time.Now().UTC().Format("20060102T150405-")+"*.eml")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	body, n := msg.bodyReaderAt()
+	err = writeAll(f, bytes.NewReader(msg.rawHeader()), io.NewSectionReader(body, 0, n))
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (srv *Server) handleHeld(ctx context.Context, msg *Message, list *List, reason string) error {
+	err := srv.hold(msg, list)
+	if err != nil {
+		return err
+	}
+	return srv.notify(msg, fmt.Sprintf("Your message to %s is held for moderation: %s.\r\n", list.Address, reason))
+}
+
+func (srv *Server) handleFiltered(ctx context.Context, msg *Message, list *List, reason string) error {
+	return srv.notify(msg, fmt.Sprintf(
+		"Your message to %s has been refused: %s. Your message has not been delivered.\r\n",
+		list.Address, reason,
+	))
+}
+
+func contains(vs []string, v string) bool {
+	for _, x := range vs {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
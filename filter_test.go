@@ -0,0 +1,231 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-alt63/strew/spamd"
+)
+
+func TestHeaderFiltersOrder(t *testing.T) {
+	cfg := Config{
+		HeaderFilters: map[string]*HeaderFilter{
+			"c": {Header: "X-C", Match: "."},
+			"a": {Header: "X-A", Match: "."},
+			"d": {Header: "X-D", Match: "."},
+			"b": {Header: "X-B", Match: "."},
+		},
+	}
+	filters, err := newFilters(cfg)
+	if err != nil {
+		t.Fatalf("could not create filters: %+v", err)
+	}
+	var got []string
+	for _, f := range filters {
+		if hf, ok := f.(*HeaderFilter); ok {
+			got = append(got, hf.Header)
+		}
+	}
+	if want := []string{"X-A", "X-B", "X-C", "X-D"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid order of header filters: got=%q, want=%q", got, want)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	cfg := Config{
+		HeaderFilters: map[string]*HeaderFilter{
+			"mailer": {Header: "X-Mailer", Match: "(?i)bulk", Action: "hold"},
+		},
+	}
+	filters, err := newFilters(cfg)
+	if err != nil {
+		t.Fatalf("could not create filters: %+v", err)
+	}
+	srv := &Server{cfg: cfg, filters: filters}
+
+	list := &List{
+		ID:            "golang",
+		MaxRecipients: 2,
+		BannedTypes:   []string{"application/x-msdownload", ".exe"},
+		RejectHTML:    true,
+		SpamAction:    "reject",
+	}
+
+	const mixed = "Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"setup.EXE\"\r\n\r\nMZ\r\n" +
+		"--b--\r\n"
+
+	for _, tc := range []struct {
+		name string
+		hdr  string
+		body string
+		want Verdict
+	}{
+		{
+			name: "plain",
+			hdr:  "To: golang@example.com\r\n",
+			body: "\r\nhello\r\n",
+			want: Accept,
+		},
+		{
+			name: "recipients",
+			hdr:  "To: golang@example.com, a@example.com\r\nCc: b@example.com\r\n",
+			body: "\r\nhello\r\n",
+			want: Reject,
+		},
+		{
+			name: "attachment",
+			hdr:  "To: golang@example.com\r\n",
+			body: mixed,
+			want: Reject,
+		},
+		{
+			name: "html-only",
+			hdr:  "To: golang@example.com\r\nContent-Type: text/html\r\n",
+			body: "\r\n<p>hello</p>\r\n",
+			want: Reject,
+		},
+		{
+			name: "alternative",
+			hdr:  "To: golang@example.com\r\n",
+			body: "Content-Type: multipart/alternative; boundary=\"b\"\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>hello</p>\r\n" +
+				"--b--\r\n",
+			want: Accept,
+		},
+		{
+			name: "spam-flag",
+			hdr:  "To: golang@example.com\r\nX-Spam-Flag: YES\r\n",
+			body: "\r\nhello\r\n",
+			want: Reject,
+		},
+		{
+			// no hold_dir: held posts are refused.
+			name: "header",
+			hdr:  "To: golang@example.com\r\nX-Mailer: BulkMailer 2.0\r\n",
+			body: "\r\nhello\r\n",
+			want: Reject,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var msg Message
+			_, err := msg.ReadFrom(strings.NewReader("From: gopher@example.com\r\n" + tc.hdr + tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, reason, err := srv.filter(context.Background(), &msg, list)
+			if err != nil {
+				t.Fatalf("could not filter message: %+v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("invalid verdict: got=%v, want=%v (%s)", got, tc.want, reason)
+			}
+		})
+	}
+}
+
+func TestHold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strew-hold-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		HoldDir: dir,
+		Filters: []Filter{FilterFunc(func(ctx context.Context, msg *Message, list *List) (Verdict, string, error) {
+			if strings.Contains(msg.Subject, "moderate") {
+				return Hold, "please wait", nil
+			}
+			return Accept, "", nil
+		})},
+	}
+	filters, err := newFilters(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{cfg: cfg, filters: filters}
+	list := &List{ID: "golang"}
+
+	const raw = "From: gopher@example.com\r\nTo: golang@example.com\r\nSubject: moderate me\r\n\r\nhello\r\n"
+	var msg Message
+	_, err = msg.ReadFrom(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := srv.filter(context.Background(), &msg, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != Hold {
+		t.Fatalf("invalid verdict: got=%v, want=%v", got, Hold)
+	}
+
+	err = srv.hold(&msg, list)
+	if err != nil {
+		t.Fatalf("could not hold message: %+v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "golang", "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("invalid held messages: %v (err=%v)", files, err)
+	}
+	held, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(held) != raw {
+		t.Fatalf("invalid held message:\ngot= %q\nwant=%q", held, raw)
+	}
+}
+
+func TestSpamdTimeout(t *testing.T) {
+	// a spamd server never answering.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	list := &List{ID: "golang", SpamAction: "reject"}
+	var msg Message
+	_, err = msg.ReadFrom(strings.NewReader("From: bob@example.com\r\nSubject: hello\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, failOpen := range []bool{false, true} {
+		sf := &spamdFilter{
+			client:   spamd.Client{Network: "tcp", Addr: l.Addr().String()},
+			timeout:  50 * time.Millisecond,
+			failOpen: failOpen,
+		}
+		v, _, err := sf.Filter(context.Background(), &msg, list)
+		if got, want := err == nil, failOpen; got != want || v != Accept {
+			t.Fatalf("fail-open=%v: invalid verdict: got=%v, err=%v", failOpen, v, err)
+		}
+	}
+}
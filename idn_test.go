@@ -0,0 +1,180 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIDNAddresses(t *testing.T) {
+	msg := readMessage(t, "From: Jörg <jörg@BÜCHER.example>\r\n"+
+		"To: liste@bücher.example\r\n"+
+		"Subject: grüße\r\n\r\nhallo\r\n",
+	)
+	if got, want := msg.From, "Jörg <jörg@BÜCHER.example>"; got != want {
+		t.Fatalf("invalid From: got=%q, want=%q", got, want)
+	}
+
+	srv := &Server{}
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{addr: msg.From, want: "jörg@bücher.example"},
+		{addr: "jörg@xn--bcher-kva.example", want: "jörg@bücher.example"},
+		// NFD spelling of jörg.
+		{addr: "jo\u0308rg@bücher.example", want: "jörg@bücher.example"},
+	} {
+		got, err := srv.normalize(tc.addr)
+		if err != nil {
+			t.Fatalf("%q: could not normalize: %+v", tc.addr, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: got=%q, want=%q", tc.addr, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		addr     string
+		smtputf8 bool
+		want     string
+		err      error
+	}{
+		{addr: "Jörg <jorg@bücher.example>", smtputf8: true, want: "jorg@bücher.example"},
+		{addr: "Jörg <jorg@bücher.example>", want: "jorg@xn--bcher-kva.example"},
+		{addr: "jörg@bücher.example", smtputf8: true, want: "jörg@bücher.example"},
+		{addr: "jörg@bücher.example", err: errNoSMTPUTF8},
+	} {
+		got, err := envelopeAddress(tc.addr, tc.smtputf8)
+		if errors.Cause(err) != tc.err {
+			t.Fatalf("%q: invalid error: got=%v, want=%v", tc.addr, err, tc.err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: got=%q, want=%q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+// smtpd is a stand-in SMTP relay, recording the envelope of the messages
+// it receives.
+type smtpd struct {
+	l        net.Listener
+	smtputf8 bool
+	cmds     chan string
+}
+
+func newSMTPD(t *testing.T, smtputf8 bool) *smtpd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &smtpd{l: l, smtputf8: smtputf8, cmds: make(chan string, 100)}
+	go srv.serve()
+	return srv
+}
+
+func (srv *smtpd) serve() {
+	for {
+		conn, err := srv.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			tp := textproto.NewConn(conn)
+			tp.PrintfLine("220 localhost ESMTP")
+			for {
+				line, err := tp.ReadLine()
+				if err != nil {
+					return
+				}
+				switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+				case "EHLO":
+					if srv.smtputf8 {
+						tp.PrintfLine("250-localhost")
+						tp.PrintfLine("250 SMTPUTF8")
+						continue
+					}
+					tp.PrintfLine("250 localhost")
+				case "MAIL", "RCPT":
+					srv.cmds <- line
+					tp.PrintfLine("250 ok")
+				case "DATA":
+					tp.PrintfLine("354 go ahead")
+					_, err := tp.ReadDotBytes()
+					if err != nil {
+						return
+					}
+					tp.PrintfLine("250 ok")
+				case "QUIT":
+					tp.PrintfLine("221 bye")
+					return
+				default:
+					tp.PrintfLine("250 ok")
+				}
+			}
+		}()
+	}
+}
+
+func (srv *smtpd) envelope() []string {
+	var cmds []string
+	for {
+		select {
+		case cmd := <-srv.cmds:
+			cmds = append(cmds, cmd)
+		default:
+			return cmds
+		}
+	}
+}
+
+func TestDeliverIDN(t *testing.T) {
+	for _, tc := range []struct {
+		smtputf8 bool
+		want     []string
+	}{
+		{
+			smtputf8: true,
+			want: []string{
+				"MAIL FROM:<liste@bücher.example> SMTPUTF8",
+				"RCPT TO:<jörg@bücher.example>",
+				"RCPT TO:<anna@bücher.example>",
+			},
+		},
+		{
+			smtputf8: false,
+			want: []string{
+				"MAIL FROM:<liste@xn--bcher-kva.example>",
+				"RCPT TO:<anna@xn--bcher-kva.example>",
+			},
+		},
+	} {
+		relay := newSMTPD(t, tc.smtputf8)
+		host, port, _ := net.SplitHostPort(relay.l.Addr().String())
+		srv := &Server{cfg: Config{SMTPHostname: host, SMTPPort: port}}
+
+		msg := &Message{
+			From:    "Liste <liste@bücher.example>",
+			To:      "jörg@bücher.example, anna@bücher.example",
+			Subject: "hallo",
+			Body:    "hallo\r\n",
+		}
+		err := srv.deliver(msg, []string{"jörg@bücher.example", "Anna <anna@bücher.example>"}, nil)
+		relay.l.Close()
+		if err != nil {
+			t.Fatalf("smtputf8=%v: could not deliver: %+v", tc.smtputf8, err)
+		}
+		got := relay.envelope()
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Fatalf("smtputf8=%v: invalid envelope:\ngot= %q\nwant=%q", tc.smtputf8, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package importer converts the mailing lists of other list managers
+// (nanolist, Mailman 2 and mlmmj) to strew.
+//
+// An import produces the [list.<id>] sections of the strew configuration and
+// the subscriptions to store in the strew database, and reports the settings
+// and subscribers that could not be converted.
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew"
+	"github.com/sbinet-alt63/strew/database"
+	ini "gopkg.in/ini.v1"
+)
+
+// Result is the outcome of an import.
+type Result struct {
+	Lists         []*strew.List
+	Subscriptions []database.Subscription
+
+	// Warnings describe what could not be converted.
+	Warnings []string
+}
+
+func (r *Result) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// subscribe adds the subscription of addr to list, addr being either a bare
+// address or a "Name <address>" mailbox.
+func (r *Result) subscribe(list, addr string, delivery database.Delivery) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return
+	}
+	sub := database.Subscription{
+		List:     list,
+		Address:  addr,
+		Source:   database.SourceImport,
+		Delivery: delivery,
+	}
+	if v, err := mail.ParseAddress(addr); err == nil {
+		sub.Address = v.Address
+		sub.Name = v.Name
+	} else {
+		r.warnf("list %s: invalid subscriber address %q: %v", list, addr, err)
+		return
+	}
+	r.Subscriptions = append(r.Subscriptions, sub)
+}
+
+// Merge appends the lists, subscriptions and warnings of o to r.
+func (r *Result) Merge(o *Result) {
+	r.Lists = append(r.Lists, o.Lists...)
+	r.Subscriptions = append(r.Subscriptions, o.Subscriptions...)
+	r.Warnings = append(r.Warnings, o.Warnings...)
+}
+
+// Apply adds the lists and subscriptions of r to db, in a single batch.
+// Subscriptions without a date are recorded as subscribed and confirmed
+// at the time of the import.
+func (r *Result) Apply(ctx context.Context, db database.Store) error {
+	now := time.Now().UTC()
+	batch := new(database.Batch)
+	for _, list := range r.Lists {
+		batch.AddList(list.ID)
+	}
+	for _, sub := range r.Subscriptions {
+		if sub.SubscribedAt.IsZero() {
+			sub.SubscribedAt = now
+		}
+		if sub.ConfirmedAt.IsZero() {
+			sub.ConfirmedAt = sub.SubscribedAt
+		}
+		batch.AddSubscription(sub)
+	}
+	return errors.WithStack(db.Apply(ctx, batch))
+}
+
+// WriteConfig writes the [list.<id>] sections of the imported lists to w,
+// in the format of strew.ini. Settings left to their default are omitted.
+func (r *Result) WriteConfig(w io.Writer) error {
+	f := ini.Empty()
+	for _, list := range r.Lists {
+		section, err := f.NewSection("list." + list.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rv := reflect.ValueOf(list).Elem()
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			name := strings.Split(rt.Field(i).Tag.Get("ini"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			v, ok := iniValue(rv.Field(i))
+			if !ok {
+				continue
+			}
+			_, err = section.NewKey(name, v)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	_, err := f.WriteTo(w)
+	return errors.WithStack(err)
+}
+
+// iniValue formats the value of a List field, and reports whether it is
+// not the default one.
+func iniValue(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), v.String() != ""
+	case reflect.Bool:
+		return "true", v.Bool()
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), v.Int() != 0
+	case reflect.Slice:
+		vs := v.Interface().([]string)
+		return strings.Join(vs, ", "), len(vs) > 0
+	}
+	return "", false
+}
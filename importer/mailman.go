@@ -0,0 +1,275 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+// Mailman describes a Mailman 2 list to import.
+//
+// The settings of a list are read from its lists/<list>/config.pck pickle,
+// and its members from the output of list_members:
+//
+//	bin/list_members -f -r golang > golang.regular
+//	bin/list_members -f -d golang > golang.digest
+//	bin/list_members -f -n enabled golang > golang.nomail
+type Mailman struct {
+	ID      string    // name of the list.
+	Config  io.Reader // config.pck of the list.
+	Members io.Reader // output of list_members -f -r.
+	Digest  io.Reader // output of list_members -f -d, if any: reported, not imported.
+	NoMail  io.Reader // output of list_members -f -n enabled, if any: reported, not imported.
+}
+
+// mailmanWarned are the settings reported when set, as strew has no
+// equivalent for them.
+var mailmanWarned = []string{
+	"owner",
+	"moderator",
+	"ban_list",
+	"reply_goes_to_list",
+	"archive",
+	"bounce_processing",
+}
+
+// mailmanVar matches the Python %(name)s interpolations of headers and
+// footers.
+var mailmanVar = regexp.MustCompile(`%\(([a-z_]+)\)s`)
+
+// ReadMailman imports the Mailman 2 list m.
+func ReadMailman(m Mailman) (*Result, error) {
+	raw, err := ioutil.ReadAll(m.Config)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cfg, err := parsePickle(raw)
+	if err != nil {
+		return nil, errors.WithMessage(err, "strew/importer: invalid configuration of list "+m.ID)
+	}
+
+	var (
+		res  Result
+		list = &strew.List{ID: strings.ToLower(m.ID)}
+	)
+	res.Lists = []*strew.List{list}
+
+	host := cfg.str("host_name")
+	if host == "" {
+		return nil, fmt.Errorf("strew/importer: list %s has no host_name", m.ID)
+	}
+	list.Address = list.ID + "@" + host
+	list.Name = cfg.str("real_name")
+	list.Description = cfg.str("description")
+	list.Hidden = cfg.has("advertised") && !cfg.bool("advertised")
+	list.Personalize = cfg.int("personalize") != 0
+	if n := cfg.int("max_message_size"); n > 0 {
+		list.MaxMessageSize = n * 1024
+	}
+
+	prefix := cfg.str("subject_prefix")
+	if strings.Contains(prefix, "%") {
+		res.warnf("list %s: subject_prefix %q has sequence numbers, which are not supported", list.ID, prefix)
+		prefix = strings.Replace(prefix, "%d", "", -1)
+	}
+	list.SubjectPrefix = strings.TrimSpace(prefix)
+
+	for _, v := range []struct {
+		key string
+		dst *string
+	}{
+		{"msg_header", &list.Header},
+		{"msg_footer", &list.Footer},
+	} {
+		*v.dst = mailmanTemplate(&res, list.ID, v.key, cfg.str(v.key), host)
+	}
+
+	action := cfg.int("from_is_list")
+	if action == 0 {
+		action = cfg.int("dmarc_moderation_action")
+	}
+	switch action {
+	case 0:
+	case 1:
+		list.DMARCMitigation = "rewrite"
+	case 2:
+		list.DMARCMitigation = "wrap"
+	default:
+		res.warnf("list %s: dmarc_moderation_action %d is not supported", list.ID, action)
+	}
+
+	nonmembers := cfg.strs("accept_these_nonmembers")
+	switch {
+	case cfg.bool("default_member_moderation"):
+		// announcement list: only the accepted non-members may post.
+		for _, addr := range nonmembers {
+			if strings.HasPrefix(addr, "^") {
+				res.warnf("list %s: poster pattern %q is not supported", list.ID, addr)
+				continue
+			}
+			list.Posters = append(list.Posters, addr)
+		}
+		if len(list.Posters) == 0 {
+			res.warnf("list %s: members are moderated, which is not supported", list.ID)
+		}
+	case cfg.int("generic_nonmember_action") != 0:
+		list.SubscribersOnly = true
+		if len(nonmembers) > 0 {
+			res.warnf("list %s: accept_these_nonmembers is not supported", list.ID)
+		}
+	}
+
+	for _, key := range mailmanWarned {
+		if cfg.set(key) {
+			res.warnf("list %s: %s is not supported", list.ID, key)
+		}
+	}
+
+	for _, v := range []struct {
+		r        io.Reader
+		delivery database.Delivery
+	}{
+		{m.Members, database.DeliveryRegular},
+		{m.Digest, database.DeliveryDigest},
+		{m.NoMail, database.DeliveryNoMail},
+	} {
+		if v.r == nil {
+			continue
+		}
+		err = readMembers(&res, list.ID, v.r, v.delivery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &res, nil
+}
+
+// mailmanTemplate converts the Mailman header or footer v to a strew
+// template.
+func mailmanTemplate(res *Result, list, key, v, host string) string {
+	v = strings.Replace(v, "{{", "{{`{{`}}", -1)
+	v = mailmanVar.ReplaceAllStringFunc(v, func(match string) string {
+		switch name := mailmanVar.FindStringSubmatch(match)[1]; name {
+		case "real_name":
+			return "{{.Name}}"
+		case "list_name", "_internal_name":
+			return "{{.ID}}"
+		case "description":
+			return "{{.Description}}"
+		case "host_name":
+			return host
+		case "user_address":
+			return "{{.Subscriber}}"
+		default:
+			res.warnf("list %s: %s variable %q is not supported", list, key, name)
+			return match
+		}
+	})
+	return strings.Replace(v, "%%", "%", -1)
+}
+
+// readMembers adds the members listed one per line in r to list.
+// A later delivery mode overrides the previous one of a member.
+// Members without regular delivery are not imported: strew sends no digests,
+// and they would receive every post of the list.
+func readMembers(res *Result, list string, r io.Reader, delivery database.Delivery) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		n := len(res.Subscriptions)
+		res.subscribe(list, line, delivery)
+		if len(res.Subscriptions) == n {
+			continue
+		}
+		sub := res.Subscriptions[n]
+		res.Subscriptions = res.Subscriptions[:n]
+		i := 0
+		for ; i < n; i++ {
+			v := res.Subscriptions[i]
+			if v.List == list && strings.EqualFold(v.Address, sub.Address) {
+				break
+			}
+		}
+		switch {
+		case delivery != database.DeliveryRegular:
+			if i < n {
+				res.Subscriptions = append(res.Subscriptions[:i], res.Subscriptions[i+1:]...)
+			}
+			res.warnf("list %s: %s member %s was not imported, as %s delivery is not supported", list, delivery, sub.Address, delivery)
+		case i < n:
+			res.Subscriptions[i].Delivery = delivery
+		default:
+			res.Subscriptions = append(res.Subscriptions, sub)
+		}
+	}
+	return errors.WithStack(sc.Err())
+}
+
+// pyConfig holds the settings of a config.pck pickle.
+type pyConfig map[string]interface{}
+
+func (cfg pyConfig) has(key string) bool {
+	_, ok := cfg[key]
+	return ok
+}
+
+// set reports whether the setting key is neither empty nor zero.
+func (cfg pyConfig) set(key string) bool {
+	switch v := cfg[key].(type) {
+	case string:
+		return v != ""
+	case int64:
+		return v != 0
+	case bool:
+		return v
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+func (cfg pyConfig) str(key string) string {
+	v, _ := cfg[key].(string)
+	return v
+}
+
+func (cfg pyConfig) int(key string) int64 {
+	switch v := cfg[key].(type) {
+	case int64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (cfg pyConfig) bool(key string) bool {
+	return cfg.int(key) != 0
+}
+
+func (cfg pyConfig) strs(key string) []string {
+	var vs []string
+	list, _ := cfg[key].([]interface{})
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			vs = append(vs, s)
+		}
+	}
+	return vs
+}
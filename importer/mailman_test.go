@@ -0,0 +1,102 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sbinet-alt63/strew"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+// mailmanConfig is the config.pck of a list, pickled by Mailman with
+// cPickle.dump(dict, fp, 1). It includes the bounce information of a member,
+// a class instance.
+const mailmanConfig = "}q\x01(U\x0bdescriptionq\x02U$Discussions about Go, caf\xc3\xa9 includedq\x03" +
+	"U\x18generic_nonmember_actionq\x04K\x01U\x0cfrom_is_listq\x05K\x00" +
+	"U\x0esubject_prefixq\x06U\x0c[Golang %d] q\x07" +
+	"U\x06topicsq\x08]q\x09(U\x02Goq\nU\n.*golang.*q\x0bU\nGo's topicq\x0cI00\ntq\x0da" +
+	"U\x10max_message_sizeq\x0eK(U\x17bounce_info_stale_afterq\x0fL864000L\n" +
+	"U\nadvertisedq\x10I00\nU\x05ownerq\x11]q\x12U\x11admin@example.comq\x13a" +
+	"U\x0bbounce_infoq\x14}q\x15h\x13(c__main__\n_BounceInfo\nq\x16o}q\x17(U\x06memberq\x18h\x13" +
+	"U\x04dateq\x19(M\xe2\x07K\x01K\x02tq\x1aU\x05scoreq\x1bG?\xf0\x00\x00\x00\x00\x00\x00ubs" +
+	"U\x17dmarc_moderation_actionq\x1cK\x01" +
+	"U\nmsg_footerq\x1dU\x9c_______________________________________________\n" +
+	"%(real_name)s mailing list\n%(real_name)s@%(host_name)s\n" +
+	"%(web_page_url)slistinfo%(cgiext)s/%(_internal_name)sq\x1e" +
+	"U\x09real_nameq\x1fX\x06\x00\x00\x00Golangq U\x09host_nameq!U\x11lists.example.comq\"" +
+	"U\x17accept_these_nonmembersq#]q$(U\x0fbot@example.comq%U\x0f^.*@example.orgq&eu."
+
+func TestReadMailman(t *testing.T) {
+	res, err := ReadMailman(Mailman{
+		ID:      "Golang",
+		Config:  strings.NewReader(mailmanConfig),
+		Members: strings.NewReader("Alice <alice@example.com>\nbob@example.com\n\n"),
+		Digest:  strings.NewReader("carol@example.com\n"),
+		NoMail:  strings.NewReader("Bob@example.com\n"),
+	})
+	if err != nil {
+		t.Fatalf("could not import list: %+v", err)
+	}
+
+	want := &strew.List{
+		ID:              "golang",
+		Name:            "Golang",
+		Description:     "Discussions about Go, café included",
+		Address:         "golang@lists.example.com",
+		Hidden:          true,
+		SubscribersOnly: true,
+		MaxMessageSize:  40 * 1024,
+		SubjectPrefix:   "[Golang ]",
+		DMARCMitigation: "rewrite",
+		Footer: "_______________________________________________\n" +
+			"{{.Name}} mailing list\n" +
+			"{{.Name}}@lists.example.com\n" +
+			"%(web_page_url)slistinfo%(cgiext)s/{{.ID}}",
+	}
+	if len(res.Lists) != 1 || !reflect.DeepEqual(res.Lists[0], want) {
+		t.Fatalf("invalid list:\ngot= %+v\nwant=%+v", res.Lists[0], want)
+	}
+
+	subs := []database.Subscription{
+		{List: "golang", Address: "alice@example.com", Name: "Alice", Source: database.SourceImport, Delivery: database.DeliveryRegular},
+	}
+	if !reflect.DeepEqual(res.Subscriptions, subs) {
+		t.Fatalf("invalid subscriptions:\ngot= %+v\nwant=%+v", res.Subscriptions, subs)
+	}
+
+	warnings := []string{
+		`list golang: subject_prefix "[Golang %d] " has sequence numbers, which are not supported`,
+		`list golang: msg_footer variable "web_page_url" is not supported`,
+		`list golang: msg_footer variable "cgiext" is not supported`,
+		`list golang: accept_these_nonmembers is not supported`,
+		`list golang: owner is not supported`,
+		`list golang: digest member carol@example.com was not imported, as digest delivery is not supported`,
+		`list golang: nomail member Bob@example.com was not imported, as nomail delivery is not supported`,
+	}
+	if !reflect.DeepEqual(res.Warnings, warnings) {
+		t.Fatalf("invalid warnings:\ngot= %q\nwant=%q", res.Warnings, warnings)
+	}
+}
+
+func TestReadMailmanAnnounce(t *testing.T) {
+	res, err := ReadMailman(Mailman{
+		ID: "announce",
+		Config: strings.NewReader("}q\x01(U\x17accept_these_nonmembersq\x02" +
+			"]q\x03(U\x11admin@example.comq\x04U\x0f^.*@example.orgq\x05e" +
+			"U\x09host_nameq\x06U\x0bexample.comq\x07U\x19default_member_moderationq\x08K\x01u."),
+	})
+	if err != nil {
+		t.Fatalf("could not import list: %+v", err)
+	}
+	if got, want := res.Lists[0].Posters, []string{"admin@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid posters: got=%q, want=%q", got, want)
+	}
+	if len(res.Warnings) != 1 {
+		t.Fatalf("invalid warnings: %q", res.Warnings)
+	}
+}
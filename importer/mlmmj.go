@@ -0,0 +1,133 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+// mlmmjVar matches the $variable$ substitutions of mlmmj footers.
+var mlmmjVar = regexp.MustCompile(`\$([a-z0-9]+)\$`)
+
+// ReadMlmmj imports the list of the mlmmj spool directory dir, such as
+// /var/spool/mlmmj/golang. The ID of the list is the name of dir.
+func ReadMlmmj(dir string) (*Result, error) {
+	var (
+		res  Result
+		list = &strew.List{ID: filepath.Base(filepath.Clean(dir))}
+	)
+	res.Lists = []*strew.List{list}
+
+	control := filepath.Join(dir, "control")
+	names, err := readDirNames(control)
+	if err != nil {
+		return nil, errors.Wrapf(err, "strew/importer: could not read mlmmj control directory of %q", dir)
+	}
+
+	for _, name := range names {
+		raw, err := ioutil.ReadFile(filepath.Join(control, name))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		v := strings.TrimSpace(string(raw))
+		switch name {
+		case "listaddress":
+			list.Address = strings.TrimSpace(strings.SplitN(v, "\n", 2)[0])
+		case "prefix":
+			list.SubjectPrefix = v
+		case "footer":
+			list.Footer = mlmmjTemplate(&res, list.ID, strings.TrimRight(string(raw), "\n"))
+		case "subonlypost":
+			list.SubscribersOnly = true
+		case "maxmailsize":
+			list.MaxMessageSize, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "strew/importer: invalid maxmailsize of list %q", list.ID)
+			}
+		case "noarchive", "nodigestsub", "nonomailsubs":
+			// no archives, digests or nomail settings in strew.
+		default:
+			res.warnf("list %s: control/%s is not supported", list.ID, name)
+		}
+	}
+	if list.Address == "" {
+		return nil, fmt.Errorf("strew/importer: mlmmj list %q has no listaddress", list.ID)
+	}
+
+	for _, v := range []struct {
+		dir      string
+		delivery database.Delivery
+	}{
+		{"subscribers.d", database.DeliveryRegular},
+		{"digesters.d", database.DeliveryDigest},
+		{"nomailsubs.d", database.DeliveryNoMail},
+	} {
+		subs := filepath.Join(dir, v.dir)
+		names, err := readDirNames(subs)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			f, err := os.Open(filepath.Join(subs, name))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			err = readMembers(&res, list.ID, f, v.delivery)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &res, nil
+}
+
+// mlmmjTemplate converts the mlmmj footer v to a strew template.
+func mlmmjTemplate(res *Result, list, v string) string {
+	v = strings.Replace(v, "{{", "{{`{{`}}", -1)
+	return mlmmjVar.ReplaceAllStringFunc(v, func(match string) string {
+		switch name := mlmmjVar.FindStringSubmatch(match)[1]; name {
+		case "listaddr":
+			return "{{.Address}}"
+		case "listname":
+			return "{{.ID}}"
+		case "subaddr":
+			return "{{.Subscriber}}"
+		default:
+			res.warnf("list %s: footer variable %q is not supported", list, name)
+			return match
+		}
+	})
+}
+
+// readDirNames returns the sorted names of the regular files of dir.
+func readDirNames(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sbinet-alt63/strew"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+func TestReadMlmmj(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "strew-mlmmj-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "golang")
+	for fname, content := range map[string]string{
+		"control/listaddress":   "golang@example.com\n",
+		"control/prefix":        "[golang]\n",
+		"control/footer":        "-- \nSent to $listaddr$ ($listname$), unsubscribe at $listunsubaddr$\n",
+		"control/subonlypost":   "",
+		"control/maxmailsize":   "1048576\n",
+		"control/noarchive":     "",
+		"control/moderated":     "",
+		"subscribers.d/a":       "alice@example.com\n",
+		"subscribers.d/b":       "bob@example.com\n",
+		"digesters.d/c":         "carol@example.com\n",
+		"nomailsubs.d/d":        "dave@example.com\n",
+		"requeue/ignored-entry": "",
+	} {
+		fname = filepath.Join(dir, fname)
+		err = os.MkdirAll(filepath.Dir(fname), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(fname, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := ReadMlmmj(dir)
+	if err != nil {
+		t.Fatalf("could not import list: %+v", err)
+	}
+
+	want := &strew.List{
+		ID:              "golang",
+		Address:         "golang@example.com",
+		SubscribersOnly: true,
+		MaxMessageSize:  1048576,
+		SubjectPrefix:   "[golang]",
+		Footer:          "-- \nSent to {{.Address}} ({{.ID}}), unsubscribe at $listunsubaddr$",
+	}
+	if len(res.Lists) != 1 || !reflect.DeepEqual(res.Lists[0], want) {
+		t.Fatalf("invalid list:\ngot= %+v\nwant=%+v", res.Lists[0], want)
+	}
+
+	var got []string
+	for _, sub := range res.Subscriptions {
+		got = append(got, sub.Address+":"+string(sub.Delivery))
+	}
+	if want := []string{
+		"alice@example.com:regular",
+		"bob@example.com:regular",
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid subscriptions: got=%q, want=%q", got, want)
+	}
+	if res.Subscriptions[0].Source != database.SourceImport {
+		t.Fatalf("invalid subscription source: %q", res.Subscriptions[0].Source)
+	}
+
+	warnings := []string{
+		`list golang: footer variable "listunsubaddr" is not supported`,
+		`list golang: control/moderated is not supported`,
+		`list golang: digest member carol@example.com was not imported, as digest delivery is not supported`,
+		`list golang: nomail member dave@example.com was not imported, as nomail delivery is not supported`,
+	}
+	if !reflect.DeepEqual(res.Warnings, warnings) {
+		t.Fatalf("invalid warnings:\ngot= %q\nwant=%q", res.Warnings, warnings)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3" // SQLite driver.
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew"
+	"github.com/sbinet-alt63/strew/database"
+	ini "gopkg.in/ini.v1"
+)
+
+// ReadNanolist imports the lists of the nanolist configuration file fname,
+// and their subscribers from the SQLite database of the configuration.
+func ReadNanolist(fname string) (*Result, error) {
+	f, err := ini.Load(fname)
+	if err != nil {
+		return nil, errors.Wrapf(err, "strew/importer: could not read nanolist configuration %q", fname)
+	}
+
+	var (
+		res   Result
+		lists = make(map[string]bool)
+	)
+	for _, section := range f.ChildSections("list") {
+		list := &strew.List{ID: strings.TrimPrefix(section.Name(), "list.")}
+		for _, key := range section.Keys() {
+			switch key.Name() {
+			case "address":
+				list.Address = key.String()
+			case "name":
+				list.Name = key.String()
+			case "description":
+				list.Description = key.String()
+			case "hidden":
+				list.Hidden, err = key.Bool()
+			case "subscribers_only":
+				list.SubscribersOnly, err = key.Bool()
+			case "posters":
+				list.Posters = key.Strings(",")
+			case "bcc":
+				list.Bcc = key.Strings(",")
+			default:
+				res.warnf("list %s: unknown setting %q", list.ID, key.Name())
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "strew/importer: invalid setting %q of list %q", key.Name(), list.ID)
+			}
+		}
+		res.Lists = append(res.Lists, list)
+		lists[list.ID] = true
+	}
+
+	src := f.Section("").Key("database").String()
+	if src == "" {
+		res.warnf("no database in %s: subscribers were not imported", fname)
+		return &res, nil
+	}
+	db, err := sql.Open("sqlite3", src)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT list, user FROM subscriptions`)
+	if err != nil {
+		return nil, errors.Wrapf(err, "strew/importer: could not read nanolist database %q", src)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var list, user string
+		err = rows.Scan(&list, &user)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !lists[list] {
+			res.warnf("subscriber %s of unknown list %q was not imported", user, list)
+			continue
+		}
+		res.subscribe(list, user, database.DeliveryRegular)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &res, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sbinet-alt63/strew/database"
+	_ "github.com/sbinet-alt63/strew/database/memdb"
+)
+
+func TestReadNanolist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strew-nanolist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbname := filepath.Join(dir, "nanolist.db")
+	db, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS "subscriptions" ("list" TEXT, "user" TEXT)`,
+		`INSERT INTO subscriptions VALUES ('golang', 'alice@example.com')`,
+		`INSERT INTO subscriptions VALUES ('golang', 'Bob <bob@example.com>')`,
+		`INSERT INTO subscriptions VALUES ('announce', 'carol@example.com')`,
+		`INSERT INTO subscriptions VALUES ('rust', 'dave@example.com')`,
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	cfg := filepath.Join(dir, "nanolist.ini")
+	err = ioutil.WriteFile(cfg, []byte(`command_address = lists@example.com
+database = `+dbname+`
+
+[list.golang]
+address = golang@example.com
+name = "Go programming"
+description = "General discussion of Go programming"
+bcc = archive@example.com, datahoarder@example.com
+archive = true
+
+[list.announce]
+address = announce@example.com
+name = "Announcements"
+posters = admin@example.com, moderator@example.com
+hidden = true
+subscribers_only = true
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ReadNanolist(cfg)
+	if err != nil {
+		t.Fatalf("could not import lists: %+v", err)
+	}
+
+	warnings := []string{
+		`list golang: unknown setting "archive"`,
+		`subscriber dave@example.com of unknown list "rust" was not imported`,
+	}
+	if !reflect.DeepEqual(res.Warnings, warnings) {
+		t.Fatalf("invalid warnings:\ngot= %q\nwant=%q", res.Warnings, warnings)
+	}
+
+	buf := new(bytes.Buffer)
+	err = res.WriteConfig(buf)
+	if err != nil {
+		t.Fatalf("could not write configuration: %+v", err)
+	}
+	want := `[list.golang]
+name        = Go programming
+description = General discussion of Go programming
+address     = golang@example.com
+bcc         = archive@example.com, datahoarder@example.com
+
+[list.announce]
+name             = Announcements
+address          = announce@example.com
+hidden           = true
+subscribers_only = true
+posters          = admin@example.com, moderator@example.com
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("invalid configuration:\ngot= %q\nwant=%q", got, want)
+	}
+
+	store, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = res.Apply(ctx, store)
+	if err != nil {
+		t.Fatalf("could not apply import: %+v", err)
+	}
+	subs, err := store.Subscribers(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com", "bob@example.com"}; !reflect.DeepEqual(subs, want) {
+		t.Fatalf("invalid subscribers: got=%q, want=%q", subs, want)
+	}
+	sub, err := store.Subscription(ctx, "bob@example.com", "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Name != "Bob" || sub.Source != database.SourceImport {
+		t.Fatalf("invalid subscription: %+v", sub)
+	}
+}
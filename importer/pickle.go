@@ -0,0 +1,425 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// maxPickleDepth bounds the nesting of the values of a pickle.
+const maxPickleDepth = 64
+
+// pyObject is an instance of a Python class, such as the bounce information
+// of a member. Its state is not decoded.
+type pyObject struct {
+	Class string
+}
+
+// pyList and pyDict are the mutable containers of a pickle being decoded.
+// Dictionaries are kept as the list of their keys and values.
+type (
+	pyList struct{ items []interface{} }
+	pyDict struct{ items []interface{} }
+)
+
+// parsePickle decodes the dictionary of settings pickled in the config.pck
+// of a Mailman 2 list.
+//
+// Mailman writes it with the binary protocol 1 of cPickle: only the opcodes
+// of that protocol which build dicts, lists, tuples, strings and numbers are
+// supported. Instances of classes are decoded as pyObject values.
+// Values are decoded as string, int64, *big.Int, float64, bool, nil,
+// pyObject or []interface{}.
+func parsePickle(data []byte) (pyConfig, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	v, err := u.run()
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(*pyDict)
+	if !ok {
+		return nil, fmt.Errorf("strew/importer: pickle is a %T, not a dict", v)
+	}
+	cfg := make(pyConfig)
+	for i := 0; i+1 < len(dict.items); i += 2 {
+		key, ok := dict.items[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("strew/importer: invalid setting name %v", dict.items[i])
+		}
+		v, err := pyValue(dict.items[i+1], 0)
+		if err != nil {
+			return nil, errors.WithMessage(err, "strew/importer: invalid setting "+key)
+		}
+		cfg[key] = v
+	}
+	return cfg, nil
+}
+
+// pyValue converts the containers of v to []interface{}.
+func pyValue(v interface{}, depth int) (interface{}, error) {
+	if depth > maxPickleDepth {
+		return nil, fmt.Errorf("strew/importer: values nested too deeply")
+	}
+	var items []interface{}
+	switch v := v.(type) {
+	case *pyList:
+		items = v.items
+	case *pyDict:
+		items = v.items
+	case []interface{}:
+		items = v
+	default:
+		return v, nil
+	}
+	vs := make([]interface{}, len(items))
+	for i, item := range items {
+		var err error
+		vs[i], err = pyValue(item, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vs, nil
+}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	marks []int
+	memo  map[int]interface{}
+}
+
+func (u *unpickler) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("strew/importer: pickle offset %d: %s", u.pos, fmt.Sprintf(format, args...))
+}
+
+func (u *unpickler) run() (interface{}, error) {
+	for {
+		if u.pos >= len(u.data) {
+			return nil, u.errorf("unexpected end of pickle")
+		}
+		op := u.data[u.pos]
+		u.pos++
+		if op == '.' { // STOP
+			if len(u.stack) != 1 || len(u.marks) != 0 {
+				return nil, u.errorf("invalid stack at end of pickle")
+			}
+			return u.stack[0], nil
+		}
+		if err := u.exec(op); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// exec executes the opcode op.
+func (u *unpickler) exec(op byte) error {
+	switch op {
+	case '(': // MARK
+		u.marks = append(u.marks, len(u.stack))
+	case 'N': // NONE
+		u.push(nil)
+	case 'I': // INT, also used for booleans as I01 and I00.
+		line, err := u.line()
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "01":
+			u.push(true)
+		case "00":
+			u.push(false)
+		default:
+			v, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return u.errorf("invalid integer %q", line)
+			}
+			u.push(v)
+		}
+	case 'J': // BININT
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+	case 'K': // BININT1
+		b, err := u.read(1)
+		if err != nil {
+			return err
+		}
+		u.push(int64(b[0]))
+	case 'M': // BININT2
+		b, err := u.read(2)
+		if err != nil {
+			return err
+		}
+		u.push(int64(binary.LittleEndian.Uint16(b)))
+	case 'L': // LONG
+		line, err := u.line()
+		if err != nil {
+			return err
+		}
+		v, ok := new(big.Int).SetString(strings.TrimSuffix(line, "L"), 10)
+		if !ok {
+			return u.errorf("invalid integer %q", line)
+		}
+		if v.IsInt64() {
+			u.push(v.Int64())
+		} else {
+			u.push(v)
+		}
+	case 'G': // BINFLOAT
+		b, err := u.read(8)
+		if err != nil {
+			return err
+		}
+		u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case 'U', 'T': // SHORT_BINSTRING, BINSTRING
+		n := 1
+		if op == 'T' {
+			n = 4
+		}
+		b, err := u.readString(n)
+		if err != nil {
+			return err
+		}
+		u.push(pyString(b))
+	case 'X': // BINUNICODE
+		b, err := u.readString(4)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(b) {
+			return u.errorf("invalid UTF-8 string")
+		}
+		u.push(string(b))
+	case ']': // EMPTY_LIST
+		u.push(&pyList{})
+	case 'l': // LIST
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(&pyList{items: items})
+	case 'a', 'e': // APPEND, APPENDS
+		items, err := u.popItems(op == 'e', 1)
+		if err != nil {
+			return err
+		}
+		list, ok := u.top().(*pyList)
+		if !ok {
+			return u.errorf("appending to a %T", u.top())
+		}
+		list.items = append(list.items, items...)
+	case ')': // EMPTY_TUPLE
+		u.push([]interface{}{})
+	case 't': // TUPLE
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(append([]interface{}{}, items...))
+	case '}': // EMPTY_DICT
+		u.push(&pyDict{})
+	case 'd': // DICT
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		if len(items)%2 != 0 {
+			return u.errorf("odd number of dict items")
+		}
+		u.push(&pyDict{items: items})
+	case 's', 'u': // SETITEM, SETITEMS
+		items, err := u.popItems(op == 'u', 2)
+		if err != nil {
+			return err
+		}
+		if len(items)%2 != 0 {
+			return u.errorf("odd number of dict items")
+		}
+		dict, ok := u.top().(*pyDict)
+		if !ok {
+			return u.errorf("setting an item of a %T", u.top())
+		}
+		dict.items = append(dict.items, items...)
+	case 'q', 'r': // BINPUT, LONG_BINPUT
+		i, err := u.index(op == 'r')
+		if err != nil {
+			return err
+		}
+		if len(u.stack) == 0 {
+			return u.errorf("stack underflow")
+		}
+		u.memo[i] = u.top()
+	case 'h', 'j': // BINGET, LONG_BINGET
+		i, err := u.index(op == 'j')
+		if err != nil {
+			return err
+		}
+		v, ok := u.memo[i]
+		if !ok {
+			return u.errorf("unknown memo key %d", i)
+		}
+		u.push(v)
+	case 'c': // GLOBAL
+		module, err := u.line()
+		if err != nil {
+			return err
+		}
+		name, err := u.line()
+		if err != nil {
+			return err
+		}
+		u.push(pyObject{Class: module + "." + name})
+	case 'o': // OBJ
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return u.errorf("missing class of object")
+		}
+		u.push(newObject(items[0]))
+	case 'R': // REDUCE
+		if len(u.stack) < 2 {
+			return u.errorf("stack underflow")
+		}
+		fn := u.stack[len(u.stack)-2]
+		u.stack = u.stack[:len(u.stack)-2]
+		u.push(newObject(fn))
+	case 'b': // BUILD: the state of objects is ignored.
+		if len(u.stack) < 2 {
+			return u.errorf("stack underflow")
+		}
+		u.stack = u.stack[:len(u.stack)-1]
+	default:
+		return u.errorf("unsupported opcode %q", op)
+	}
+	return nil
+}
+
+// newObject returns the instance created by calling class.
+func newObject(class interface{}) pyObject {
+	if obj, ok := class.(pyObject); ok {
+		return obj
+	}
+	return pyObject{}
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+// top returns the top of the stack, or nil if it is empty.
+func (u *unpickler) top() interface{} {
+	if len(u.stack) == 0 {
+		return nil
+	}
+	return u.stack[len(u.stack)-1]
+}
+
+// popMark pops the values pushed since the last MARK.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, u.errorf("missing mark")
+	}
+	n := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	if n > len(u.stack) {
+		return nil, u.errorf("stack underflow")
+	}
+	items := u.stack[n:]
+	u.stack = u.stack[:n:n]
+	return items, nil
+}
+
+// popItems pops the values pushed since the last MARK if mark is set, or
+// the n top values otherwise.
+func (u *unpickler) popItems(mark bool, n int) ([]interface{}, error) {
+	if mark {
+		return u.popMark()
+	}
+	// the container the items are added to stays on the stack.
+	if len(u.stack) <= n {
+		return nil, u.errorf("stack underflow")
+	}
+	n = len(u.stack) - n
+	items := u.stack[n:]
+	u.stack = u.stack[:n:n]
+	return items, nil
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, u.errorf("unexpected end of pickle")
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+// readString reads a string prefixed by its length, stored on size bytes.
+func (u *unpickler) readString(size int) ([]byte, error) {
+	b, err := u.read(size)
+	if err != nil {
+		return nil, err
+	}
+	n := int(b[0])
+	if size == 4 {
+		n = int(int32(binary.LittleEndian.Uint32(b)))
+	}
+	return u.read(n)
+}
+
+// index reads a memo key stored on 1 byte, or on 4 if long is set.
+func (u *unpickler) index(long bool) (int, error) {
+	if !long {
+		b, err := u.read(1)
+		if err != nil {
+			return 0, err
+		}
+		return int(b[0]), nil
+	}
+	b, err := u.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(b)), nil
+}
+
+// line reads the argument of a text opcode, up to a newline.
+func (u *unpickler) line() (string, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return "", u.errorf("unexpected end of pickle")
+	}
+	line := string(u.data[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+// pyString converts a Python byte string. Byte strings that are not valid
+// UTF-8 are decoded as Latin-1.
+func pyString(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
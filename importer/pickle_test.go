@@ -0,0 +1,53 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePickle(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want pyConfig
+	}{
+		{
+			name: "values",
+			data: "}q\x01(U\x01aU\x04it'sq\x02U\x01cJ\xd6\xff\xff\xffU\x01eNU\x01dI01\n" +
+				"U\x01g]q\x03(K\x01(K\x02U\x01xtq\x04}q\x05U\x01kU\x01vsU\x01xe" +
+				"U\x01fX\x02\x00\x00\x00\xc3\xa9U\x01iJ\x00\x00\x10\x00U\x01hL1180591620717411303424L\n" +
+				"U\x01kG?\xf8\x00\x00\x00\x00\x00\x00U\x01jU\x03\xe9t\xe9q\x06u.",
+			want: pyConfig{
+				"a": "it's", "c": int64(-42), "d": true, "e": nil, "f": "é",
+				"g": []interface{}{int64(1), []interface{}{int64(2), "x"}, []interface{}{"k", "v"}, "x"},
+				"h": new(big.Int).Lsh(big.NewInt(1), 70), "i": int64(1 << 20), "j": "été", "k": 1.5,
+			},
+		},
+		{name: "empty"},
+		{name: "not-dict", data: "K\x01."},
+		{name: "truncated", data: "}U\x05ab."},
+		{name: "no-stop", data: "}"},
+		{name: "odd-items", data: "}(K\x01u."},
+		{name: "protocol-2", data: "\x80\x02}."},
+		{name: "unknown-memo", data: "}h\x05."},
+		{name: "setitem-underflow", data: "(U\x01as."},
+		{name: "non-string-name", data: "}K\x01K\x02s."},
+		{name: "too-deep", data: "}U\x01a" + strings.Repeat("]", 70) + strings.Repeat("a", 69) + "s."},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parsePickle([]byte(tc.data))
+			if (err != nil) != (tc.want == nil) {
+				t.Fatalf("invalid error: %v", err)
+			}
+			if tc.want != nil && !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("invalid settings:\ngot= %#v\nwant=%#v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+// reconcileLists brings the lists of db in line with the configured lists.
+// Configured lists missing from db, or deleted, are made active, and lists
+// of db which are no longer configured are marked as deleted: their
+// subscriptions are kept until the list is purged.
+// Closed and archived lists keep their state.
+func reconcileLists(ctx context.Context, db database.Store, lists map[string]*List) error {
+	states, err := db.ListStates(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var (
+		batch      = new(database.Batch)
+		configured = make(map[string]bool, len(lists))
+	)
+	for _, list := range lists {
+		configured[list.ID] = true
+		state, ok := states[list.ID]
+		switch {
+		case !ok:
+			batch.AddList(list.ID)
+		case state == database.ListDeleted:
+			log.Printf("server: restoring deleted list %q", list.ID)
+			batch.AddList(list.ID)
+		}
+	}
+
+	ids := make([]string, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if configured[id] || states[id] == database.ListDeleted {
+			continue
+		}
+		log.Printf("server: list %q is no longer configured, marking it as deleted", id)
+		batch.DelList(id)
+	}
+
+	return errors.WithStack(db.Apply(ctx, batch))
+}
+
+// configured reports whether the list id has a section in cfg.
+func (cfg Config) configured(id string) bool {
+	for _, list := range cfg.Lists {
+		if list.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SetListState changes the state of the configured list id in db.
+// Posts to closed and archived lists are refused, and so are new
+// subscriptions. Lists are deleted by removing them from the configuration.
+func SetListState(ctx context.Context, cfg Config, db database.Store, id string, state database.ListState) error {
+	if !cfg.configured(id) {
+		return fmt.Errorf("strew: list %q is not configured", id)
+	}
+	if state == database.ListDeleted {
+		return fmt.Errorf("strew: list %q is configured: remove it from the configuration to delete it", id)
+	}
+	return db.SetListState(ctx, id, state)
+}
+
+// PurgeList removes the list id, which is no longer configured, from db
+// along with its subscriptions and keys.
+func PurgeList(ctx context.Context, cfg Config, db database.Store, id string) error {
+	if cfg.configured(id) {
+		return fmt.Errorf("strew: list %q is configured: remove it from the configuration before purging it", id)
+	}
+	return db.PurgeList(ctx, id)
+}
+
+// SetListState changes the state of the configured list id.
+func (srv *Server) SetListState(ctx context.Context, id string, state database.ListState) error {
+	return SetListState(ctx, srv.cfg, srv.db, id, state)
+}
+
+// PurgeList removes the list id, which is no longer configured, along with
+// its subscriptions.
+func (srv *Server) PurgeList(ctx context.Context, id string) error {
+	return PurgeList(ctx, srv.cfg, srv.db, id)
+}
+
+// listState returns the state of the list id.
+func (srv *Server) listState(ctx context.Context, id string) (database.ListState, error) {
+	state, err := srv.db.ListState(ctx, id)
+	if err != nil {
+		return "", errors.WithMessage(err, "strew: could not get state of list "+id)
+	}
+	return state, nil
+}
+
+func (srv *Server) handleClosed(ctx context.Context, msg *Message, list *List) error {
+	return srv.notify(msg, fmt.Sprintf("The mailing list %s is closed. Your message has not been delivered.\r\n", list.Address))
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+	_ "github.com/sbinet-alt63/strew/database/memdb"
+)
+
+func TestReconcileLists(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, list := range []string{"golang", "rust", "haskell", "ocaml", "old"} {
+		db.AddList(ctx, list)
+	}
+	db.SetListState(ctx, "rust", database.ListClosed)
+	db.SetListState(ctx, "haskell", database.ListArchived)
+	db.DelList(ctx, "ocaml")
+	db.DelList(ctx, "old")
+	db.Subscribe(ctx, "alice@example.com", "haskell")
+
+	cfg := Config{Lists: map[string]*List{
+		"golang@example.com": {ID: "golang", Address: "golang@example.com"},
+		"rust@example.com":   {ID: "rust", Address: "rust@example.com"},
+		"ocaml@example.com":  {ID: "ocaml", Address: "ocaml@example.com"},
+		"zig@example.com":    {ID: "zig", Address: "zig@example.com"},
+	}}
+	err = reconcileLists(ctx, db, cfg.Lists)
+	if err != nil {
+		t.Fatalf("could not reconcile lists: %+v", err)
+	}
+
+	states, err := db.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]database.ListState{
+		"golang":  database.ListActive,
+		"rust":    database.ListClosed,
+		"haskell": database.ListDeleted,
+		"ocaml":   database.ListActive,
+		"old":     database.ListDeleted,
+		"zig":     database.ListActive,
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Fatalf("invalid list states:\ngot= %v\nwant=%v", states, want)
+	}
+	subs, err := db.Subscribers(ctx, "haskell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 {
+		t.Fatalf("subscriptions of deleted list were not kept: %q", subs)
+	}
+
+	srv := &Server{cfg: cfg, db: db}
+	for _, tc := range []struct {
+		name string
+		fn   func() error
+		err  bool
+	}{
+		{name: "close", fn: func() error { return srv.SetListState(ctx, "golang", database.ListClosed) }},
+		{name: "reopen", fn: func() error { return srv.SetListState(ctx, "rust", database.ListActive) }},
+		{name: "delete-configured", fn: func() error { return srv.SetListState(ctx, "zig", database.ListDeleted) }, err: true},
+		{name: "open-unconfigured", fn: func() error { return srv.SetListState(ctx, "haskell", database.ListActive) }, err: true},
+		{name: "purge-configured", fn: func() error { return srv.PurgeList(ctx, "golang") }, err: true},
+		{name: "purge", fn: func() error { return srv.PurgeList(ctx, "haskell") }},
+		{name: "purge-unknown", fn: func() error { return srv.PurgeList(ctx, "cobol") }, err: true},
+	} {
+		err := tc.fn()
+		if (err != nil) != tc.err {
+			t.Fatalf("%s: invalid error: %v", tc.name, err)
+		}
+	}
+
+	state, err := srv.listState(ctx, "golang")
+	if err != nil || state != database.ListClosed {
+		t.Fatalf("invalid state: %q (err=%v)", state, err)
+	}
+	_, err = srv.listState(ctx, "haskell")
+	if errors.Cause(err) != database.ErrListNotFound {
+		t.Fatalf("invalid error: got=%v, want=%v", err, database.ErrListNotFound)
+	}
+	users, err := db.Users(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("subscriptions of purged list were kept: %q", users)
+	}
+}
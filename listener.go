@@ -0,0 +1,201 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/proto"
+)
+
+// newListener creates the command socket described by cfg.
+//
+// Addresses of the form "unix:/path/to/socket" create a Unix-domain socket
+// with the file permissions given by cfg.ListenPerm (0600 by default).
+// Any other address is a TCP address.
+// The listener is wrapped with TLS when a certificate is configured.
+func newListener(cfg Config) (net.Listener, error) {
+	var (
+		sck net.Listener
+		err error
+	)
+
+	switch {
+	case strings.HasPrefix(cfg.ListenAddress, "unix:"):
+		fname := strings.TrimPrefix(cfg.ListenAddress, "unix:")
+		perm := os.FileMode(0600)
+		if cfg.ListenPerm != "" {
+			v, err := strconv.ParseUint(cfg.ListenPerm, 8, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "strew: invalid listen_perm %q", cfg.ListenPerm)
+			}
+			perm = os.FileMode(v)
+		}
+		sck, err = listenUnix(fname, perm)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		sck, err = net.Listen("tcp", cfg.ListenAddress)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if cfg.ListenTLSCert == "" {
+		if cfg.ListenClientCA != "" {
+			sck.Close()
+			return nil, fmt.Errorf("strew: listen_client_ca requires listen_tls_cert and listen_tls_key")
+		}
+		return sck, nil
+	}
+
+	tlscfg, err := newListenerTLSConfig(cfg)
+	if err != nil {
+		sck.Close()
+		return nil, err
+	}
+	return tls.NewListener(sck, tlscfg), nil
+}
+
+// listenUnix creates the Unix-domain socket fname with the permissions perm.
+// The socket is created in a private directory, and only moved to fname
+// once its permissions are set, so that it is never reachable with the
+// permissions of the umask.
+func listenUnix(fname string, perm os.FileMode) (net.Listener, error) {
+	// remove a stale socket left over by a previous run.
+	if fi, err := os.Lstat(fname); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(fname)
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(fname), ".strew-sock-")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	sck, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ul := sck.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmp, perm)
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	}
+	if err != nil {
+		ul.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &unixListener{UnixListener: ul, fname: fname}, nil
+}
+
+// unixListener removes its socket file when closed.
+type unixListener struct {
+	*net.UnixListener
+	fname string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.fname)
+	return err
+}
+
+func newListenerTLSConfig(cfg Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.ListenTLSCert, cfg.ListenTLSKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: could not load command socket certificate")
+	}
+
+	tlscfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ListenClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.ListenClientCA)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("strew: no certificate found in %q", cfg.ListenClientCA)
+		}
+		tlscfg.ClientCAs = pool
+		tlscfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlscfg, nil
+}
+
+// authTimeout is the time given to clients to complete the TLS and
+// shared-secret handshakes.
+var authTimeout = 10 * time.Second
+
+// authenticate performs the TLS handshake and the shared-secret handshake,
+// if they are configured, within authTimeout.
+func (srv *Server) authenticate(conn net.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(authTimeout))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if c, ok := conn.(*tls.Conn); ok {
+		err = c.Handshake()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if srv.cfg.ListenToken != "" {
+		err = srv.checkToken(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.WithStack(conn.SetDeadline(time.Time{}))
+}
+
+// checkToken reads the authentication frame of the client and checks its
+// shared secret.
+func (srv *Server) checkToken(conn net.Conn) error {
+	var auth proto.Auth
+	_, err := auth.ReadFrom(conn)
+	if err != nil {
+		return err
+	}
+
+	resp := proto.Response{Status: proto.Accepted}
+	ok := subtle.ConstantTimeCompare([]byte(auth.Token), []byte(srv.cfg.ListenToken)) == 1
+	if !ok {
+		resp.Status = proto.Rejected
+		resp.Reason = "invalid authentication token"
+	}
+
+	_, err = resp.WriteTo(conn)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid authentication token from %v", conn.RemoteAddr())
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet-alt63/strew/client"
+	"github.com/sbinet-alt63/strew/proto"
+)
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strew-listener-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "strew.sock")
+
+	for _, tc := range []struct {
+		perm string
+		want os.FileMode
+	}{
+		{"", 0600},
+		{"0660", 0660},
+	} {
+		sck, err := newListener(Config{ListenAddress: "unix:" + fname, ListenPerm: tc.perm})
+		if err != nil {
+			t.Fatalf("could not listen: %+v", err)
+		}
+		fi, err := os.Lstat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != tc.want {
+			t.Fatalf("invalid socket mode: got=%v, want=%v", fi.Mode(), os.ModeSocket|tc.want)
+		}
+
+		c, err := net.Dial("unix", fname)
+		if err != nil {
+			t.Fatalf("could not connect: %v", err)
+		}
+		c.Close()
+
+		sck.Close()
+		_, err = os.Lstat(fname)
+		if !os.IsNotExist(err) {
+			t.Fatalf("socket was not removed: %v", err)
+		}
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 0 {
+			t.Fatalf("temporary files were left: %v", names)
+		}
+	}
+}
+
+// testPKI writes a CA, a server certificate for 127.0.0.1 and a client
+// certificate signed by the CA to dir.
+type testPKI struct {
+	ca     string // PEM file of the CA certificate.
+	pool   *x509.CertPool
+	cert   string // PEM files of the server certificate and key.
+	key    string
+	client tls.Certificate
+}
+
+func newTestPKI(t *testing.T, dir string) testPKI {
+	newCert := func(tmpl, parent *x509.Certificate, signer *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, signer = tmpl, key
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	writePEM := func(name, typ string, der []byte) string {
+		fname := filepath.Join(dir, name)
+		err := ioutil.WriteFile(fname, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+
+	var (
+		now      = time.Now()
+		template = func(n int64, name string) *x509.Certificate {
+			return &x509.Certificate{
+				SerialNumber: big.NewInt(n),
+				Subject:      pkix.Name{CommonName: name},
+				NotBefore:    now.Add(-time.Hour),
+				NotAfter:     now.Add(time.Hour),
+			}
+		}
+	)
+
+	tmpl := template(1, "strew test CA")
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	ca, caKey := newCert(tmpl, nil, nil)
+
+	tmpl = template(2, "127.0.0.1")
+	tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	srv, srvKey := newCert(tmpl, ca, caKey)
+
+	tmpl = template(3, "client")
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	cli, cliKey := newCert(tmpl, ca, caKey)
+
+	srvDER, err := x509.MarshalECPrivateKey(srvKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := testPKI{
+		ca:   writePEM("ca.pem", "CERTIFICATE", ca.Raw),
+		pool: x509.NewCertPool(),
+		cert: writePEM("cert.pem", "CERTIFICATE", srv.Raw),
+		key:  writePEM("key.pem", "EC PRIVATE KEY", srvDER),
+		client: tls.Certificate{
+			Certificate: [][]byte{cli.Raw},
+			PrivateKey:  cliKey,
+		},
+	}
+	pki.pool.AddCert(ca)
+	return pki
+}
+
+func TestListenerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strew-listener-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pki := newTestPKI(t, dir)
+
+	srv, relay := newTestServer(t, Config{
+		ListenAddress:  "127.0.0.1:0",
+		ListenTLSCert:  pki.cert,
+		ListenTLSKey:   pki.key,
+		ListenClientCA: pki.ca,
+		ListenToken:    "s3cr3t",
+	})
+	defer relay.l.Close()
+	srv.sck.Close()
+	srv.sck, err = newListener(srv.cfg)
+	if err != nil {
+		t.Fatalf("could not listen: %+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx)
+
+	addr := srv.sck.Addr().String()
+	dial := func(certs ...tls.Certificate) *client.Client {
+		c, err := client.DialTLS("tcp", addr, &tls.Config{RootCAs: pki.pool, Certificates: certs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := dial(pki.client)
+	defer c.Close()
+	err = c.Auth("s3cr3t")
+	if err != nil {
+		t.Fatalf("could not authenticate: %+v", err)
+	}
+	resp, err := c.SubmitRaw([]byte("From: alice@example.com\r\nTo: strew@example.com\r\nSubject: help\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("could not submit message: %+v", err)
+	}
+	if resp.Status != proto.Accepted {
+		t.Fatalf("invalid response: %+v", resp)
+	}
+
+	// a rejected token closes the connection.
+	bad := dial(pki.client)
+	defer bad.Close()
+	err = bad.Auth("guess")
+	if err == nil || !strings.Contains(err.Error(), "invalid authentication token") {
+		t.Fatalf("invalid error: %v", err)
+	}
+	_, err = bad.SubmitRaw([]byte("From: alice@example.com\r\nTo: strew@example.com\r\nSubject: help\r\n\r\n"))
+	if err == nil {
+		t.Fatalf("connection with a rejected token was kept open")
+	}
+
+	// clients without a certificate signed by the CA are refused.
+	anon := dial()
+	defer anon.Close()
+	err = anon.Auth("s3cr3t")
+	if err == nil {
+		t.Fatalf("client without certificate was accepted")
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	defer func(v time.Duration) { authTimeout = v }(authTimeout)
+	authTimeout = 50 * time.Millisecond
+
+	srv, relay := newTestServer(t, Config{ListenToken: "s3cr3t"})
+	defer relay.l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx)
+
+	conn, err := net.Dial("tcp", srv.sck.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// never send the authentication frame.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("idle unauthenticated connection was not closed: %v", err)
+	}
+}
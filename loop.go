@@ -0,0 +1,61 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// isLoop reports whether msg was already sent by list, as marked by the
+// X-Loop and List-Id header fields strew adds to posts.
+func isLoop(msg *Message, list *List) bool {
+	for _, v := range msg.headerValues("X-Loop") {
+		if strings.EqualFold(strings.Trim(v, "<>"), list.Address) {
+			return true
+		}
+	}
+	for _, v := range msg.headerValues("List-Id") {
+		i := strings.LastIndex(v, "<")
+		j := strings.LastIndex(v, ">")
+		if i < 0 || j < i {
+			continue
+		}
+		switch id := strings.ToLower(v[i+1 : j]); id {
+		case strings.ToLower(list.Address), strings.ToLower(list.ID):
+			return true
+		}
+	}
+	return false
+}
+
+// isAutomated reports whether msg was sent by an automated process, such as
+// an auto-responder, a mailing list or a mailer daemon, and must not be
+// answered. (RFC 3834)
+func isAutomated(msg *Message) bool {
+	if v := strings.ToLower(strings.TrimSpace(msg.AutoSubmitted)); v != "" && !strings.HasPrefix(v, "no") {
+		return true
+	}
+	for _, v := range msg.headerValues("Precedence") {
+		switch strings.ToLower(v) {
+		case "bulk", "list", "junk":
+			return true
+		}
+	}
+	for _, v := range msg.headerValues("Return-Path") {
+		if strings.Trim(v, " <>") == "" {
+			return true
+		}
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return true
+	}
+	local := strings.ToLower(from.Address)
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	return local == "mailer-daemon"
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func readMessage(t *testing.T, raw string) *Message {
+	t.Helper()
+	var msg Message
+	_, err := msg.ReadFrom(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("could not read message: %+v", err)
+	}
+	return &msg
+}
+
+func TestIsLoop(t *testing.T) {
+	list := &List{ID: "golang", Address: "golang@example.com"}
+	for _, tc := range []struct {
+		hdr  string
+		want bool
+	}{
+		{hdr: "", want: false},
+		{hdr: "X-Loop: golang@example.com\r\n", want: true},
+		{hdr: "X-Loop: other@example.com\r\nX-Loop: <GOLANG@example.com>\r\n", want: true},
+		{hdr: "List-Id: golang <golang@example.com>\r\n", want: true},
+		{hdr: "List-Id: Go programming <golang>\r\n", want: true},
+		{hdr: "List-Id: <rust@example.com>\r\n", want: false},
+	} {
+		msg := readMessage(t, tc.hdr+"From: gopher@example.com\r\nTo: golang@example.com\r\n\r\nhello\r\n")
+		if got := isLoop(msg, list); got != tc.want {
+			t.Fatalf("%q: got=%v, want=%v", tc.hdr, got, tc.want)
+		}
+	}
+
+	// posts sent by a list are detected as loops by this list.
+	post := readMessage(t, "From: gopher@example.com\r\nTo: golang@example.com\r\n\r\nhello\r\n").resendTo(list)
+	buf := new(bytes.Buffer)
+	_, err := post.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isLoop(readMessage(t, buf.String()), list) {
+		t.Fatalf("post sent by the list not detected as a loop:\n%s", buf.String())
+	}
+}
+
+func TestIsAutomated(t *testing.T) {
+	for _, tc := range []struct {
+		hdr  string
+		want bool
+	}{
+		{hdr: "From: gopher@example.com\r\n", want: false},
+		{hdr: "From: gopher@example.com\r\nAuto-Submitted: no\r\n", want: false},
+		{hdr: "From: gopher@example.com\r\nAuto-Submitted: auto-replied\r\n", want: true},
+		{hdr: "From: gopher@example.com\r\nPrecedence: bulk\r\n", want: true},
+		{hdr: "From: gopher@example.com\r\nPrecedence: List\r\n", want: true},
+		{hdr: "Return-Path: <>\r\nFrom: gopher@example.com\r\n", want: true},
+		{hdr: "From: Mail Delivery System <MAILER-DAEMON@example.com>\r\n", want: true},
+	} {
+		msg := readMessage(t, tc.hdr+"To: strew@example.com\r\nSubject: help\r\n\r\n")
+		if got := isAutomated(msg); got != tc.want {
+			t.Fatalf("%q: got=%v, want=%v", tc.hdr, got, tc.want)
+		}
+	}
+
+	// replies of the server are marked as automated.
+	reply := readMessage(t, "From: gopher@example.com\r\nSubject: help\r\n\r\n").Reply()
+	reply.From = "strew@example.com"
+	reply.AutoSubmitted = "auto-replied"
+	buf := new(bytes.Buffer)
+	_, err := reply.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAutomated(readMessage(t, buf.String())) {
+		t.Fatalf("reply not detected as automated:\n%s", buf.String())
+	}
+}
@@ -5,17 +5,31 @@
 package strew
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"mime"
 	"net/mail"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/dkim"
+)
+
+// maxHeaderSize is the maximum size of the header section of a message
+// read with a size limit.
+const maxHeaderSize = 1 << 20
+
+var (
+	ErrMessageTooLarge = errors.New("strew: message too large")
 )
 
 type Message struct {
 	Subject     string
 	From        string
+	ReplyTo     string
 	To          string
 	Cc          string
 	Bcc         string
@@ -23,8 +37,20 @@ type Message struct {
 	ID          string
 	InReplyTo   string
 	ContentType string
+	Encoding    string // Content-Transfer-Encoding
 	XList       string
 	Body        string
+
+	AutoSubmitted string // Auto-Submitted (RFC 3834)
+	XLoop         string // address of the list that sent the message.
+
+	spool  *spool       // body of the message, when spooled to disk.
+	header []byte       // header section of the message, as received.
+	arc    []string     // ARC header fields of the message, forwarded as is.
+	auth   *authResults // authentication results of the message, once computed.
+	seal   *arcSeal     // ARC set to add to the message when sent.
+
+	tooLarge bool // body exceeded the maximum message size, and was dropped.
 }
 
 // Reply creates a new message that replies to this message
@@ -37,17 +63,25 @@ func (msg *Message) Reply() *Message {
 	}
 }
 
-// ResendAs prepares a copy of the message being forwarded to a list
+// ResendAs prepares a copy of the message being forwarded to a list.
+// The returned message shares its body with msg.
 func (msg *Message) ResendAs(listID string, listAddress string) *Message {
 	send := &Message{
-		Subject:   msg.Subject,
-		From:      msg.From,
-		To:        msg.To,
-		Cc:        msg.Cc,
-		Date:      msg.Date,
-		ID:        msg.ID,
-		InReplyTo: msg.InReplyTo,
-		XList:     listID + " <" + listAddress + ">",
+		Subject:     msg.Subject,
+		From:        msg.From,
+		ReplyTo:     msg.ReplyTo,
+		To:          msg.To,
+		Cc:          msg.Cc,
+		Date:        msg.Date,
+		ID:          msg.ID,
+		InReplyTo:   msg.InReplyTo,
+		ContentType: msg.ContentType,
+		Encoding:    msg.Encoding,
+		XList:       listID + " <" + listAddress + ">",
+		Body:        msg.Body,
+		spool:       msg.spool,
+		arc:         msg.arcFields(),
+		XLoop:       listAddress,
 	}
 
 	// If the destination mailing list is in the Bcc field, keep it there
@@ -63,9 +97,127 @@ func (msg *Message) ResendAs(listID string, listAddress string) *Message {
 	return send
 }
 
+// resendTo prepares a copy of the message being forwarded to list, with its
+// subject tagged with the subject prefix of the list.
+func (msg *Message) resendTo(list *List) *Message {
+	send := msg.ResendAs(list.ID, list.Address)
+	send.Subject = prefixSubject(msg.Subject, list.SubjectPrefix)
+	return send
+}
+
+// Size returns the size of the message body, in bytes.
+func (msg *Message) Size() int64 {
+	if msg.spool != nil {
+		return msg.spool.Len()
+	}
+	return int64(len(msg.Body))
+}
+
+// bodyReaderAt returns a random access reader over the body of the message,
+// together with the size of the body.
+func (msg *Message) bodyReaderAt() (io.ReaderAt, int64) {
+	if msg.spool != nil {
+		return msg.spool.ReaderAt(), msg.spool.Len()
+	}
+	return strings.NewReader(msg.Body), int64(len(msg.Body))
+}
+
+// BodyReader returns a reader over the body of the message.
+func (msg *Message) BodyReader() io.Reader {
+	if msg.spool != nil {
+		return msg.spool.Reader()
+	}
+	return bytes.NewReader([]byte(msg.Body))
+}
+
+// Close releases the resources held by the message, such as a body spooled
+// to disk.
+func (msg *Message) Close() error {
+	if msg.spool == nil {
+		return nil
+	}
+	return msg.spool.Close()
+}
+
+// replyPrefixes are the (lowercased) reply markers collapsed by prefixSubject.
+var replyPrefixes = []string{"re:", "aw:", "sv:", "antw:"}
+
+// prefixSubject tags subject with prefix.
+// Any existing occurrence of the prefix and repeated reply markers at the
+// start of the subject are collapsed, so that "Re: [golang] Re: [golang] hi"
+// becomes "[golang] Re: hi".
+// RFC 2047 encoded subjects are decoded, tagged and encoded back.
+func prefixSubject(subject, prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return subject
+	}
+
+	dec := new(mime.WordDecoder)
+	txt, err := dec.DecodeHeader(subject)
+	if err != nil {
+		// unknown charset: only tag subjects that are not already tagged.
+		if hasPrefixFold(subject, prefix) {
+			return subject
+		}
+		return prefix + " " + subject
+	}
+
+	reply := false
+loop:
+	for {
+		txt = strings.TrimLeft(txt, " \t")
+		if hasPrefixFold(txt, prefix) {
+			txt = txt[len(prefix):]
+			continue
+		}
+		for _, re := range replyPrefixes {
+			if hasPrefixFold(txt, re) {
+				txt = txt[len(re):]
+				reply = true
+				continue loop
+			}
+		}
+		break
+	}
+
+	out := prefix + " "
+	if reply {
+		out += "Re: "
+	}
+	out += txt
+
+	if isASCII(out) {
+		return out
+	}
+	return mime.QEncoding.Encode("utf-8", out)
+}
+
+// hasPrefixFold reports whether s begins with prefix, under Unicode
+// case-folding. Only prefixes of the same length in bytes match, so that
+// s may be sliced past prefix.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
 func (msg *Message) MarshalText() ([]byte, error) {
 	buf := new(bytes.Buffer)
+	_, err := msg.WriteTo(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msg *Message) marshalHeader() []byte {
+	buf := new(bytes.Buffer)
+	for _, f := range msg.arc {
+		fmt.Fprintf(buf, "%s\r\n", f)
+	}
 	fmt.Fprintf(buf, "From: %s\r\n", msg.From)
+	if len(msg.ReplyTo) > 0 {
+		fmt.Fprintf(buf, "Reply-To: %s\r\n", msg.ReplyTo)
+	}
 	fmt.Fprintf(buf, "To: %s\r\n", msg.To)
 	fmt.Fprintf(buf, "Cc: %s\r\n", msg.Cc)
 	fmt.Fprintf(buf, "Bcc: %s\r\n", msg.Bcc)
@@ -73,7 +225,7 @@ func (msg *Message) MarshalText() ([]byte, error) {
 		fmt.Fprintf(buf, "Date: %s\r\n", msg.Date)
 	}
 	if len(msg.ID) > 0 {
-		fmt.Fprintf(buf, "Messsage-ID: %s\r\n", msg.ID)
+		fmt.Fprintf(buf, "Message-ID: %s\r\n", msg.ID)
 	}
 	fmt.Fprintf(buf, "In-Reply-To: %s\r\n", msg.InReplyTo)
 	if len(msg.XList) > 0 {
@@ -81,13 +233,22 @@ func (msg *Message) MarshalText() ([]byte, error) {
 		fmt.Fprintf(buf, "List-ID: %s\r\n", msg.XList)
 		fmt.Fprintf(buf, "Sender: %s\r\n", msg.XList)
 	}
+	if len(msg.XLoop) > 0 {
+		fmt.Fprintf(buf, "X-Loop: %s\r\n", msg.XLoop)
+	}
+	if len(msg.AutoSubmitted) > 0 {
+		fmt.Fprintf(buf, "Auto-Submitted: %s\r\n", msg.AutoSubmitted)
+	}
 	if len(msg.ContentType) > 0 {
+		fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
 		fmt.Fprintf(buf, "Content-Type: %s\r\n", msg.ContentType)
 	}
+	if len(msg.Encoding) > 0 {
+		fmt.Fprintf(buf, "Content-Transfer-Encoding: %s\r\n", msg.Encoding)
+	}
 	fmt.Fprintf(buf, "Subject: %s\r\n", msg.Subject)
-	fmt.Fprintf(buf, "\r\n%s", msg.Body)
-
-	return buf.Bytes(), nil
+	fmt.Fprintf(buf, "\r\n")
+	return buf.Bytes()
 }
 
 func (msg *Message) UnmarshalText(data []byte) error {
@@ -96,38 +257,136 @@ func (msg *Message) UnmarshalText(data []byte) error {
 }
 
 func (msg *Message) ReadFrom(r io.Reader) (int64, error) {
+	return msg.readFrom(r, 0)
+}
+
+// readFrom reads a message from r.
+// If max is strictly positive, ErrMessageTooLarge is returned as soon as the
+// body grows past max bytes. The headers of the message are still decoded.
+// Large bodies are spooled to disk.
+func (msg *Message) readFrom(r io.Reader, max int64) (int64, error) {
+	if max > 0 {
+		r = io.LimitReader(r, max+maxHeaderSize)
+	}
 	rr := creader{r: r}
-	rmsg, err := mail.ReadMessage(&rr)
+	br := bufio.NewReader(&rr)
+	hdr, err := readHeader(br)
 	if err != nil {
 		return rr.n, err
 	}
-
-	// FIXME(sbinet): use io.ReadFull(r, []byte(max)) ?
-	body, err := ioutil.ReadAll(rmsg.Body)
+	rmsg, err := mail.ReadMessage(io.MultiReader(bytes.NewReader(hdr), br))
 	if err != nil {
 		return rr.n, err
 	}
 
+	msg.header = hdr
 	msg.Subject = rmsg.Header.Get("Subject")
 	msg.From = rmsg.Header.Get("From")
+	msg.ReplyTo = rmsg.Header.Get("Reply-To")
 	msg.ID = rmsg.Header.Get("Message-ID")
 	msg.InReplyTo = rmsg.Header.Get("In-Reply-To")
-	msg.Body = string(body[:])
 	msg.To = rmsg.Header.Get("To")
 	msg.Cc = rmsg.Header.Get("Cc")
 	msg.Bcc = rmsg.Header.Get("Bcc")
 	msg.Date = rmsg.Header.Get("Date")
+	msg.ContentType = rmsg.Header.Get("Content-Type")
+	msg.Encoding = rmsg.Header.Get("Content-Transfer-Encoding")
+	msg.AutoSubmitted = rmsg.Header.Get("Auto-Submitted")
+	msg.XLoop = rmsg.Header.Get("X-Loop")
+
+	var (
+		body = new(spool)
+		src  = rmsg.Body
+	)
+	if max > 0 {
+		src = io.LimitReader(src, max+1)
+	}
+	_, err = io.Copy(body, src)
+	if err != nil {
+		body.Close()
+		return rr.n, err
+	}
+	if max > 0 && body.Len() > max {
+		body.Close()
+		return rr.n, ErrMessageTooLarge
+	}
+
+	msg.Body = ""
+	msg.spool = nil
+	switch {
+	case body.onDisk():
+		msg.spool = body
+	default:
+		msg.Body = body.String()
+	}
 
 	return rr.n, nil
 }
 
+// readHeader reads the header section of a message, up to and including the
+// empty line separating it from the body.
+func readHeader(r *bufio.Reader) ([]byte, error) {
+	var (
+		hdr     []byte
+		partial bool // whether the previous read stopped mid-line.
+	)
+	for {
+		line, err := r.ReadSlice('\n')
+		hdr = append(hdr, line...)
+		if len(hdr) > maxHeaderSize {
+			return nil, errors.New("strew: header section too large")
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			partial = true
+			continue
+		case err == io.EOF:
+			// message without a body.
+			if len(hdr) > 0 && hdr[len(hdr)-1] != '\n' {
+				hdr = append(hdr, "\r\n"...)
+			}
+			return append(hdr, "\r\n"...), nil
+		case err != nil:
+			return nil, err
+		}
+		if !partial && (string(line) == "\r\n" || string(line) == "\n") {
+			return hdr, nil
+		}
+		partial = false
+	}
+}
+
+// headerValues returns the values of the name header fields of msg,
+// as received.
+func (msg *Message) headerValues(name string) []string {
+	var vs []string
+	for _, f := range dkim.ParseHeader(msg.header) {
+		if strings.EqualFold(f.Name, name) {
+			vs = append(vs, f.Value())
+		}
+	}
+	return vs
+}
+
+// arcFields returns the ARC header fields of the message, as received.
+func (msg *Message) arcFields() []string {
+	var arc []string
+	for _, f := range dkim.ParseHeader(msg.header) {
+		switch strings.ToLower(f.Name) {
+		case "arc-seal", "arc-message-signature", "arc-authentication-results":
+			arc = append(arc, f.Raw)
+		}
+	}
+	return arc
+}
+
 func (msg *Message) WriteTo(w io.Writer) (int64, error) {
-	buf, err := msg.MarshalText()
+	n, err := w.Write(msg.marshalHeader())
 	if err != nil {
-		return 0, err
+		return int64(n), err
 	}
-	n, err := w.Write(buf)
-	return int64(n), err
+	nn, err := io.Copy(w, msg.BodyReader())
+	return int64(n) + nn, err
 }
 
 type creader struct {
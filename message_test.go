@@ -0,0 +1,93 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMessageSizeLimit(t *testing.T) {
+	const hdr = "From: alice@example.com\r\nTo: golang@example.com\r\nSubject: hello\r\n\r\n"
+
+	for _, tc := range []struct {
+		size    int
+		max     int64
+		tooBig  bool
+		spooled bool
+	}{
+		{size: 10, max: 0},
+		{size: 10, max: 10},
+		{size: 11, max: 10, tooBig: true},
+		{size: spoolThreshold + 1, max: 0, spooled: true},
+		{size: spoolThreshold + 1, max: spoolThreshold, tooBig: true},
+	} {
+		raw := hdr + strings.Repeat("x", tc.size)
+		var msg Message
+		_, err := msg.readFrom(strings.NewReader(raw), tc.max)
+		switch {
+		case tc.tooBig:
+			if err != ErrMessageTooLarge {
+				t.Fatalf("size=%d max=%d: got err=%v, want %v", tc.size, tc.max, err, ErrMessageTooLarge)
+			}
+			if msg.From != "alice@example.com" {
+				t.Fatalf("size=%d max=%d: headers not decoded: from=%q", tc.size, tc.max, msg.From)
+			}
+			continue
+		case err != nil:
+			t.Fatalf("size=%d max=%d: could not read message: %v", tc.size, tc.max, err)
+		}
+
+		if got, want := msg.Size(), int64(tc.size); got != want {
+			t.Fatalf("size=%d max=%d: invalid size: got=%d", tc.size, tc.max, got)
+		}
+		if got := msg.spool != nil; got != tc.spooled {
+			t.Fatalf("size=%d max=%d: invalid spool state: got=%v, want=%v", tc.size, tc.max, got, tc.spooled)
+		}
+		body, err := ioutil.ReadAll(msg.BodyReader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, []byte(strings.Repeat("x", tc.size))) {
+			t.Fatalf("size=%d max=%d: invalid body", tc.size, tc.max)
+		}
+		err = msg.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrefixSubject(t *testing.T) {
+	for _, tc := range []struct {
+		subject string
+		prefix  string
+		want    string
+	}{
+		{"hello", "", "hello"},
+		{"hello", "[golang]", "[golang] hello"},
+		{"[golang] hello", "[golang]", "[golang] hello"},
+		{"[GoLang] hello", "[golang]", "[golang] hello"},
+		{"Re: hello", "[golang]", "[golang] Re: hello"},
+		{"Re: [golang] hello", "[golang]", "[golang] Re: hello"},
+		{"Re: [golang] Re: [golang] hello", "[golang]", "[golang] Re: hello"},
+		{"RE: AW: [golang] hello", "[golang]", "[golang] Re: hello"},
+		{"Re: [golang]hello", "[golang]", "[golang] Re: hello"},
+		{"=?utf-8?q?Re=3A_=5Bgolang=5D_h=C3=A9llo?=", "[golang]", "=?utf-8?q?[golang]_Re:_h=C3=A9llo?="},
+		{"=?utf-8?q?Re=3A_=5Bgolang=5D_hello?=", "[golang]", "[golang] Re: hello"},
+		{"=?koi8-r?q?=F0=D2=C9=D7=C5=D4?=", "[golang]", "[golang] =?koi8-r?q?=F0=D2=C9=D7=C5=D4?="},
+		// the Kelvin sign lowercases to a shorter "k".
+		{"[k]", "[\u212a]", "=?utf-8?q?[=E2=84=AA]_[k]?="},
+		{"[\u212a] hello", "[k]", "=?utf-8?q?[k]_[=E2=84=AA]_hello?="},
+		{"[\u212a] hello", "[\u212a]", "=?utf-8?q?[=E2=84=AA]_hello?="},
+	} {
+		got := prefixSubject(tc.subject, tc.prefix)
+		if got != tc.want {
+			t.Errorf("prefixSubject(%q, %q):\ngot= %q\nwant=%q", tc.subject, tc.prefix, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/dmarc"
+)
+
+// DMARC mitigation modes of a list.
+const (
+	dmarcNone    = "none"    // leave posts untouched.
+	dmarcRewrite = "rewrite" // rewrite From to the list address.
+	dmarcWrap    = "wrap"    // wrap posts as message/rfc822 parts.
+)
+
+// checkDMARCMitigation reports whether the dmarc_mitigation mode of the list
+// is known.
+func (list *List) checkDMARCMitigation() error {
+	switch strings.ToLower(list.DMARCMitigation) {
+	case "", dmarcNone, dmarcRewrite, dmarcWrap:
+		return nil
+	}
+	return errors.Errorf("strew: invalid dmarc_mitigation %q for list %q", list.DMARCMitigation, list.ID)
+}
+
+// mitigateDMARC prepares a post forwarded to list so that it is not rejected
+// by receivers enforcing the DMARC policy of the author's domain.
+// Posts from domains publishing neither a quarantine nor a reject policy
+// are returned untouched.
+func (srv *Server) mitigateDMARC(ctx context.Context, msg *Message, list *List) (*Message, error) {
+	mode := strings.ToLower(list.DMARCMitigation)
+	switch mode {
+	case "", dmarcNone:
+		return msg, nil
+	case dmarcRewrite, dmarcWrap:
+	default:
+		return nil, list.checkDMARCMitigation()
+	}
+
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return msg, nil
+	}
+
+	if !srv.dmarcStrict(ctx, domainOf(from.Address)) {
+		return msg, nil
+	}
+
+	switch mode {
+	case dmarcRewrite:
+		return rewriteFrom(msg, from, list), nil
+	default:
+		return wrapMessage(msg, from, list)
+	}
+}
+
+// dmarcStrict reports whether domain asks receivers to quarantine or reject
+// unauthenticated mail.
+// Lookup failures are considered strict, so that delivery is not put at risk.
+func (srv *Server) dmarcStrict(ctx context.Context, domain string) bool {
+	rec, err := dmarc.Lookup(ctx, srv.resolver(), domain)
+	switch err {
+	case nil:
+		return rec.Policy == dmarc.Quarantine || rec.Policy == dmarc.Reject
+	case dmarc.ErrNoPolicy:
+		return false
+	default:
+		log.Printf("server: could not look up DMARC policy of %q: %v", domain, err)
+		return true
+	}
+}
+
+// rewriteFrom returns a copy of msg sent from the list address on behalf of
+// its author, who replaces the Reply-To of msg.
+func rewriteFrom(msg *Message, from *mail.Address, list *List) *Message {
+	out := *msg
+	out.From = viaAddress(from, list)
+	out.ReplyTo = from.String()
+	return &out
+}
+
+// wrapMessage returns a new message, sent from the list address on behalf of
+// the author of msg, holding msg as the message/rfc822 part of a
+// multipart/mixed body, to which the list footer can be added.
+func wrapMessage(msg *Message, from *mail.Address, list *List) (*Message, error) {
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+	body := new(spool)
+	_, err := io.WriteString(body, "--"+boundary+"\r\n"+
+		"Content-Type: message/rfc822\r\n"+
+		"Content-Disposition: inline\r\n"+
+		"\r\n")
+	if err == nil {
+		_, err = msg.WriteTo(body)
+	}
+	if err == nil {
+		_, err = io.WriteString(body, "\r\n--"+boundary+"--\r\n")
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	ctype := mime.FormatMediaType("multipart/mixed", map[string]string{
+		"boundary": boundary,
+	})
+	out := &Message{
+		Subject:     msg.Subject,
+		From:        viaAddress(from, list),
+		ReplyTo:     from.String(),
+		To:          msg.To,
+		Cc:          msg.Cc,
+		Bcc:         msg.Bcc,
+		Date:        msg.Date,
+		ID:          msg.ID,
+		InReplyTo:   msg.InReplyTo,
+		XList:       msg.XList,
+		XLoop:       msg.XLoop,
+		ContentType: ctype,
+	}
+	switch enc := strings.ToLower(msg.Encoding); enc {
+	case "8bit", "binary":
+		out.Encoding = enc
+	}
+	return out.withBody(body), nil
+}
+
+// viaAddress returns the list address, displayed as "Name via List".
+func viaAddress(from *mail.Address, list *List) string {
+	name := from.Name
+	if name == "" {
+		name = from.Address
+	}
+	via := list.Name
+	if via == "" {
+		via = list.ID
+	}
+	addr := mail.Address{
+		Name:    name + " via " + via,
+		Address: list.Address,
+	}
+	return addr.String()
+}
+
+// domainOf returns the domain part of an email address.
+func domainOf(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(addr[i+1:])
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// fakeDNS is an offline Resolver.
+type fakeDNS struct {
+	txt map[string][]string
+	ips map[string][]net.IPAddr
+	mxs map[string][]*net.MX
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (dns fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, ok := dns.txt[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return v, nil
+}
+
+func (dns fakeDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	v, ok := dns.ips[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	return v, nil
+}
+
+func (dns fakeDNS) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, ok := dns.mxs[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return v, nil
+}
+
+func TestMitigateDMARC(t *testing.T) {
+	srv := &Server{cfg: Config{
+		Resolver: fakeDNS{txt: map[string][]string{
+			"_dmarc.strict.com": {"v=DMARC1; p=reject"},
+			"_dmarc.lax.com":    {"v=DMARC1; p=none"},
+		}},
+	}}
+
+	list := &List{
+		ID:      "golang",
+		Name:    "Go programming",
+		Address: "golang@example.com",
+	}
+
+	for _, tc := range []struct {
+		mode    string
+		from    string
+		orig    string // Reply-To of the post.
+		want    string
+		replyTo string
+		ctype   string
+	}{
+		{mode: "none", from: "Alice <alice@strict.com>", want: "Alice <alice@strict.com>"},
+		{mode: "rewrite", from: "Alice <alice@lax.com>", want: "Alice <alice@lax.com>"},
+		{mode: "rewrite", from: "Alice <alice@nodmarc.com>", want: "Alice <alice@nodmarc.com>"},
+		{
+			mode:    "rewrite",
+			from:    "Alice <alice@strict.com>",
+			want:    `"Alice via Go programming" <golang@example.com>`,
+			replyTo: `"Alice" <alice@strict.com>`,
+		},
+		{
+			mode:    "rewrite",
+			from:    "carol@strict.com",
+			orig:    "team@example.org",
+			want:    `"carol@strict.com via Go programming" <golang@example.com>`,
+			replyTo: `<carol@strict.com>`,
+		},
+		{
+			mode:    "wrap",
+			from:    "bob@strict.com",
+			want:    `"bob@strict.com via Go programming" <golang@example.com>`,
+			replyTo: `<bob@strict.com>`,
+			ctype:   "multipart/mixed",
+		},
+	} {
+		t.Run(tc.mode+":"+tc.from, func(t *testing.T) {
+			list.DMARCMitigation = tc.mode
+			msg := &Message{From: tc.from, ReplyTo: tc.orig, Subject: "hello", Body: "hello\r\n"}
+			out, err := srv.mitigateDMARC(context.Background(), msg.resendTo(list), list)
+			if err != nil {
+				t.Fatalf("could not mitigate: %v", err)
+			}
+			defer out.Close()
+
+			if got, want := out.From, tc.want; got != want {
+				t.Fatalf("invalid From:\ngot= %q\nwant=%q", got, want)
+			}
+			if got, want := out.ReplyTo, tc.replyTo; got != want {
+				t.Fatalf("invalid Reply-To:\ngot= %q\nwant=%q", got, want)
+			}
+			media, params, _ := mime.ParseMediaType(out.ContentType)
+			if got, want := media, tc.ctype; got != want {
+				t.Fatalf("invalid Content-Type:\ngot= %q\nwant=%q", got, want)
+			}
+			if tc.ctype == "" {
+				return
+			}
+			mr := multipart.NewReader(strings.NewReader(out.Body), params["boundary"])
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("could not read part: %v", err)
+			}
+			if got, want := part.Header.Get("Content-Type"), "message/rfc822"; got != want {
+				t.Fatalf("invalid part Content-Type:\ngot= %q\nwant=%q", got, want)
+			}
+			orig, err := mail.ReadMessage(part)
+			if err != nil {
+				t.Fatalf("could not read original message: %v", err)
+			}
+			if got, want := orig.Header.Get("From"), tc.from; got != want {
+				t.Fatalf("invalid original From:\ngot= %q\nwant=%q", got, want)
+			}
+			if _, err := mr.NextPart(); err != io.EOF {
+				t.Fatalf("unexpected part: %v", err)
+			}
+
+			// the list footer is added as a part of its own.
+			dec, err := decorate(out, "", "footer of the list")
+			if err != nil {
+				t.Fatalf("could not decorate: %v", err)
+			}
+			if dec.ContentType != out.ContentType || !strings.Contains(dec.Body, "footer of the list") {
+				t.Fatalf("footer not added:\n%s", dec.Body)
+			}
+		})
+	}
+}
+
+func TestCheckDMARCMitigation(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		ok   bool
+	}{
+		{"", true},
+		{"none", true},
+		{"Rewrite", true},
+		{"wrap", true},
+		{"rewrap", false},
+	} {
+		list := &List{ID: "golang", DMARCMitigation: tc.mode}
+		err := list.checkDMARCMitigation()
+		if got := err == nil; got != tc.ok {
+			t.Fatalf("mode %q: got err=%v, want ok=%v", tc.mode, err, tc.ok)
+		}
+	}
+}
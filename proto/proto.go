@@ -0,0 +1,288 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package proto defines the wire protocol spoken on the strew command socket.
+//
+// A client submits messages as Request frames:
+//
+//	[1 byte version][8 bytes request ID][8 bytes body size][body]
+//
+// and, for every request, the server answers with a Response frame:
+//
+//	[1 byte version][8 bytes request ID][1 byte status][4 bytes reason size][reason]
+//
+// All integers are big-endian.
+//
+// When the server requires a shared secret, the first frame sent by the client
+// must be an Auth frame:
+//
+//	['A'][1 byte version][2 bytes token size][token]
+//
+// which the server acknowledges with a Response of ID 0.
+//
+// Frames starting with a zero byte are interpreted as legacy frames: an
+// 8-byte body size followed by the body.
+// Legacy requests are fire-and-forget and never receive a Response.
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the current version of the protocol.
+const Version = 1
+
+// AuthMagic is the first byte of an Auth frame.
+const AuthMagic = 'A'
+
+// MaxRequestSize is the largest request body Request.ReadFrom loads in
+// memory.
+const MaxRequestSize = 64 << 20
+
+// maxReasonSize is the largest reason accepted in a Response frame.
+const maxReasonSize = 64 << 10
+
+var (
+	ErrVersion  = errors.New("strew/proto: unsupported protocol version")
+	ErrNoAuth   = errors.New("strew/proto: expected an authentication frame")
+	ErrTooLarge = errors.New("strew/proto: frame too large")
+)
+
+// Status describes how the server handled a submitted message.
+type Status uint8
+
+const (
+	// Accepted means the message was parsed and routed: it was delivered,
+	// held for moderation, or silently dropped by the server. Submitting it
+	// again will not help.
+	Accepted Status = iota + 1
+	// Rejected means the message was refused. Submitting it again will
+	// not help.
+	Rejected
+	// TempFailure means the message could not be handled because of a
+	// transient error. It may be submitted again later.
+	TempFailure
+)
+
+func (st Status) String() string {
+	switch st {
+	case Accepted:
+		return "accepted"
+	case Rejected:
+		return "rejected"
+	case TempFailure:
+		return "temporary failure"
+	}
+	return fmt.Sprintf("Status(%d)", uint8(st))
+}
+
+// Request is a message submitted to the server.
+type Request struct {
+	Version uint8  // protocol version. Zero for legacy requests.
+	ID      uint64 // request ID, echoed back in the Response.
+	Body    []byte // RFC 5322 message.
+}
+
+// Header is the fixed-size header of a Request frame.
+// It allows servers to check the announced body size before reading it.
+type Header struct {
+	Version uint8  // protocol version. Zero for legacy requests.
+	ID      uint64 // request ID, echoed back in the Response.
+	Size    uint64 // size of the request body, in bytes.
+}
+
+// ReadFrom reads a request frame header from r.
+func (hdr *Header) ReadFrom(r io.Reader) (int64, error) {
+	rr := creader{r: r}
+	var buf [17]byte
+	_, err := io.ReadFull(&rr, buf[:1])
+	if err != nil {
+		return rr.n, err
+	}
+
+	switch buf[0] {
+	case 0:
+		_, err = io.ReadFull(&rr, buf[1:8])
+		if err != nil {
+			return rr.n, errors.WithStack(err)
+		}
+		hdr.Version = 0
+		hdr.ID = 0
+		hdr.Size = binary.BigEndian.Uint64(buf[:8])
+	case Version:
+		_, err = io.ReadFull(&rr, buf[1:])
+		if err != nil {
+			return rr.n, errors.WithStack(err)
+		}
+		hdr.Version = buf[0]
+		hdr.ID = binary.BigEndian.Uint64(buf[1:9])
+		hdr.Size = binary.BigEndian.Uint64(buf[9:17])
+	default:
+		return rr.n, errors.Wrapf(ErrVersion, "version=%d", buf[0])
+	}
+	return rr.n, nil
+}
+
+// WriteTo writes a request frame header to w.
+func (hdr *Header) WriteTo(w io.Writer) (int64, error) {
+	var (
+		out []byte
+		buf [17]byte
+	)
+	switch hdr.Version {
+	case 0:
+		binary.BigEndian.PutUint64(buf[:8], hdr.Size)
+		out = buf[:8]
+	case Version:
+		buf[0] = hdr.Version
+		binary.BigEndian.PutUint64(buf[1:9], hdr.ID)
+		binary.BigEndian.PutUint64(buf[9:17], hdr.Size)
+		out = buf[:]
+	default:
+		return 0, errors.Wrapf(ErrVersion, "version=%d", hdr.Version)
+	}
+	n, err := w.Write(out)
+	return int64(n), err
+}
+
+// ReadFrom reads a request frame from r.
+// The whole body is loaded in memory: servers should rather read the Header
+// and stream the body. Bodies larger than MaxRequestSize are refused with
+// ErrTooLarge.
+func (req *Request) ReadFrom(r io.Reader) (int64, error) {
+	var hdr Header
+	n, err := hdr.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+	if hdr.Size > MaxRequestSize {
+		return n, errors.Wrapf(ErrTooLarge, "size=%d", hdr.Size)
+	}
+	req.Version = hdr.Version
+	req.ID = hdr.ID
+	req.Body = make([]byte, hdr.Size)
+	nn, err := io.ReadFull(r, req.Body)
+	n += int64(nn)
+	if err != nil {
+		return n, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// WriteTo writes a request frame to w.
+func (req *Request) WriteTo(w io.Writer) (int64, error) {
+	hdr := Header{
+		Version: req.Version,
+		ID:      req.ID,
+		Size:    uint64(len(req.Body)),
+	}
+	n, err := hdr.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	nn, err := w.Write(req.Body)
+	return n + int64(nn), err
+}
+
+// Auth is the handshake frame used to present a shared secret to the server.
+type Auth struct {
+	Token string
+}
+
+// ReadFrom reads an authentication frame from r.
+func (auth *Auth) ReadFrom(r io.Reader) (int64, error) {
+	rr := creader{r: r}
+	var hdr [4]byte
+	_, err := io.ReadFull(&rr, hdr[:])
+	if err != nil {
+		return rr.n, err
+	}
+	if hdr[0] != AuthMagic {
+		return rr.n, ErrNoAuth
+	}
+	if hdr[1] != Version {
+		return rr.n, errors.Wrapf(ErrVersion, "version=%d", hdr[1])
+	}
+	tok := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+	_, err = io.ReadFull(&rr, tok)
+	if err != nil {
+		return rr.n, errors.WithStack(err)
+	}
+	auth.Token = string(tok)
+	return rr.n, nil
+}
+
+// WriteTo writes an authentication frame to w.
+func (auth *Auth) WriteTo(w io.Writer) (int64, error) {
+	if len(auth.Token) > 0xffff {
+		return 0, errors.New("strew/proto: authentication token too long")
+	}
+	buf := make([]byte, 4+len(auth.Token))
+	buf[0] = AuthMagic
+	buf[1] = Version
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(auth.Token)))
+	copy(buf[4:], auth.Token)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// Response is the server's answer to a Request.
+type Response struct {
+	ID     uint64 // ID of the request this response answers.
+	Status Status
+	Reason string // human readable explanation of the status.
+}
+
+// ReadFrom reads a response frame from r.
+func (resp *Response) ReadFrom(r io.Reader) (int64, error) {
+	rr := creader{r: r}
+	var hdr [14]byte
+	_, err := io.ReadFull(&rr, hdr[:])
+	if err != nil {
+		return rr.n, err
+	}
+	if hdr[0] != Version {
+		return rr.n, errors.Wrapf(ErrVersion, "version=%d", hdr[0])
+	}
+	resp.ID = binary.BigEndian.Uint64(hdr[1:9])
+	resp.Status = Status(hdr[9])
+	size := binary.BigEndian.Uint32(hdr[10:14])
+	if size > maxReasonSize {
+		return rr.n, errors.Wrapf(ErrTooLarge, "reason size=%d", size)
+	}
+	reason := make([]byte, size)
+	_, err = io.ReadFull(&rr, reason)
+	if err != nil {
+		return rr.n, errors.WithStack(err)
+	}
+	resp.Reason = string(reason)
+	return rr.n, nil
+}
+
+// WriteTo writes a response frame to w.
+func (resp *Response) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 14+len(resp.Reason))
+	buf[0] = Version
+	binary.BigEndian.PutUint64(buf[1:9], resp.ID)
+	buf[9] = byte(resp.Status)
+	binary.BigEndian.PutUint32(buf[10:14], uint32(len(resp.Reason)))
+	copy(buf[14:], resp.Reason)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+type creader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *creader) Read(data []byte) (int, error) {
+	n, err := r.r.Read(data)
+	r.n += int64(n)
+	return n, err
+}
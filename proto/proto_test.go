@@ -0,0 +1,113 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRequestRW(t *testing.T) {
+	for _, want := range []Request{
+		{Version: 0, Body: []byte("Subject: legacy\r\n\r\nhello\r\n")},
+		{Version: Version, ID: 42, Body: []byte("Subject: v1\r\n\r\nhello\r\n")},
+		{Version: Version, ID: 43, Body: []byte{}},
+	} {
+		buf := new(bytes.Buffer)
+		_, err := want.WriteTo(buf)
+		if err != nil {
+			t.Fatalf("could not write request: %v", err)
+		}
+
+		var got Request
+		_, err = got.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("could not read request: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("round-trip failed:\ngot= %#v\nwant=%#v", got, want)
+		}
+	}
+}
+
+func TestResponseRW(t *testing.T) {
+	for _, want := range []Response{
+		{ID: 1, Status: Accepted},
+		{ID: 2, Status: Rejected, Reason: "sender is not authorized to post"},
+		{ID: 3, Status: TempFailure, Reason: "smtp: connection refused"},
+	} {
+		buf := new(bytes.Buffer)
+		_, err := want.WriteTo(buf)
+		if err != nil {
+			t.Fatalf("could not write response: %v", err)
+		}
+
+		var got Response
+		_, err = got.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		if got != want {
+			t.Fatalf("round-trip failed:\ngot= %#v\nwant=%#v", got, want)
+		}
+	}
+}
+
+func TestAuthRW(t *testing.T) {
+	want := Auth{Token: "s3cr3t"}
+	buf := new(bytes.Buffer)
+	_, err := want.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("could not write auth: %v", err)
+	}
+
+	var got Auth
+	_, err = got.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("could not read auth: %v", err)
+	}
+	if got != want {
+		t.Fatalf("round-trip failed:\ngot= %#v\nwant=%#v", got, want)
+	}
+
+	_, err = got.ReadFrom(bytes.NewReader([]byte{1, 0, 0, 0}))
+	if err != ErrNoAuth {
+		t.Fatalf("invalid error: got=%v, want=%v", err, ErrNoAuth)
+	}
+}
+
+func TestInvalidVersion(t *testing.T) {
+	var req Request
+	_, err := req.ReadFrom(bytes.NewReader([]byte{0xff, 0, 0, 0}))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	buf := new(bytes.Buffer)
+	hdr := Header{Version: Version, ID: 1, Size: 1 << 62}
+	_, err := hdr.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req Request
+	_, err = req.ReadFrom(buf)
+	if errors.Cause(err) != ErrTooLarge {
+		t.Fatalf("invalid error: got=%v, want=%v", err, ErrTooLarge)
+	}
+
+	buf.Reset()
+	buf.Write([]byte{Version, 0, 0, 0, 0, 0, 0, 0, 1, byte(Accepted), 0xff, 0xff, 0xff, 0xff})
+	var resp Response
+	_, err = resp.ReadFrom(buf)
+	if errors.Cause(err) != ErrTooLarge {
+		t.Fatalf("invalid error: got=%v, want=%v", err, ErrTooLarge)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/database"
+)
+
+// rate is a rate limit of n events per period.
+type rate struct {
+	n   int
+	per time.Duration
+}
+
+// parseRate parses a rate limit such as "10/h" or "100/24h".
+// An empty rate is unlimited.
+func parseRate(v string) (rate, error) {
+	var r rate
+	if v == "" {
+		return r, nil
+	}
+	i := strings.Index(v, "/")
+	if i < 0 {
+		return r, fmt.Errorf("strew: invalid rate %q", v)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v[:i]))
+	if err != nil || n <= 0 {
+		return r, fmt.Errorf("strew: invalid rate %q", v)
+	}
+	per := strings.TrimSpace(v[i+1:])
+	if per != "" && strings.IndexAny(per[:1], "0123456789") < 0 {
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return r, fmt.Errorf("strew: invalid rate %q", v)
+	}
+	return rate{n: n, per: d}, nil
+}
+
+// limiter enforces a rate limit per key, with token buckets.
+type limiter struct {
+	rate    rate
+	buckets map[string]*bucket
+	gc      time.Time // last collection of idle buckets.
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(r rate) *limiter {
+	return &limiter{rate: r, buckets: make(map[string]*bucket)}
+}
+
+// allow consumes a token of the bucket of key, and reports whether one was
+// available.
+func (l *limiter) allow(key string, now time.Time) bool {
+	if l.rate.n == 0 {
+		return true
+	}
+	l.collect(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.n), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(l.rate.n) * float64(now.Sub(b.last)) / float64(l.rate.per)
+	if b.tokens > float64(l.rate.n) {
+		b.tokens = float64(l.rate.n)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// collect forgets the buckets refilled since their last use.
+func (l *limiter) collect(now time.Time) {
+	if now.Sub(l.gc) < l.rate.per {
+		return
+	}
+	l.gc = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= l.rate.per {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// guard rate limits commands and posts by sender address and by source IP,
+// and temporarily blocks the keys exceeding their limits too often.
+type guard struct {
+	mu       sync.Mutex
+	commands *limiter
+	posts    *limiter
+	after    int           // number of exceeded limits before a block.
+	duration time.Duration // duration of blocks, and of strikes.
+	strikes  map[string]*strike
+	blocked  map[string]time.Time
+	store    database.BlockList // persistent block list, if any.
+	now      func() time.Time
+	gc       time.Time // last collection of expired strikes.
+}
+
+// strike counts the limits exceeded by a key.
+// Strikes are forgotten once the key has not exceeded its limit for the
+// duration of a block.
+type strike struct {
+	n    int
+	last time.Time
+}
+
+// newGuard returns the guard configured by cfg, or nil if no rate limit is
+// configured.
+func newGuard(ctx context.Context, cfg Config, db database.Store) (*guard, error) {
+	commands, err := parseRate(cfg.CommandRate)
+	if err != nil {
+		return nil, err
+	}
+	posts, err := parseRate(cfg.PostRate)
+	if err != nil {
+		return nil, err
+	}
+	if commands.n == 0 && posts.n == 0 {
+		return nil, nil
+	}
+
+	g := &guard{
+		commands: newLimiter(commands),
+		posts:    newLimiter(posts),
+		after:    cfg.BlockAfter,
+		duration: cfg.BlockDuration,
+		strikes:  make(map[string]*strike),
+		blocked:  make(map[string]time.Time),
+		now:      time.Now,
+	}
+	if g.duration <= 0 {
+		g.duration = 24 * time.Hour
+	}
+
+	if cfg.PersistBlocks {
+		store, ok := db.(database.BlockList)
+		if !ok {
+			return nil, fmt.Errorf("strew: driver %q can not persist blocks", cfg.Driver)
+		}
+		blocked, err := store.Blocked(ctx)
+		if err != nil {
+			return nil, errors.WithMessage(err, "strew: could not load block list")
+		}
+		g.store = store
+		g.blocked = blocked
+	}
+	return g, nil
+}
+
+// allow reports whether a command (or a post) from the keys is allowed.
+func (g *guard) allow(ctx context.Context, command bool, keys ...string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	lim := g.posts
+	if command {
+		lim = g.commands
+	}
+
+	g.collect(now)
+
+	ok := true
+	for _, key := range keys {
+		if g.isBlocked(ctx, key, now) {
+			ok = false
+			continue
+		}
+		if lim.allow(key, now) {
+			continue
+		}
+		ok = false
+		s := g.strikes[key]
+		if s == nil || now.Sub(s.last) >= g.duration {
+			s = &strike{}
+			g.strikes[key] = s
+		}
+		s.n++
+		s.last = now
+		if g.after > 0 && s.n >= g.after {
+			g.block(ctx, key, now.Add(g.duration))
+		}
+	}
+	return ok
+}
+
+// collect forgets the expired strikes.
+func (g *guard) collect(now time.Time) {
+	if now.Sub(g.gc) < g.duration {
+		return
+	}
+	g.gc = now
+	for k, s := range g.strikes {
+		if now.Sub(s.last) >= g.duration {
+			delete(g.strikes, k)
+		}
+	}
+}
+
+// isBlocked reports whether key is blocked, and lifts expired blocks.
+func (g *guard) isBlocked(ctx context.Context, key string, now time.Time) bool {
+	until, ok := g.blocked[key]
+	if !ok {
+		return false
+	}
+	if now.Before(until) {
+		return true
+	}
+	delete(g.blocked, key)
+	delete(g.strikes, key)
+	if g.store != nil {
+		err := g.store.Unblock(ctx, key)
+		if err != nil {
+			log.Printf("server: could not unblock %q: %v", key, err)
+		}
+	}
+	return false
+}
+
+func (g *guard) block(ctx context.Context, key string, until time.Time) {
+	log.Printf("server: blocking %q until %v", key, until.Format(time.RFC3339))
+	g.blocked[key] = until
+	if g.store != nil {
+		err := g.store.Block(ctx, key, until)
+		if err != nil {
+			log.Printf("server: could not persist block of %q: %v", key, err)
+		}
+	}
+}
+
+// allow reports whether msg is within the rate limits of its sender and of
+// its source: the client IP recorded by a trusted relay.
+// The relays themselves are never rate limited, as they carry the traffic of
+// all senders.
+func (srv *Server) allow(ctx context.Context, msg *Message, command bool) bool {
+	if srv.guard == nil {
+		return true
+	}
+	var keys []string
+	if from, err := srv.normalize(msg.From); err == nil {
+		keys = append(keys, "from:"+from)
+	}
+	if ip, _ := srv.envelope(msg); ip != nil {
+		keys = append(keys, "ip:"+ip.String())
+	}
+	return srv.guard.allow(ctx, command, keys...)
+}
+
+func (srv *Server) handleThrottled(msg *Message) error {
+	log.Printf("server: rate limit exceeded by %q (message %s)", msg.From, msg.ID)
+	if srv.cfg.SilentDrop {
+		return nil
+	}
+	return rejection{"rate limit exceeded"}
+}
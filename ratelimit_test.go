@@ -0,0 +1,129 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want rate
+		err  bool
+	}{
+		{v: "", want: rate{}},
+		{v: "10/h", want: rate{10, time.Hour}},
+		{v: "100/24h", want: rate{100, 24 * time.Hour}},
+		{v: "5 / 30m", want: rate{5, 30 * time.Minute}},
+		{v: "10", err: true},
+		{v: "0/h", err: true},
+		{v: "10/fortnight", err: true},
+	} {
+		got, err := parseRate(tc.v)
+		if (err != nil) != tc.err {
+			t.Fatalf("%q: invalid error: %v", tc.v, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: got=%+v, want=%+v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	g, err := newGuard(ctx, Config{
+		CommandRate:   "2/h",
+		BlockAfter:    2,
+		BlockDuration: 3 * time.Hour,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if got := g.allow(ctx, true, "from:a@example.com"); got != want {
+			t.Fatalf("command #%d: got=%v, want=%v", i, got, want)
+		}
+	}
+	if !g.allow(ctx, true, "from:b@example.com") {
+		t.Fatalf("rate limits must be per key")
+	}
+	if !g.allow(ctx, false, "from:a@example.com") {
+		t.Fatalf("posts must not be rate limited")
+	}
+
+	// the bucket refills over time.
+	now = now.Add(30 * time.Minute)
+	if !g.allow(ctx, true, "from:a@example.com") {
+		t.Fatalf("command should be allowed after refill")
+	}
+
+	// second strike: blocked, even once refilled.
+	if g.allow(ctx, true, "from:a@example.com") {
+		t.Fatalf("command should be refused")
+	}
+	now = now.Add(2 * time.Hour)
+	if g.allow(ctx, true, "from:a@example.com") {
+		t.Fatalf("blocked sender should be refused")
+	}
+	now = now.Add(2 * time.Hour)
+	if !g.allow(ctx, true, "from:a@example.com") {
+		t.Fatalf("block should have expired")
+	}
+
+	// strikes are forgotten after the block duration.
+	if !g.allow(ctx, true, "from:c@example.com") || !g.allow(ctx, true, "from:c@example.com") {
+		t.Fatalf("commands should be allowed")
+	}
+	if g.allow(ctx, true, "from:c@example.com") {
+		t.Fatalf("command should be refused")
+	}
+	now = now.Add(4 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if !g.allow(ctx, true, "from:c@example.com") {
+			t.Fatalf("command #%d should be allowed after refill", i)
+		}
+	}
+	if g.allow(ctx, true, "from:c@example.com") {
+		t.Fatalf("command should be refused")
+	}
+	if _, blocked := g.blocked["from:c@example.com"]; blocked {
+		t.Fatalf("expired strike should not count towards a block")
+	}
+
+	g, err = newGuard(ctx, Config{}, nil)
+	if err != nil || g != nil {
+		t.Fatalf("expected no guard without rate limits: %v, %v", g, err)
+	}
+}
+
+func TestRateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "strew-rate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "strew.ini")
+	err = ioutil.WriteFile(fname, []byte("command_rate = 10/h\nblock_after = 3\nblock_duration = 12h\nsilent_drop = true\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := newConfig(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CommandRate != "10/h" || cfg.BlockAfter != 3 || cfg.BlockDuration != 12*time.Hour || !cfg.SilentDrop {
+		t.Fatalf("invalid config: %+v", cfg)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver performs the DNS lookups needed to handle sender authentication
+// policies.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// resolver returns the DNS resolver configured for the server.
+func (srv *Server) resolver() Resolver {
+	if srv.cfg.Resolver != nil {
+		return srv.cfg.Resolver
+	}
+	return net.DefaultResolver
+}
@@ -8,17 +8,23 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/mail"
 	"net/smtp"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sbinet-alt63/strew/database"
+	"github.com/sbinet-alt63/strew/dkim"
+	"github.com/sbinet-alt63/strew/proto"
+	"golang.org/x/crypto/openpgp"
 	ini "gopkg.in/ini.v1"
 )
 
@@ -28,8 +34,30 @@ type Server struct {
 	db  database.Store
 	sck net.Listener
 	msg chan *Message
+	sub chan submission
+
+	signers  map[string]*dkim.Signer    // DKIM signers, by list ID.
+	keyrings map[string]*keyring        // signature keyrings, by list ID.
+	listKeys map[string]*openpgp.Entity // secret keys of encrypted lists, by list ID.
+	filters  []Filter                   // filters run on posts.
+	guard    *guard                     // rate limits, nil if unlimited.
+}
+
+// submission is a message received on the command socket, waiting for
+// its processing status.
+type submission struct {
+	msg  *Message
+	resp chan proto.Response
+}
+
+// rejection is returned by handlers that refused a message.
+// The sender has already been notified.
+type rejection struct {
+	reason string
 }
 
+func (r rejection) Error() string { return "strew: message rejected: " + r.reason }
+
 func NewServerFrom(fname string) (*Server, error) {
 	cfg, err := newConfig(fname)
 	if err != nil {
@@ -38,16 +66,32 @@ func NewServerFrom(fname string) (*Server, error) {
 	return NewServer(cfg)
 }
 
+// defaultMaxMessageSize is the maximum size of message bodies, when
+// max_message_size is not set.
+const defaultMaxMessageSize = 10 << 20
+
 func NewServer(cfg Config) (*Server, error) {
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = defaultMaxMessageSize
+	}
 	db, err := database.Open(cfg.Driver, cfg.Database)
 	if err != nil {
 		return nil, err
 	}
 	for _, list := range cfg.Lists {
-		err := db.AddList(list.ID)
+		err = list.parseTemplates()
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, err
 		}
+		err = list.checkDMARCMitigation()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx := context.Background()
+	err = reconcileLists(ctx, db, cfg.Lists)
+	if err != nil {
+		return nil, errors.WithMessage(err, "strew: could not reconcile lists")
 	}
 
 	client, err := smtp.Dial(cfg.SMTPHostname + ":" + cfg.SMTPPort)
@@ -73,9 +117,44 @@ func NewServer(cfg Config) (*Server, error) {
 		return nil, err
 	}
 
-	srv := &Server{cfg: cfg, db: db, msg: make(chan *Message)}
+	signers, err := newSigners(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	keyrings, err := newKeyrings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	listKeys, err := newListKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := newFilters(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	guard, err := newGuard(ctx, cfg, db)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		cfg:      cfg,
+		db:       db,
+		msg:      make(chan *Message),
+		sub:      make(chan submission),
+		signers:  signers,
+		keyrings: keyrings,
+		listKeys: listKeys,
+		filters:  filters,
+		guard:    guard,
+	}
 	if cfg.ListenAddress != "" {
-		sck, err := net.Listen("tcp", cfg.ListenAddress)
+		sck, err := newListener(cfg)
 		if err != nil {
 			return nil, fmt.Errorf("strew: could not listen on command socket %q: %v", cfg.ListenAddress, err)
 		}
@@ -98,28 +177,76 @@ func (srv *Server) Serve(ctx context.Context) error {
 	for {
 		select {
 		case msg := <-srv.msg:
-			var err error
-			switch {
-			case srv.isCommand(msg):
-				err = srv.handleCommand(ctx, msg)
-			default:
-				err = srv.handleMessage(ctx, msg)
-			}
-			if err != nil {
-				// FIXME(sbinet): better handling
-				log.Print(err)
-			}
+			srv.process(ctx, msg)
+		case sub := <-srv.sub:
+			sub.resp <- srv.process(ctx, sub.msg)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
+}
+
+// Close closes the database of the server, flushing drivers such as
+// memory snapshots.
+func (srv *Server) Close() error {
+	if db, ok := srv.db.(io.Closer); ok {
+		return db.Close()
+	}
 	return nil
 }
 
+// Backup writes a copy of the database to w, while the server runs.
+func (srv *Server) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	db, ok := srv.db.(database.Backuper)
+	if !ok {
+		return 0, fmt.Errorf("strew: driver %q does not support backups", srv.cfg.Driver)
+	}
+	return db.Backup(ctx, w)
+}
+
+// process handles a command or a list post and reports how it went.
+// The message is closed once processed.
+func (srv *Server) process(ctx context.Context, msg *Message) proto.Response {
+	defer msg.Close()
+
+	var (
+		err     error
+		command = srv.isCommand(msg)
+	)
+	switch {
+	case !srv.allow(ctx, msg, command):
+		err = srv.handleThrottled(msg)
+	case msg.tooLarge:
+		err = srv.handleTooLarge(ctx, msg, srv.cfg.MaxMessageSize)
+		if err == nil {
+			err = rejection{fmt.Sprintf("message exceeds the maximum size of %d bytes", srv.cfg.MaxMessageSize)}
+		}
+	case command:
+		err = srv.handleCommand(ctx, msg)
+	default:
+		err = srv.handleMessage(ctx, msg)
+	}
+
+	switch err := err.(type) {
+	case nil:
+		return proto.Response{Status: proto.Accepted}
+	case rejection:
+		return proto.Response{Status: proto.Rejected, Reason: err.reason}
+	default:
+		// FIXME(sbinet): better handling
+		log.Print(err)
+		return proto.Response{Status: proto.TempFailure, Reason: err.Error()}
+	}
+}
+
 func (srv *Server) run(ctx context.Context) {
 	for {
 		c, err := srv.sck.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				// the listener was closed by Serve.
+				return
+			}
 			log.Printf("server: could not accept connection: %v", err)
 			continue
 		}
@@ -129,30 +256,106 @@ func (srv *Server) run(ctx context.Context) {
 
 func (srv *Server) client(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
-	var hdr [8]byte
+
+	err := srv.authenticate(conn)
+	if err != nil {
+		log.Printf("server: could not authenticate client: %v", err)
+		return
+	}
+
 	for {
-		msg := new(Message)
-		_, err := io.ReadFull(conn, hdr[:])
+		var hdr proto.Header
+		_, err := hdr.ReadFrom(conn)
 		if err != nil {
 			log.Printf("server: could not read command message header: %v", err)
 			return
 		}
-		size := binary.BigEndian.Uint64(hdr[:])
-		buf := make([]byte, size)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			log.Printf("server: could not read command message body: %v", err)
+		if hdr.Size > math.MaxInt64 {
+			log.Printf("server: invalid command message size (%d)", hdr.Size)
 			return
 		}
-		_, err = msg.ReadFrom(bytes.NewReader(buf))
-		if err != nil {
+
+		var (
+			body = io.LimitReader(conn, int64(hdr.Size))
+			msg  = new(Message)
+			drop bool
+		)
+		_, err = msg.readFrom(body, srv.cfg.MaxMessageSize)
+		switch {
+		case errors.Cause(err) == ErrMessageTooLarge:
+			// the header of the message was read: process refuses it.
+			// The rest of the frame is discarded, so the client can read
+			// the response once it has written the whole body, unless the
+			// frame is too large to be read: the connection is dropped.
+			msg.tooLarge = true
+			drop = hdr.Size > proto.MaxRequestSize
+			if !drop {
+				_, err = io.Copy(ioutil.Discard, body)
+				if err != nil {
+					msg.Close()
+					log.Printf("server: could not read command message: %v", err)
+					return
+				}
+			}
+		case err != nil:
 			log.Printf("server: could not deserialize command message: %v", err)
+			if hdr.Version == 0 {
+				return
+			}
+			resp := proto.Response{
+				ID:     hdr.ID,
+				Status: proto.Rejected,
+				Reason: fmt.Sprintf("could not parse message: %v", err),
+			}
+			_, err = io.Copy(ioutil.Discard, body)
+			if err != nil {
+				return
+			}
+			err = srv.reply(conn, resp)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		if hdr.Version == 0 {
+			// legacy fire-and-forget protocol.
+			select {
+			case srv.msg <- msg:
+			case <-ctx.Done():
+				msg.Close()
+				return
+			}
+			if drop {
+				return
+			}
+			continue
+		}
+
+		sub := submission{msg: msg, resp: make(chan proto.Response, 1)}
+		select {
+		case srv.sub <- sub:
+		case <-ctx.Done():
+			msg.Close()
+			return
+		}
+		resp := <-sub.resp
+		resp.ID = hdr.ID
+		err = srv.reply(conn, resp)
+		if err != nil || drop {
 			return
 		}
-		srv.msg <- msg
 	}
 }
 
+func (srv *Server) reply(conn net.Conn, resp proto.Response) error {
+	_, err := resp.WriteTo(conn)
+	if err != nil {
+		log.Printf("server: could not send status reply: %v", err)
+	}
+	return err
+}
+
 func (srv *Server) isCommand(msg *Message) bool {
 	for _, list := range []string{msg.To, msg.Cc, msg.Bcc} {
 		addrs, err := mail.ParseAddressList(list)
@@ -169,6 +372,22 @@ func (srv *Server) isCommand(msg *Message) bool {
 }
 
 func (srv *Server) handleCommand(ctx context.Context, msg *Message) error {
+	if isAutomated(msg) {
+		// don't answer auto-responders, other lists or bounces.
+		log.Printf("server: ignoring automated command message %s from %q", msg.ID, msg.From)
+		return nil
+	}
+
+	if srv.cfg.RequireSignature && isSignedCommand(msg.Subject) {
+		err := srv.verifySignature(msg, nil)
+		if err == nil {
+			err = msg.checkSignedCommand()
+		}
+		if err != nil {
+			return srv.handleUnsignedCommand(ctx, msg, err)
+		}
+	}
+
 	switch {
 	case msg.Subject == "lists":
 		return srv.handleShowLists(ctx, msg)
@@ -180,16 +399,22 @@ func (srv *Server) handleCommand(ctx context.Context, msg *Message) error {
 		return srv.handleSubscribe(ctx, msg)
 	case strings.HasPrefix(msg.Subject, "unsubscribe"):
 		return srv.handleUnsubscribe(ctx, msg)
+	case strings.HasPrefix(msg.Subject, "setkey"):
+		return srv.handleSetKey(ctx, msg)
 	default:
 		return srv.handleUnknownCommand(ctx, msg)
 	}
 }
 
 func (srv *Server) handleShowLists(ctx context.Context, msg *Message) error {
+	states, err := srv.db.ListStates(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	body := new(bytes.Buffer)
 	fmt.Fprintf(body, "Available mailing lists:\r\n\r\n")
 	for _, list := range srv.cfg.Lists {
-		if list.Hidden {
+		if list.Hidden || states[list.ID] != database.ListActive {
 			continue
 		}
 		fmt.Fprintf(body,
@@ -224,12 +449,20 @@ func (srv *Server) handleHelp(ctx context.Context, msg *Message) error {
 
 func (srv *Server) handleShowSubscriptions(ctx context.Context, msg *Message) error {
 	body := new(bytes.Buffer)
+	subscribed, err := srv.subscriptions(ctx, msg.From)
+	if err != nil {
+		return err
+	}
+	states, err := srv.db.ListStates(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	fmt.Fprintf(body, "Mailing lists:\r\n\r\n")
 	for _, list := range srv.cfg.Lists {
-		if list.Hidden {
+		if list.Hidden || states[list.ID] == database.ListArchived {
 			continue
 		}
-		if !srv.isSubscribed(msg.From, list.ID) {
+		if !subscribed[list.ID] {
 			continue
 		}
 
@@ -267,13 +500,27 @@ func (srv *Server) handleSubscribe(ctx context.Context, msg *Message) error {
 	// Switch to id - in case we were passed address
 	listID = list.ID
 
-	if srv.isSubscribed(msg.From, listID) {
+	state, err := srv.listState(ctx, listID)
+	if err != nil {
+		return err
+	}
+	if state != database.ListActive {
+		reply := msg.Reply()
+		reply.Body = fmt.Sprintf("Unable to subscribe to %s  - the mailing list is closed.\r\n", listID)
+		return srv.send(reply, []string{msg.From})
+	}
+
+	subscribed, err := srv.isSubscribed(ctx, msg.From, listID)
+	if err != nil {
+		return err
+	}
+	if subscribed {
 		reply := msg.Reply()
 		reply.Body = fmt.Sprintf("You are already subscribed to %s\r\n", listID)
 		return srv.send(reply, []string{msg.From})
 	}
 
-	err := srv.subscribe(msg.From, listID)
+	err = srv.subscribe(ctx, msg.From, listID)
 	if err != nil {
 		return err
 	}
@@ -296,13 +543,12 @@ func (srv *Server) handleUnsubscribe(ctx context.Context, msg *Message) error {
 	// Switch to id - in case we were passed address
 	listID = list.ID
 
-	if !srv.isSubscribed(msg.From, listID) {
+	err := srv.unsubscribe(ctx, msg.From, listID)
+	if errors.Cause(err) == database.ErrNotSubscribed {
 		reply := msg.Reply()
 		reply.Body = fmt.Sprintf("You aren't subscribed to %s\r\n", listID)
 		return srv.send(reply, []string{msg.From})
 	}
-
-	err := srv.unsubscribe(msg.From, listID)
 	if err != nil {
 		return err
 	}
@@ -324,43 +570,165 @@ func (srv *Server) handleUnknownCommand(ctx context.Context, msg *Message) error
 	return srv.send(reply, []string{msg.From})
 }
 
+func (srv *Server) handleUnsignedCommand(ctx context.Context, msg *Message, err error) error {
+	reply := msg.Reply()
+	reply.From = srv.cfg.CommandAddress
+	reply.Body = fmt.Sprintf(
+		"Subscription commands must carry a valid OpenPGP or S/MIME signature from a key registered to your address.\r\n"+
+			"The command must also be part of the signed content: either as its Subject header, or as the first line of its text.\r\n"+
+			"Your command has not been processed: %v\r\n",
+		errors.Cause(err),
+	)
+	err = srv.send(reply, []string{msg.From})
+	if err != nil {
+		return err
+	}
+	return rejection{"command is not signed"}
+}
+
 func (srv *Server) handleMessage(ctx context.Context, msg *Message) error {
 	lists := srv.lookupLists(msg)
 	if len(lists) == 0 {
 		return srv.handleNoDestination(ctx, msg)
 	}
 
-	var last error
+	var (
+		last    error
+		posted  int
+		dropped int
+	)
 	for _, list := range lists {
-		if !srv.canPost(msg.From, list) {
-			err := srv.handleNotAuthorizedToPost(ctx, msg, list)
+		if isLoop(msg, list) {
+			log.Printf("server: dropping message %s already sent by list %q", msg.ID, list.ID)
+			dropped++
+			continue
+		}
+		state, err := srv.listState(ctx, list.ID)
+		if err != nil {
+			last = err
+			continue
+		}
+		if state != database.ListActive {
+			err = srv.handleClosed(ctx, msg, list)
 			if err != nil {
 				last = err
 			}
 			continue
 		}
-		fwd := msg.ResendAs(list.ID, list.Address)
-		err := srv.sendList(fwd, list)
+		if list.MaxMessageSize > 0 && msg.Size() > list.MaxMessageSize {
+			err := srv.handleTooLarge(ctx, msg, list.MaxMessageSize)
+			if err != nil {
+				last = err
+			}
+			continue
+		}
+		allowed, err := srv.canPost(ctx, msg, list)
 		if err != nil {
 			last = err
+			continue
+		}
+		if !allowed {
+			err := srv.handleNotAuthorizedToPost(ctx, msg, list)
+			if err != nil {
+				last = err
+			}
+			continue
+		}
+		err = srv.post(ctx, msg, list)
+		switch err.(type) {
+		case nil:
+			posted++
+		case rejection:
+			// the sender has been notified.
+		default:
+			last = err
 		}
 	}
-	return last
+	if last != nil {
+		return last
+	}
+	if posted == 0 && dropped == 0 {
+		return rejection{"message was refused by all addressed lists"}
+	}
+	return nil
 }
 
-func (srv *Server) handleNoDestination(ctx context.Context, msg *Message) error {
+// post filters msg and sends it to list.
+// A rejection is returned if msg was refused, after notifying the sender.
+func (srv *Server) post(ctx context.Context, msg *Message, list *List) error {
+	in := msg
+	if list.Encrypted {
+		var err error
+		in, err = srv.decryptPost(msg, list)
+		if err != nil {
+			err = srv.handleNotEncrypted(ctx, msg, list, err)
+			if err != nil {
+				return err
+			}
+			return rejection{"message is not encrypted"}
+		}
+		defer in.Close()
+	}
+
+	verdict, reason, err := srv.filter(ctx, in, list)
+	if err != nil {
+		return err
+	}
+	switch verdict {
+	case Hold:
+		return srv.handleHeld(ctx, msg, list, reason)
+	case Reject:
+		err = srv.handleFiltered(ctx, msg, list, reason)
+		if err != nil {
+			return err
+		}
+		return rejection{reason}
+	}
+
+	fwd, err := srv.mitigateDMARC(ctx, in.resendTo(list), list)
+	if err != nil {
+		return err
+	}
+	if fwd.spool != in.spool {
+		defer fwd.Close()
+	}
+	fwd.seal = srv.sealFor(ctx, msg, fwd, list)
+	return srv.sendList(ctx, fwd, list)
+}
+
+// notify answers msg with body, unless msg was sent by an auto-responder,
+// a mailing list or a mailer daemon, which must not be answered.
+func (srv *Server) notify(msg *Message, body string) error {
+	if isAutomated(msg) {
+		log.Printf("server: not answering automated message %s from %q", msg.ID, msg.From)
+		return nil
+	}
 	reply := msg.Reply()
 	reply.From = srv.cfg.CommandAddress
-	reply.Body = "No mailing lists addressed. Your message has not been delivered.\r\n"
+	reply.Body = body
 	return srv.send(reply, []string{msg.From})
 }
 
+func (srv *Server) handleNoDestination(ctx context.Context, msg *Message) error {
+	err := srv.notify(msg, "No mailing lists addressed. Your message has not been delivered.\r\n")
+	if err != nil {
+		return err
+	}
+	return rejection{"no mailing list addressed"}
+}
+
 func (srv *Server) handleNotAuthorizedToPost(ctx context.Context, msg *Message, list *List) error {
-	reply := msg.Reply()
-	reply.From = srv.cfg.CommandAddress
-	reply.Body = fmt.Sprintf("You are not an approved poster for this mailing list (%s). Your message has not been delivered.\r\n", list.Address)
+	return srv.notify(msg, fmt.Sprintf(
+		"You are not an approved poster for this mailing list (%s). Your message has not been delivered.\r\n",
+		list.Address,
+	))
+}
 
-	return srv.send(reply, []string{msg.From})
+func (srv *Server) handleTooLarge(ctx context.Context, msg *Message, max int64) error {
+	return srv.notify(msg, fmt.Sprintf(
+		"Your message exceeds the maximum allowed size of %d bytes. Your message has not been delivered.\r\n",
+		max,
+	))
 }
 
 func (srv *Server) lookupLists(msg *Message) []*List {
@@ -390,77 +758,308 @@ func (srv *Server) lookupList(key string) *List {
 	return nil
 }
 
-func (srv *Server) canPost(from string, list *List) bool {
-	if list.SubscribersOnly && !srv.isSubscribed(from, list.ID) {
-		return false
+func (srv *Server) canPost(ctx context.Context, msg *Message, list *List) (bool, error) {
+	from := msg.From
+
+	// Posting rights are granted based on the From address: make sure it
+	// is not spoofed.
+	restricted := list.SubscribersOnly || len(list.Posters) > 0
+	if restricted && list.RequireAuth && !srv.verifySender(ctx, msg).aligned(from) {
+		return false, nil
+	}
+	if list.RequireSignature && srv.verifySignature(msg, list) != nil {
+		return false, nil
+	}
+
+	if list.SubscribersOnly {
+		subscribed, err := srv.isSubscribed(ctx, from, list.ID)
+		if err != nil || !subscribed {
+			return false, err
+		}
 	}
 
 	// Is there a whitelist of approved posters?
 	if len(list.Posters) > 0 {
 		for _, poster := range list.Posters {
-			if from == poster {
-				return true
+			if srv.sameAddress(from, poster) {
+				return true, nil
 			}
 		}
-		return false
+		return false, nil
 	}
 
-	return true
+	return true, nil
 }
 
-func (srv *Server) sendList(msg *Message, list *List) error {
-	recipients, err := srv.subscribers(list.ID)
+func (srv *Server) sendList(ctx context.Context, msg *Message, list *List) error {
+	recipients, err := srv.subscribers(ctx, list.ID)
 	if err != nil {
 		return err
 	}
 	recipients = append(recipients, list.Bcc...)
 
-	return srv.send(msg, recipients)
+	if !list.Personalize && !list.Encrypted {
+		return srv.sendDecorated(ctx, msg, list, "", recipients)
+	}
+
+	var last error
+	for _, rcpt := range recipients {
+		err := srv.sendDecorated(ctx, msg, list, rcpt, []string{rcpt})
+		if errors.Cause(err) == database.ErrNoKey {
+			log.Printf("server: no key registered by %q for list %q", rcpt, list.ID)
+			continue
+		}
+		if err != nil {
+			last = err
+		}
+	}
+	return last
 }
 
-func (srv *Server) send(msg *Message, recipients []string) error {
-	body, err := msg.MarshalText()
+// sendDecorated sends msg to recipients, with the header and footer of
+// the list rendered for rcpt.
+func (srv *Server) sendDecorated(ctx context.Context, msg *Message, list *List, rcpt string, recipients []string) error {
+	header, footer, err := srv.decoration(list, rcpt)
 	if err != nil {
 		return err
 	}
+	out, err := decorate(msg, header, footer)
+	if err != nil {
+		return err
+	}
+	if out != msg {
+		defer out.Close()
+	}
+	if list.Encrypted {
+		out, err = srv.encryptFor(ctx, out, list, rcpt)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	return srv.deliver(out, recipients, srv.signers[list.ID])
+}
 
-	return smtp.SendMail(
-		srv.cfg.SMTPHostname+":"+srv.cfg.SMTPPort,
-		smtp.PlainAuth("",
+// send sends a server generated message, from the command address unless
+// set otherwise.
+func (srv *Server) send(msg *Message, recipients []string) error {
+	if msg.From == "" {
+		msg.From = srv.cfg.CommandAddress
+	}
+	if msg.AutoSubmitted == "" {
+		msg.AutoSubmitted = "auto-replied"
+	}
+	return srv.deliver(msg, recipients, srv.signers[""])
+}
+
+// deliver sends msg to recipients through the SMTP relay, signing it with
+// signer if not nil.
+func (srv *Server) deliver(msg *Message, recipients []string, signer *dkim.Signer) error {
+	c, err := smtp.Dial(srv.cfg.SMTPHostname + ":" + srv.cfg.SMTPPort)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: srv.cfg.SMTPHostname})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if ok, _ := c.Extension("AUTH"); ok {
+		err = c.Auth(smtp.PlainAuth("",
 			srv.cfg.SMTPUsername, srv.cfg.SMTPPassword,
 			srv.cfg.SMTPHostname,
-		),
-		msg.From, recipients,
-		body,
+		))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	smtputf8, _ := c.Extension("SMTPUTF8")
+	if !smtputf8 {
+		msg = downgrade(msg)
+	}
+
+	var sig string
+	if signer != nil {
+		hdr := msg.marshalHeader()
+		if msg.seal != nil {
+			set, err := signer.Seal(hdr, msg.BodyReader(), msg.seal.instance, msg.seal.cv, msg.seal.results)
+			if err != nil {
+				return errors.Wrap(err, "strew: could not seal message")
+			}
+			sig = set
+		}
+		dsig, err := signer.Sign(hdr, msg.BodyReader())
+		if err != nil {
+			return errors.Wrap(err, "strew: could not sign message")
+		}
+		sig = dsig + sig
+	}
+
+	from, err := envelopeAddress(msg.From, smtputf8)
+	if err != nil {
+		return err
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var (
+		last  error
+		rcpts int
 	)
+	for _, rcpt := range recipients {
+		to, err := envelopeAddress(rcpt, smtputf8)
+		if err != nil {
+			log.Printf("server: could not send message %s: %v", msg.ID, err)
+			last = err
+			continue
+		}
+		err = c.Rcpt(to)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rcpts++
+	}
+	if rcpts == 0 {
+		return last
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.WriteString(w, sig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = msg.WriteTo(w)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return c.Quit()
 }
 
-// subscribers returns the list of subscribers for the given mailing list ID.
-func (srv *Server) subscribers(list string) ([]string, error) {
-	return srv.db.Subscribers(list)
+// downgrade returns a copy of msg with the IDNs of its address header fields
+// converted to A-labels, for relays without SMTPUTF8 support.
+func downgrade(msg *Message) *Message {
+	out := *msg
+	out.From = asciiAddressList(msg.From)
+	out.ReplyTo = asciiAddressList(msg.ReplyTo)
+	out.To = asciiAddressList(msg.To)
+	out.Cc = asciiAddressList(msg.Cc)
+	out.Bcc = asciiAddressList(msg.Bcc)
+	return &out
 }
 
-// subscribe subscribes a user to a mailing list
-func (srv *Server) subscribe(user, list string) error {
-	return srv.db.Subscribe(user, list)
+// subscribers returns the list of subscribers for the given mailing list ID
+// receiving each post.
+// Digests are not supported yet: subscribers with the digest (or nomail)
+// delivery mode receive no posts.
+func (srv *Server) subscribers(ctx context.Context, list string) ([]string, error) {
+	members, err := srv.db.Members(ctx, list)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(members))
+	for _, sub := range members {
+		switch sub.Delivery {
+		case "", database.DeliveryRegular:
+			users = append(users, sub.Address)
+		}
+	}
+	return users, nil
+}
+
+// subscribe subscribes a user to a mailing list.
+// The address is stored as given, without its display name.
+func (srv *Server) subscribe(ctx context.Context, user, list string) error {
+	v, err := mail.ParseAddress(user)
+	if err != nil {
+		return rejection{"invalid address"}
+	}
+	sub := database.Subscription{
+		List:         list,
+		Address:      v.Address,
+		Name:         v.Name,
+		SubscribedAt: time.Now().UTC(),
+		Source:       database.SourceEmail,
+		Delivery:     database.DeliveryRegular,
+	}
+	return srv.db.AddSubscription(ctx, sub)
 }
 
 // unsubscribe removes a user from the given mailing list.
-func (srv *Server) unsubscribe(user, list string) error {
-	return srv.db.Unsubscribe(user, list)
+func (srv *Server) unsubscribe(ctx context.Context, user, list string) error {
+	if _, err := srv.normalize(user); err != nil {
+		return rejection{"invalid address"}
+	}
+	sub, err := srv.lookupSubscription(ctx, user, list)
+	if err != nil {
+		return err
+	}
+	return srv.db.Unsubscribe(ctx, sub.Address, list)
 }
 
-func (srv *Server) isSubscribed(user, list string) bool {
-	users, err := srv.db.Subscribers(list)
+// subscriptions returns the set of IDs of the configured lists user is
+// subscribed to, with its address as given or in its normalized form.
+// Subscriptions made with other spellings of the address are not listed.
+func (srv *Server) subscriptions(ctx context.Context, user string) (map[string]bool, error) {
+	norm, err := srv.normalize(user)
+	if err != nil {
+		return nil, rejection{"invalid address"}
+	}
+	v, err := mail.ParseAddress(user)
 	if err != nil {
-		return false
+		return nil, rejection{"invalid address"}
+	}
+	addrs := []string{v.Address}
+	if norm != v.Address {
+		addrs = append(addrs, norm)
 	}
-	for _, u := range users {
-		if u == user {
-			return true
+
+	configured := make(map[string]bool, len(srv.cfg.Lists))
+	for _, list := range srv.cfg.Lists {
+		configured[list.ID] = true
+	}
+	set := make(map[string]bool)
+	for _, addr := range addrs {
+		lists, err := srv.db.Subscriptions(ctx, addr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, list := range lists {
+			if configured[list] {
+				set[list] = true
+			}
 		}
 	}
-	return false
+	return set, nil
+}
+
+// isSubscribed reports whether user is subscribed to list.
+// A rejection is returned if user is not a valid address.
+func (srv *Server) isSubscribed(ctx context.Context, user, list string) (bool, error) {
+	if _, err := srv.normalize(user); err != nil {
+		return false, rejection{"invalid address"}
+	}
+	_, err := srv.lookupSubscription(ctx, user, list)
+	switch errors.Cause(err) {
+	case nil:
+		return true, nil
+	case database.ErrNotSubscribed:
+		return false, nil
+	default:
+		return false, err
+	}
 }
 
 // commandInfo generates an email-able list of commands
@@ -480,23 +1079,114 @@ func (srv *Server) commandInfo() string {
 		"    unsubscribe <list-id>\r\n"+
 		"      Unsubscribe from <list-id>\r\n"+
 		"\r\n"+
+		"    setkey <list-id>\r\n"+
+		"      Register the OpenPGP public key attached to the message,\r\n"+
+		"      to receive the posts of the encrypted list <list-id>.\r\n"+
+		"      The message must be PGP/MIME signed with the key already\r\n"+
+		"      registered, or with the new key for a first registration\r\n"+
+		"\r\n"+
 		"To send a command, email %s with the command as the subject.\r\n",
 		srv.cfg.CommandAddress,
 	)
 }
 
 type Config struct {
-	ListenAddress  string `ini:"listen_address"`
-	CommandAddress string `ini:"command_address"`
-	Log            string `ini:"log"`
-	Driver         string `ini:"driver"`
-	Database       string `ini:"database"`
-	SMTPHostname   string `ini:"smtp_hostname"`
-	SMTPPort       string `ini:"smtp_port"`
-	SMTPUsername   string `ini:"smtp_username"`
-	SMTPPassword   string `ini:"smtp_password"`
+	ListenAddress  string   `ini:"listen_address"`
+	ListenPerm     string   `ini:"listen_perm"`
+	ListenTLSCert  string   `ini:"listen_tls_cert"`
+	ListenTLSKey   string   `ini:"listen_tls_key"`
+	ListenClientCA string   `ini:"listen_client_ca"`
+	ListenToken    string   `ini:"listen_token"`
+	CommandAddress string   `ini:"command_address"`
+	Log            string   `ini:"log"`
+	Driver         string   `ini:"driver"`
+	Database       string   `ini:"database"`
+	SMTPHostname   string   `ini:"smtp_hostname"`
+	SMTPPort       string   `ini:"smtp_port"`
+	SMTPUsername   string   `ini:"smtp_username"`
+	SMTPPassword   string   `ini:"smtp_password"`
+	MaxMessageSize int64    `ini:"max_message_size"`
+	DKIMDomain     string   `ini:"dkim_domain"`
+	DKIMSelector   string   `ini:"dkim_selector"`
+	DKIMKey        string   `ini:"dkim_key"`
+	DKIMHeaders    []string `ini:"dkim_headers,omitempty"`
+	AuthservID     string   `ini:"authserv_id"`
 	Lists          map[string]*List
 	Debug          bool
+
+	// TrustedAuthservIDs lists the authserv-id of the MTAs whose
+	// Authentication-Results header fields are trusted.
+	TrustedAuthservIDs []string `ini:"trusted_authserv_ids,omitempty"`
+
+	// TrustedRelays lists the host names of the MTAs delivering mail to
+	// strew. The client IP address and envelope sender used for SPF
+	// checks are only read from the header fields they add.
+	TrustedRelays []string `ini:"trusted_relays,omitempty"`
+
+	// DKIM holds the DKIM settings of [dkim.<domain>] sections,
+	// by signing domain.
+	DKIM map[string]*DKIM `ini:"-"`
+
+	// RequireSignature requires the subscribe, unsubscribe and setkey
+	// commands to be signed with a key of Keyring or a certificate issued
+	// by SMIMECerts, registered to the sender address.
+	RequireSignature bool   `ini:"require_signature"`
+	Keyring          string `ini:"keyring"`     // OpenPGP public keyring.
+	SMIMECerts       string `ini:"smime_certs"` // PEM S/MIME trust store.
+
+	// SpamdAddress is the address of a spamd (or rspamd) server checking
+	// posts to lists with a spam_action, as host:port or unix:/path.
+	SpamdAddress string `ini:"spamd_address"`
+	// SpamdTimeout bounds the time taken by a spam check.
+	// (default: 30s)
+	SpamdTimeout time.Duration `ini:"spamd_timeout"`
+	// SpamdFailOpen accepts posts that could not be checked for spam.
+	// Otherwise, they are refused with a temporary failure.
+	SpamdFailOpen bool `ini:"spamd_fail_open"`
+	// HoldDir is the directory where posts held for moderation are saved.
+	// Held posts are refused if empty.
+	HoldDir string `ini:"hold_dir"`
+
+	// Address normalization: FoldLocalPart lowercases the local part of
+	// addresses, PlusDomains and DotDomains list the domains ("*" for all)
+	// ignoring +tags and dots in local parts.
+	FoldLocalPart bool     `ini:"fold_local_part"`
+	PlusDomains   []string `ini:"plus_domains,omitempty"`
+	DotDomains    []string `ini:"dot_domains,omitempty"`
+
+	// CommandRate and PostRate limit the number of commands and posts
+	// accepted from a sender address or a source IP, such as "10/h".
+	// Source IPs are read from the header fields added by TrustedRelays.
+	// Keys exceeding their limit BlockAfter times within BlockDuration are
+	// blocked for BlockDuration, persisted in the database if PersistBlocks
+	// is set.
+	// Refused messages are dropped silently if SilentDrop is set.
+	CommandRate   string        `ini:"command_rate"`
+	PostRate      string        `ini:"post_rate"`
+	BlockAfter    int           `ini:"block_after"`
+	BlockDuration time.Duration `ini:"block_duration"`
+	PersistBlocks bool          `ini:"persist_blocks"`
+	SilentDrop    bool          `ini:"silent_drop"`
+
+	// BackupFile is the file a hot backup of the database is written to
+	// when the server receives SIGUSR1.
+	BackupFile string `ini:"backup_file"`
+
+	// HeaderFilters holds the settings of [filter.<name>] sections,
+	// by name.
+	HeaderFilters map[string]*HeaderFilter `ini:"-"`
+
+	// Filters are run on posts, after the built-in filters.
+	Filters []Filter `ini:"-"`
+
+	// Resolver is used for DNS lookups, such as DMARC policies.
+	// net.DefaultResolver is used if nil.
+	Resolver Resolver `ini:"-"`
+}
+
+// LoadConfig loads the configuration file fname.
+func LoadConfig(fname string) (Config, error) {
+	return newConfig(fname)
 }
 
 func newConfig(fname string) (Config, error) {
@@ -511,6 +1201,26 @@ func newConfig(fname string) (Config, error) {
 		return cfg, err
 	}
 
+	cfg.DKIM = make(map[string]*DKIM)
+	for _, section := range f.ChildSections("dkim") {
+		var v DKIM
+		err = section.MapTo(&v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DKIM[strings.TrimPrefix(section.Name(), "dkim.")] = &v
+	}
+
+	cfg.HeaderFilters = make(map[string]*HeaderFilter)
+	for _, section := range f.ChildSections("filter") {
+		var v HeaderFilter
+		err = section.MapTo(&v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.HeaderFilters[strings.TrimPrefix(section.Name(), "filter.")] = &v
+	}
+
 	cfg.Lists = make(map[string]*List)
 	for _, section := range f.ChildSections("list") {
 		var list List
@@ -533,4 +1243,37 @@ type List struct {
 	SubscribersOnly bool     `ini:"subscribers_only"`
 	Posters         []string `ini:"posters,omitempty"`
 	Bcc             []string `ini:"bcc,omitempty"`
+	MaxMessageSize  int64    `ini:"max_message_size"`
+	Header          string   `ini:"header"`
+	Footer          string   `ini:"footer"`
+	Personalize     bool     `ini:"personalize"`
+	SubjectPrefix   string   `ini:"subject_prefix"`
+	DMARCMitigation string   `ini:"dmarc_mitigation"`
+	DKIMDomain      string   `ini:"dkim_domain"`
+	DKIMSelector    string   `ini:"dkim_selector"`
+	DKIMKey         string   `ini:"dkim_key"`
+	DKIMHeaders     []string `ini:"dkim_headers,omitempty"`
+	RequireAuth     bool     `ini:"require_auth"`
+	ARCSeal         bool     `ini:"arc_seal"`
+
+	// RequireSignature requires posts to be signed with a key registered
+	// to the sender. Keyring and SMIMECerts default to the global ones.
+	RequireSignature bool   `ini:"require_signature"`
+	Keyring          string `ini:"keyring"`
+	SMIMECerts       string `ini:"smime_certs"`
+
+	// Encrypted lists only accept posts encrypted to SecretKey, and
+	// re-encrypt them to the key registered by each subscriber.
+	Encrypted           bool   `ini:"encrypted"`
+	SecretKey           string `ini:"secret_key"`
+	SecretKeyPassphrase string `ini:"secret_key_passphrase"`
+
+	// Filters refusing posts.
+	MaxRecipients int      `ini:"max_recipients"`
+	BannedTypes   []string `ini:"banned_types,omitempty"` // media types or file extensions.
+	RejectHTML    bool     `ini:"reject_html"`            // refuse HTML-only posts.
+	SpamAction    string   `ini:"spam_action"`            // hold or reject posts flagged as spam.
+
+	header *template.Template
+	footer *template.Template
 }
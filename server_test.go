@@ -0,0 +1,227 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sbinet-alt63/strew/client"
+	"github.com/sbinet-alt63/strew/database"
+	_ "github.com/sbinet-alt63/strew/database/memdb"
+	"github.com/sbinet-alt63/strew/proto"
+)
+
+// newTestServer returns a server relaying to a stand-in SMTP relay and
+// listening on a local command socket, with a single list
+// golang@example.com.
+func newTestServer(t *testing.T, cfg Config) (*Server, *smtpd) {
+	relay := newSMTPD(t, false)
+	host, port, _ := net.SplitHostPort(relay.l.Addr().String())
+	cfg.CommandAddress = "strew@example.com"
+	cfg.SMTPHostname = host
+	cfg.SMTPPort = port
+	if cfg.Lists == nil {
+		cfg.Lists = map[string]*List{
+			"golang@example.com": {ID: "golang", Address: "golang@example.com"},
+		}
+	}
+
+	db, err := database.Open("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reconcileLists(context.Background(), db, cfg.Lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		cfg: cfg,
+		db:  db,
+		sck: sck,
+		msg: make(chan *Message),
+		sub: make(chan submission),
+	}
+	return srv, relay
+}
+
+func TestServeStatus(t *testing.T) {
+	srv, relay := newTestServer(t, Config{})
+	defer relay.l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx)
+
+	c, err := client.Dial("tcp", srv.sck.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, tc := range []struct {
+		name string
+		raw  string
+		want proto.Response
+		rcpt []string
+	}{
+		{
+			name: "subscribe",
+			raw:  "From: alice@example.com\r\nTo: strew@example.com\r\nSubject: subscribe golang\r\n\r\n",
+			want: proto.Response{Status: proto.Accepted},
+			rcpt: []string{"RCPT TO:<alice@example.com>"},
+		},
+		{
+			name: "post",
+			raw:  "From: bob@example.com\r\nTo: golang@example.com\r\nSubject: hello\r\n\r\nhello\r\n",
+			want: proto.Response{Status: proto.Accepted},
+			rcpt: []string{"RCPT TO:<alice@example.com>"},
+		},
+		{
+			name: "no-destination",
+			raw:  "From: bob@example.com\r\nTo: rust@example.com\r\nSubject: hello\r\n\r\nhello\r\n",
+			want: proto.Response{Status: proto.Rejected, Reason: "no mailing list addressed"},
+			rcpt: []string{"RCPT TO:<bob@example.com>"},
+		},
+		{
+			// bounces are not answered.
+			name: "no-destination-bounce",
+			raw:  "From: MAILER-DAEMON@example.com\r\nTo: rust@example.com\r\nSubject: undeliverable\r\n\r\nhello\r\n",
+			want: proto.Response{Status: proto.Rejected, Reason: "no mailing list addressed"},
+		},
+		{
+			name: "invalid",
+			raw:  "From bob\r\n",
+			want: proto.Response{Status: proto.Rejected},
+		},
+	} {
+		resp, err := c.SubmitRaw([]byte(tc.raw))
+		if err != nil {
+			t.Fatalf("%s: could not submit message: %+v", tc.name, err)
+		}
+		if tc.want.Reason == "" && tc.want.Status != proto.Accepted {
+			// only check the status of parse errors.
+			resp.Reason = ""
+		}
+		resp.ID = 0
+		if resp != tc.want {
+			t.Fatalf("%s: invalid response:\ngot= %+v\nwant=%+v", tc.name, resp, tc.want)
+		}
+		var rcpt []string
+		for _, cmd := range relay.envelope() {
+			if strings.HasPrefix(cmd, "RCPT") {
+				rcpt = append(rcpt, cmd)
+			}
+		}
+		if !reflect.DeepEqual(rcpt, tc.rcpt) {
+			t.Fatalf("%s: invalid recipients: got=%q, want=%q", tc.name, rcpt, tc.rcpt)
+		}
+	}
+}
+
+func TestServeTooLarge(t *testing.T) {
+	srv, relay := newTestServer(t, Config{MaxMessageSize: 16})
+	defer relay.l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx)
+
+	for _, tc := range []struct {
+		from string
+		rcpt []string
+	}{
+		{"bob@example.com", []string{"RCPT TO:<bob@example.com>"}},
+		// bounces are not answered.
+		{"MAILER-DAEMON@example.com", nil},
+		{"<>", nil},
+	} {
+		c, err := client.Dial("tcp", srv.sck.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the body is larger than the socket buffers: the client only
+		// reads the response once it has written all of it.
+		resp, err := c.SubmitRaw([]byte("From: " + tc.from + "\r\nTo: golang@example.com\r\nSubject: hello\r\n\r\n" +
+			strings.Repeat("hello\r\n", 1<<20),
+		))
+		if err != nil {
+			t.Fatalf("%s: could not submit message: %+v", tc.from, err)
+		}
+		want := proto.Response{ID: 1, Status: proto.Rejected, Reason: "message exceeds the maximum size of 16 bytes"}
+		if resp != want {
+			t.Fatalf("%s: invalid response:\ngot= %+v\nwant=%+v", tc.from, resp, want)
+		}
+		// the rest of the frame was discarded: the connection is kept open.
+		resp, err = c.SubmitRaw([]byte("Subject: help\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("%s: connection was dropped: %+v", tc.from, err)
+		}
+		if resp.ID != 2 {
+			t.Fatalf("%s: invalid response: %+v", tc.from, resp)
+		}
+		c.Close()
+
+		var rcpt []string
+		for _, cmd := range relay.envelope() {
+			if strings.HasPrefix(cmd, "RCPT") {
+				rcpt = append(rcpt, cmd)
+			}
+		}
+		if !reflect.DeepEqual(rcpt, tc.rcpt) {
+			t.Fatalf("%s: invalid recipients: got=%q, want=%q", tc.from, rcpt, tc.rcpt)
+		}
+	}
+}
+
+func TestServeDeliveryModes(t *testing.T) {
+	srv, relay := newTestServer(t, Config{})
+	defer relay.l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, sub := range []database.Subscription{
+		{List: "golang", Address: "alice@example.com", Delivery: database.DeliveryRegular},
+		{List: "golang", Address: "bob@example.com", Delivery: database.DeliveryDigest},
+		{List: "golang", Address: "carol@example.com", Delivery: database.DeliveryNoMail},
+		{List: "golang", Address: "dave@example.com"},
+	} {
+		err := srv.db.AddSubscription(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	go srv.Serve(ctx)
+
+	c, err := client.Dial("tcp", srv.sck.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp, err := c.SubmitRaw([]byte("From: alice@example.com\r\nTo: golang@example.com\r\nSubject: hello\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatalf("could not submit message: %+v", err)
+	}
+	if resp.Status != proto.Accepted {
+		t.Fatalf("invalid response: %+v", resp)
+	}
+	var rcpt []string
+	for _, cmd := range relay.envelope() {
+		if strings.HasPrefix(cmd, "RCPT") {
+			rcpt = append(rcpt, cmd)
+		}
+	}
+	if want := []string{"RCPT TO:<alice@example.com>", "RCPT TO:<dave@example.com>"}; !reflect.DeepEqual(rcpt, want) {
+		t.Fatalf("invalid recipients: got=%q, want=%q", rcpt, want)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"crypto"
+
+	"github.com/pkg/errors"
+	"github.com/sbinet-alt63/strew/dkim"
+)
+
+// DKIM describes how outgoing mail is signed for a domain.
+// It is configured with [dkim.<domain>] sections.
+type DKIM struct {
+	Selector string   `ini:"selector"`
+	Key      string   `ini:"key"`
+	Headers  []string `ini:"headers,omitempty"`
+}
+
+// newSigners creates the DKIM signers of the server (under the "" key) and of
+// each list (under the list ID).
+//
+// Settings of a list take precedence over the settings of the [dkim.<domain>]
+// section of its signing domain, which take precedence over the global
+// settings.
+func newSigners(cfg Config) (map[string]*dkim.Signer, error) {
+	var (
+		signers = make(map[string]*dkim.Signer)
+		keys    = make(map[string]crypto.Signer)
+	)
+
+	global := DKIM{
+		Selector: cfg.DKIMSelector,
+		Key:      cfg.DKIMKey,
+		Headers:  cfg.DKIMHeaders,
+	}
+
+	newSigner := func(domain string, local DKIM) (*dkim.Signer, error) {
+		set := global
+		if v, ok := cfg.DKIM[domain]; ok {
+			set = merge(set, *v)
+		}
+		set = merge(set, local)
+		if domain == "" || set.Selector == "" || set.Key == "" {
+			return nil, nil
+		}
+
+		key, ok := keys[set.Key]
+		if !ok {
+			var err error
+			key, err = dkim.LoadKey(set.Key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "strew: could not load DKIM key for %q", domain)
+			}
+			keys[set.Key] = key
+		}
+
+		return &dkim.Signer{
+			Domain:   domain,
+			Selector: set.Selector,
+			Key:      key,
+			Headers:  set.Headers,
+		}, nil
+	}
+
+	domain := cfg.DKIMDomain
+	if domain == "" {
+		domain = domainOf(cfg.CommandAddress)
+	}
+	s, err := newSigner(domain, DKIM{})
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		signers[""] = s
+	}
+
+	for _, list := range cfg.Lists {
+		domain := list.DKIMDomain
+		if domain == "" {
+			domain = domainOf(list.Address)
+		}
+		s, err := newSigner(domain, DKIM{
+			Selector: list.DKIMSelector,
+			Key:      list.DKIMKey,
+			Headers:  list.DKIMHeaders,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			signers[list.ID] = s
+		}
+	}
+
+	return signers, nil
+}
+
+// merge returns base overridden with the non-empty settings of v.
+func merge(base, v DKIM) DKIM {
+	if v.Selector != "" {
+		base.Selector = v.Selector
+	}
+	if v.Key != "" {
+		base.Key = v.Key
+	}
+	if len(v.Headers) > 0 {
+		base.Headers = v.Headers
+	}
+	return base
+}
@@ -0,0 +1,327 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+	"golang.org/x/crypto/openpgp"
+)
+
+var (
+	errNotSigned      = errors.New("strew: message is not signed")
+	errUnknownKey     = errors.New("strew: message is not signed by a registered key")
+	errSignerMismatch = errors.New("strew: signing key is not registered to the sender")
+	errUnsignedCmd    = errors.New("strew: command is not part of the signed content")
+)
+
+// keyring holds the OpenPGP keys and S/MIME certificates of the senders
+// allowed to sign messages.
+type keyring struct {
+	pgp   openpgp.EntityList
+	smime *x509.CertPool
+}
+
+// newKeyrings loads the global keyring of the server (under the "" key) and
+// the keyrings of each list (under the list ID).
+func newKeyrings(cfg Config) (map[string]*keyring, error) {
+	keyrings := make(map[string]*keyring)
+
+	kr, err := loadKeyring(cfg.Keyring, cfg.SMIMECerts)
+	if err != nil {
+		return nil, err
+	}
+	keyrings[""] = kr
+
+	for _, list := range cfg.Lists {
+		if list.Keyring == "" && list.SMIMECerts == "" {
+			keyrings[list.ID] = kr
+			continue
+		}
+		lkr, err := loadKeyring(list.Keyring, list.SMIMECerts)
+		if err != nil {
+			return nil, errors.WithMessage(err, "list "+list.ID)
+		}
+		keyrings[list.ID] = lkr
+	}
+	return keyrings, nil
+}
+
+// loadKeyring loads an OpenPGP public keyring (armored or binary) and a set
+// of PEM encoded S/MIME certificates.
+func loadKeyring(pgp, smime string) (*keyring, error) {
+	kr := &keyring{smime: x509.NewCertPool()}
+
+	if pgp != "" {
+		raw, err := ioutil.ReadFile(pgp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		kr.pgp, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(raw))
+		if err != nil {
+			kr.pgp, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "strew: could not read OpenPGP keyring %q", pgp)
+		}
+	}
+
+	if smime != "" {
+		raw, err := ioutil.ReadFile(smime)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !kr.smime.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("strew: no certificate found in %q", smime)
+		}
+	}
+
+	return kr, nil
+}
+
+// signedPart is the content and detached signature of a multipart/signed
+// message. (RFC 1847)
+type signedPart struct {
+	protocol string // protocol of the signature.
+	content  []byte // signed MIME entity, with CRLF line endings.
+	sig      []byte // signature, with its transfer encoding removed.
+}
+
+// signedPart extracts the signed content and the signature of msg.
+func (msg *Message) signedPart() (*signedPart, error) {
+	media, params, err := mime.ParseMediaType(msg.ContentType)
+	if err != nil || media != "multipart/signed" || params["boundary"] == "" {
+		return nil, errNotSigned
+	}
+
+	body, err := ioutil.ReadAll(msg.BodyReader())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	body = []byte(crlf(string(body)))
+
+	parts := splitMultipart(body, params["boundary"])
+	if len(parts) != 2 {
+		return nil, errors.New("strew: invalid multipart/signed message")
+	}
+
+	hdr, sig, err := readPart(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "strew: invalid signature part")
+	}
+	if strings.EqualFold(hdr.Get("Content-Transfer-Encoding"), "base64") {
+		sig, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(sig)), ""))
+		if err != nil {
+			return nil, errors.Wrap(err, "strew: invalid signature encoding")
+		}
+	}
+
+	return &signedPart{
+		protocol: strings.ToLower(params["protocol"]),
+		content:  parts[0],
+		sig:      sig,
+	}, nil
+}
+
+// splitMultipart returns the raw parts of a multipart body with CRLF line
+// endings, without their delimiters.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	var (
+		delim = []byte("--" + boundary)
+		parts [][]byte
+	)
+	beg := indexLine(body, delim)
+	for beg >= 0 {
+		// skip the delimiter line.
+		eol := bytes.Index(body[beg:], []byte("\r\n"))
+		if eol < 0 {
+			break
+		}
+		start := beg + eol + 2
+		next := indexLine(body[start:], delim)
+		if next < 0 {
+			break
+		}
+		end := start + next - 2 // the CRLF preceding a delimiter is part of it.
+		if end < start {
+			end = start
+		}
+		parts = append(parts, body[start:end])
+		beg = start + next
+	}
+	return parts
+}
+
+// readPart returns the header and the body of a MIME part.
+func readPart(part []byte) (textproto.MIMEHeader, []byte, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(part)))
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	body, err := ioutil.ReadAll(tp.R)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return hdr, body, nil
+}
+
+// verifySignature checks msg carries a valid OpenPGP or S/MIME signature,
+// made with a key of the keyring of list (or the global keyring if list is
+// nil) registered to the sender of msg.
+func (srv *Server) verifySignature(msg *Message, list *List) error {
+	kr := srv.keyrings[""]
+	if list != nil {
+		kr = srv.keyrings[list.ID]
+	}
+	if kr == nil {
+		return errUnknownKey
+	}
+
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	part, err := msg.signedPart()
+	if err != nil {
+		return err
+	}
+
+	switch part.protocol {
+	case "application/pgp-signature":
+		signer, err := openpgp.CheckArmoredDetachedSignature(kr.pgp, bytes.NewReader(part.content), bytes.NewReader(part.sig))
+		if err != nil {
+			signer, err = openpgp.CheckDetachedSignature(kr.pgp, bytes.NewReader(part.content), bytes.NewReader(part.sig))
+		}
+		if err != nil {
+			return errors.Wrap(errUnknownKey, err.Error())
+		}
+		for _, id := range signer.Identities {
+			if strings.EqualFold(id.UserId.Email, from.Address) {
+				return nil
+			}
+		}
+		return errSignerMismatch
+
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		p7, err := pkcs7.Parse(part.sig)
+		if err != nil {
+			return errors.Wrap(err, "strew: invalid S/MIME signature")
+		}
+		p7.Content = part.content
+		err = p7.VerifyWithChain(kr.smime)
+		if err != nil {
+			return errors.Wrap(errUnknownKey, err.Error())
+		}
+		signer := p7.GetOnlySigner()
+		if signer == nil {
+			return errUnknownKey
+		}
+		for _, addr := range signer.EmailAddresses {
+			if strings.EqualFold(addr, from.Address) {
+				return nil
+			}
+		}
+		return errSignerMismatch
+	}
+
+	return fmt.Errorf("strew: unsupported signature protocol %q", part.protocol)
+}
+
+// signedCommands are the prefixes of the commands changing the state of the
+// server, which must be signed when require_signature is set.
+var signedCommands = []string{"subscribe", "unsubscribe", "setkey"}
+
+// isSignedCommand reports whether cmd must be signed.
+func isSignedCommand(cmd string) bool {
+	for _, prefix := range signedCommands {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignedCommand checks the command in the Subject of msg, which is not
+// covered by its signature, is also found in its signed part.
+func (msg *Message) checkSignedCommand() error {
+	cmd, err := msg.signedCommand()
+	if err != nil {
+		return err
+	}
+	if cmd != msg.Subject {
+		return errUnsignedCmd
+	}
+	return nil
+}
+
+// signedCommand returns the command carried by the signed part of msg: the
+// Subject header field of the signed entity (a protected header) if any, or
+// the first non-empty line of its first text part.
+func (msg *Message) signedCommand() (string, error) {
+	part, err := msg.signedPart()
+	if err != nil {
+		return "", err
+	}
+	hdr, body, err := readPart(part.content)
+	if err != nil {
+		return "", errors.Wrap(err, "strew: invalid signed part")
+	}
+	if v := hdr.Get("Subject"); v != "" {
+		v, err = new(mime.WordDecoder).DecodeHeader(v)
+		if err != nil {
+			return "", errors.Wrap(err, "strew: invalid signed Subject")
+		}
+		return strings.TrimSpace(v), nil
+	}
+
+	media, params, _ := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if strings.HasPrefix(media, "multipart/") {
+		parts := splitMultipart(body, params["boundary"])
+		if len(parts) == 0 {
+			return "", errUnsignedCmd
+		}
+		hdr, body, err = readPart(parts[0])
+		if err != nil {
+			return "", errors.Wrap(err, "strew: invalid signed part")
+		}
+		media, _, _ = mime.ParseMediaType(hdr.Get("Content-Type"))
+	}
+	if media != "" && media != "text/plain" {
+		return "", errUnsignedCmd
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	switch strings.ToLower(hdr.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errors.Wrap(err, "strew: invalid signed text")
+	}
+	for _, line := range strings.Split(string(text), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+	}
+	return "", errUnsignedCmd
+}
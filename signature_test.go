@@ -0,0 +1,244 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+	"golang.org/x/crypto/openpgp"
+)
+
+// signedMessage returns a multipart/signed message from sender with the
+// provided content and signature parts.
+func signedMessage(t *testing.T, from, protocol, content, sig string) *Message {
+	t.Helper()
+	raw := "From: " + from + "\r\n" +
+		"To: announce@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; boundary=\"sig\"; protocol=\"" + protocol + "\"\r\n" +
+		"\r\n" +
+		"--sig\r\n" + content + "\r\n" +
+		"--sig\r\n" + sig + "\r\n" +
+		"--sig--\r\n"
+	var msg Message
+	_, err := msg.ReadFrom(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("could not read message: %+v", err)
+	}
+	return &msg
+}
+
+func TestVerifyPGPSignature(t *testing.T) {
+	alice, err := openpgp.NewEntity("Alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := openpgp.NewEntity("Mallory", "", "mallory@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{keyrings: map[string]*keyring{
+		"": {pgp: openpgp.EntityList{alice}, smime: x509.NewCertPool()},
+	}}
+
+	const content = "Content-Type: text/plain\r\n\r\nsubscribe golang"
+	sign := func(e *openpgp.Entity, content string) string {
+		buf := new(bytes.Buffer)
+		err := openpgp.ArmoredDetachSign(buf, e, strings.NewReader(content), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Content-Type: application/pgp-signature\r\n\r\n" + crlf(buf.String())
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  *Message
+		ok   bool
+	}{
+		{
+			name: "valid",
+			msg:  signedMessage(t, "Alice <alice@example.com>", "application/pgp-signature", content, sign(alice, content)),
+			ok:   true,
+		},
+		{
+			name: "other-sender",
+			msg:  signedMessage(t, "bob@example.com", "application/pgp-signature", content, sign(alice, content)),
+		},
+		{
+			name: "unknown-key",
+			msg:  signedMessage(t, "mallory@example.com", "application/pgp-signature", content, sign(mallory, content)),
+		},
+		{
+			name: "tampered",
+			msg:  signedMessage(t, "alice@example.com", "application/pgp-signature", content+"!", sign(alice, content)),
+		},
+		{
+			name: "unsigned",
+			msg: func() *Message {
+				var msg Message
+				msg.ReadFrom(strings.NewReader("From: alice@example.com\r\nSubject: hello\r\n\r\nhello\r\n"))
+				return &msg
+			}(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := srv.verifySignature(tc.msg, nil)
+			if got, want := err == nil, tc.ok; got != want {
+				t.Fatalf("invalid verification: got=%v, want=%v (err=%v)", got, want, err)
+			}
+		})
+	}
+}
+
+func TestVerifySMIMESignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Alice"},
+		EmailAddresses:        []string{"alice@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const content = "Content-Type: text/plain\r\n\r\nsubscribe golang"
+	sd, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	p7, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := "Content-Type: application/pkcs7-signature\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(p7)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv := &Server{keyrings: map[string]*keyring{
+		"announce": {smime: pool},
+	}}
+	list := &List{ID: "announce"}
+
+	msg := signedMessage(t, "alice@example.com", "application/pkcs7-signature", content, sig)
+	err = srv.verifySignature(msg, list)
+	if err != nil {
+		t.Fatalf("could not verify signature: %+v", err)
+	}
+
+	msg = signedMessage(t, "bob@example.com", "application/pkcs7-signature", content, sig)
+	err = srv.verifySignature(msg, list)
+	if err == nil {
+		t.Fatalf("expected an error for a signature from another sender")
+	}
+
+	err = srv.verifySignature(msg, nil)
+	if err == nil {
+		t.Fatalf("expected an error without a trust store")
+	}
+}
+
+func TestSignedCommand(t *testing.T) {
+	const sig = "Content-Type: application/pgp-signature\r\n\r\nsignature"
+	for _, tc := range []struct {
+		name    string
+		content string
+		subject string
+		ok      bool
+	}{
+		{
+			name:    "text",
+			content: "Content-Type: text/plain\r\n\r\n\r\nsubscribe golang\r\nthanks",
+			subject: "subscribe golang",
+			ok:      true,
+		},
+		{
+			name:    "resent",
+			content: "Content-Type: text/plain\r\n\r\nsubscribe golang",
+			subject: "unsubscribe golang",
+		},
+		{
+			name:    "protected-subject",
+			content: "Subject: unsubscribe golang\r\nContent-Type: text/plain\r\n\r\nbye",
+			subject: "unsubscribe golang",
+			ok:      true,
+		},
+		{
+			name:    "quoted-printable",
+			content: "Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nsetkey=20golang",
+			subject: "setkey golang",
+			ok:      true,
+		},
+		{
+			name: "attachment",
+			content: "Content-Type: multipart/mixed; boundary=\"mixed\"\r\n\r\n" +
+				"--mixed\r\nContent-Type: text/plain\r\n\r\nsetkey golang\r\n" +
+				"--mixed\r\nContent-Type: application/pgp-keys\r\n\r\nkey\r\n" +
+				"--mixed--",
+			subject: "setkey golang",
+			ok:      true,
+		},
+		{
+			name:    "html",
+			content: "Content-Type: text/html\r\n\r\nsubscribe golang",
+			subject: "subscribe golang",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := signedMessage(t, "alice@example.com", "application/pgp-signature", tc.content, sig)
+			msg.Subject = tc.subject
+			err := msg.checkSignedCommand()
+			if got, want := err == nil, tc.ok; got != want {
+				t.Fatalf("invalid check: got=%v, want=%v (err=%v)", got, want, err)
+			}
+		})
+	}
+
+	for cmd, want := range map[string]bool{
+		"help":               false,
+		"lists":              false,
+		"subscriptions":      false,
+		"subscribe golang":   true,
+		"unsubscribe golang": true,
+		"setkey golang":      true,
+	} {
+		if got := isSignedCommand(cmd); got != want {
+			t.Fatalf("invalid signature requirement for %q: got=%v, want=%v", cmd, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package spamd implements a client for the SpamAssassin spamd protocol,
+// also served by rspamd.
+package spamd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrProtocol = errors.New("strew/spamd: invalid response")
+)
+
+// Client checks messages against a spamd server.
+type Client struct {
+	Network string // network of the server, "tcp" or "unix".
+	Addr    string // address of the server.
+	User    string // user whose preferences are used, if not empty.
+}
+
+// Result is the verdict of a spamd server.
+type Result struct {
+	Spam      bool
+	Score     float64
+	Threshold float64
+}
+
+// Check sends the size bytes of the message read from msg to the server,
+// and returns its verdict.
+func (c *Client) Check(ctx context.Context, msg io.Reader, size int64) (Result, error) {
+	var (
+		res Result
+		d   net.Dialer
+	)
+	conn, err := d.DialContext(ctx, c.Network, c.Addr)
+	if err != nil {
+		return res, errors.WithStack(err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CHECK SPAMC/1.5\r\nContent-length: %d\r\n", size)
+	if c.User != "" {
+		fmt.Fprintf(w, "User: %s\r\n", c.User)
+	}
+	w.WriteString("\r\n")
+	_, err = io.CopyN(w, msg, size)
+	if err != nil {
+		return res, errors.WithStack(err)
+	}
+	err = w.Flush()
+	if err != nil {
+		return res, errors.WithStack(err)
+	}
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	line, err := r.ReadLine()
+	if err != nil {
+		return res, errors.WithStack(err)
+	}
+	toks := strings.Fields(line)
+	if len(toks) < 2 || !strings.HasPrefix(toks[0], "SPAMD/") {
+		return res, errors.Wrapf(ErrProtocol, "status line %q", line)
+	}
+	if toks[1] != "0" {
+		return res, fmt.Errorf("strew/spamd: check failed: %s", strings.Join(toks[1:], " "))
+	}
+
+	hdr, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return res, errors.WithStack(err)
+	}
+	spam := hdr.Get("Spam")
+	if spam == "" {
+		return res, errors.Wrap(ErrProtocol, "missing Spam header")
+	}
+	return parseSpam(spam)
+}
+
+// parseSpam parses the value of a Spam header, such as "True ; 15.0 / 5.0".
+func parseSpam(v string) (Result, error) {
+	var res Result
+	i := strings.Index(v, ";")
+	j := strings.Index(v, "/")
+	if i < 0 || j < i {
+		return res, errors.Wrapf(ErrProtocol, "Spam header %q", v)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(v[:i])) {
+	case "true", "yes":
+		res.Spam = true
+	case "false", "no":
+		res.Spam = false
+	default:
+		return res, errors.Wrapf(ErrProtocol, "Spam header %q", v)
+	}
+
+	var err error
+	res.Score, err = strconv.ParseFloat(strings.TrimSpace(v[i+1:j]), 64)
+	if err != nil {
+		return res, errors.Wrapf(ErrProtocol, "Spam header %q", v)
+	}
+	res.Threshold, err = strconv.ParseFloat(strings.TrimSpace(v[j+1:]), 64)
+	if err != nil {
+		return res, errors.Wrapf(ErrProtocol, "Spam header %q", v)
+	}
+	return res, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spamd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve runs a stand-in spamd server, flagging messages containing "viagra".
+func serve(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := textproto.NewReader(bufio.NewReader(conn))
+			line, err := r.ReadLine()
+			if err != nil || line != "CHECK SPAMC/1.5" {
+				io.WriteString(conn, "SPAMD/1.1 76 Bad header line\r\n")
+				return
+			}
+			hdr, err := r.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			n, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64)
+			if err != nil {
+				return
+			}
+			body, err := ioutil.ReadAll(io.LimitReader(r.R, n))
+			if err != nil {
+				return
+			}
+			verdict := "False ; 1.2 / 5.0"
+			if strings.Contains(string(body), "viagra") {
+				verdict = "True ; 15.0 / 5.0"
+			}
+			io.WriteString(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: "+verdict+"\r\n\r\n")
+		}(conn)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(t, l)
+
+	c := &Client{Network: "tcp", Addr: l.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		msg  string
+		want Result
+	}{
+		{
+			msg:  "Subject: hello\r\n\r\nhello\r\n",
+			want: Result{Spam: false, Score: 1.2, Threshold: 5},
+		},
+		{
+			msg:  "Subject: cheap\r\n\r\ncheap viagra\r\n",
+			want: Result{Spam: true, Score: 15, Threshold: 5},
+		},
+	} {
+		got, err := c.Check(ctx, strings.NewReader(tc.msg), int64(len(tc.msg)))
+		if err != nil {
+			t.Fatalf("could not check message: %+v", err)
+		}
+		if got != tc.want {
+			t.Fatalf("invalid result: got=%+v, want=%+v", got, tc.want)
+		}
+	}
+}
+
+func TestParseSpam(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want Result
+		err  bool
+	}{
+		{v: "True ; 15.0 / 5.0", want: Result{true, 15, 5}},
+		{v: "False ; -0.5 / 5.0", want: Result{false, -0.5, 5}},
+		{v: "Yes ; 6 / 5", want: Result{true, 6, 5}},
+		{v: "Maybe ; 6 / 5", err: true},
+		{v: "True", err: true},
+	} {
+		got, err := parseSpam(tc.v)
+		if (err != nil) != tc.err {
+			t.Fatalf("%q: invalid error: %v", tc.v, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%q: got=%+v, want=%+v", tc.v, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package spf implements the evaluation of SPF (RFC 7208) policies.
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Result is the outcome of an SPF evaluation.
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// maxLookups is the maximum number of DNS querying mechanisms and modifiers
+// evaluated for a single check. (RFC 7208, 4.6.4)
+const maxLookups = 10
+
+// Resolver performs the DNS lookups needed by SPF evaluations.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Check evaluates whether ip is authorized to send mail for domain, on behalf
+// of sender (the MAIL FROM address, or postmaster@helo-domain).
+func Check(ctx context.Context, r Resolver, ip net.IP, domain, sender string) (Result, error) {
+	if i := strings.LastIndex(sender, "@"); i < 0 {
+		sender = "postmaster@" + sender
+	}
+	c := &checker{r: r, ip: ip, sender: sender}
+	return c.check(ctx, strings.TrimSuffix(domain, "."))
+}
+
+type checker struct {
+	r       Resolver
+	ip      net.IP
+	sender  string
+	lookups int
+}
+
+func (c *checker) check(ctx context.Context, domain string) (Result, error) {
+	rec, res, err := c.record(ctx, domain)
+	if err != nil || rec == "" {
+		return res, err
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(rec)[1:] {
+		if i := strings.Index(term, "="); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			// modifier.
+			switch strings.ToLower(term[:i]) {
+			case "redirect":
+				if redirect != "" {
+					return PermError, errors.New("strew/spf: duplicate redirect modifier")
+				}
+				redirect = term[i+1:]
+			}
+			continue
+		}
+
+		qual := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qual, term = Fail, term[1:]
+		case '~':
+			qual, term = SoftFail, term[1:]
+		case '?':
+			qual, term = Neutral, term[1:]
+		}
+
+		ok, res, err := c.match(ctx, domain, term)
+		if err != nil {
+			return res, err
+		}
+		if ok {
+			return qual, nil
+		}
+	}
+
+	if redirect != "" {
+		err := c.count()
+		if err != nil {
+			return PermError, err
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return PermError, err
+		}
+		res, err := c.check(ctx, target)
+		if res == None {
+			return PermError, errors.Errorf("strew/spf: no SPF record for redirect domain %q", target)
+		}
+		return res, err
+	}
+	return Neutral, nil
+}
+
+// record retrieves the SPF record of domain.
+func (c *checker) record(ctx context.Context, domain string) (string, Result, error) {
+	txts, err := c.r.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", None, nil
+		}
+		return "", TempError, errors.WithStack(err)
+	}
+
+	var recs []string
+	for _, txt := range txts {
+		low := strings.ToLower(txt)
+		if low == "v=spf1" || strings.HasPrefix(low, "v=spf1 ") {
+			recs = append(recs, txt)
+		}
+	}
+	switch len(recs) {
+	case 0:
+		return "", None, nil
+	case 1:
+		return recs[0], None, nil
+	default:
+		return "", PermError, errors.Errorf("strew/spf: multiple SPF records for %q", domain)
+	}
+}
+
+// match evaluates a mechanism.
+func (c *checker) match(ctx context.Context, domain, term string) (bool, Result, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, None, nil
+
+	case "include":
+		err := c.count()
+		if err != nil {
+			return false, PermError, err
+		}
+		target, err := c.expand(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil {
+			return false, PermError, err
+		}
+		res, err := c.check(ctx, target)
+		switch res {
+		case Pass:
+			return true, None, nil
+		case Fail, SoftFail, Neutral:
+			return false, None, nil
+		case None:
+			return false, PermError, errors.Errorf("strew/spf: no SPF record for included domain %q", target)
+		default:
+			return false, res, err
+		}
+
+	case "a", "mx":
+		err := c.count()
+		if err != nil {
+			return false, PermError, err
+		}
+		target, cidr4, cidr6, err := c.domainSpec(arg, domain)
+		if err != nil {
+			return false, PermError, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := c.r.LookupMX(ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, TempError, errors.WithStack(err)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+			if len(hosts) > maxLookups {
+				return false, PermError, errors.New("strew/spf: too many MX records")
+			}
+		}
+		for _, host := range hosts {
+			ips, err := c.r.LookupIPAddr(ctx, host)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return false, TempError, errors.WithStack(err)
+			}
+			for _, ip := range ips {
+				if c.inNet(ip.IP, cidr4, cidr6) {
+					return true, None, nil
+				}
+			}
+		}
+		return false, None, nil
+
+	case "ip4", "ip6":
+		ipnet := strings.TrimPrefix(arg, ":")
+		if !strings.Contains(ipnet, "/") {
+			if name == "ip4" {
+				ipnet += "/32"
+			} else {
+				ipnet += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(ipnet)
+		if err != nil {
+			return false, PermError, errors.Errorf("strew/spf: invalid %s mechanism %q", name, term)
+		}
+		return n.Contains(c.ip), None, nil
+
+	case "exists":
+		err := c.count()
+		if err != nil {
+			return false, PermError, err
+		}
+		target, err := c.expand(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil {
+			return false, PermError, err
+		}
+		ips, err := c.r.LookupIPAddr(ctx, target)
+		if err != nil {
+			if isNotFound(err) {
+				return false, None, nil
+			}
+			return false, TempError, errors.WithStack(err)
+		}
+		for _, ip := range ips {
+			if ip.IP.To4() != nil {
+				return true, None, nil
+			}
+		}
+		return false, None, nil
+
+	case "ptr":
+		// the ptr mechanism is deprecated (RFC 7208, 5.5) and never matches.
+		err := c.count()
+		if err != nil {
+			return false, PermError, err
+		}
+		return false, None, nil
+	}
+
+	return false, PermError, errors.Errorf("strew/spf: unknown mechanism %q", term)
+}
+
+// domainSpec parses the [:domain][/cidr4][//cidr6] argument of the a and mx
+// mechanisms.
+func (c *checker) domainSpec(arg, domain string) (string, int, int, error) {
+	var (
+		cidr4 = 32
+		cidr6 = 128
+		err   error
+	)
+	if i := strings.Index(arg, "//"); i >= 0 {
+		cidr6, err = strconv.Atoi(arg[i+2:])
+		if err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, errors.Errorf("strew/spf: invalid ip6 prefix length %q", arg)
+		}
+		arg = arg[:i]
+	}
+	if i := strings.Index(arg, "/"); i >= 0 {
+		cidr4, err = strconv.Atoi(arg[i+1:])
+		if err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, errors.Errorf("strew/spf: invalid ip4 prefix length %q", arg)
+		}
+		arg = arg[:i]
+	}
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		target, err = c.expand(arg[1:], domain)
+		if err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return target, cidr4, cidr6, nil
+}
+
+func (c *checker) inNet(ip net.IP, cidr4, cidr6 int) bool {
+	var mask net.IPMask
+	switch {
+	case ip.To4() != nil && c.ip.To4() != nil:
+		ip, mask = ip.To4(), net.CIDRMask(cidr4, 32)
+	case ip.To4() == nil && c.ip.To4() == nil:
+		mask = net.CIDRMask(cidr6, 128)
+	default:
+		return false
+	}
+	n := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return n.Contains(c.ip)
+}
+
+func (c *checker) count() error {
+	c.lookups++
+	if c.lookups > maxLookups {
+		return errors.New("strew/spf: too many DNS lookups")
+	}
+	return nil
+}
+
+// expand expands the macros of a domain-spec. (RFC 7208, 7)
+func (c *checker) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	var (
+		out   strings.Builder
+		local = c.sender[:strings.LastIndex(c.sender, "@")]
+		sdom  = c.sender[strings.LastIndex(c.sender, "@")+1:]
+	)
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errors.Errorf("strew/spf: invalid macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errors.Errorf("strew/spf: invalid macro in %q", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errors.Errorf("strew/spf: invalid macro in %q", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var v string
+		switch macro[0] | 0x20 {
+		case 's':
+			v = c.sender
+		case 'l':
+			v = local
+		case 'o':
+			v = sdom
+		case 'd':
+			v = domain
+		case 'i':
+			v = c.ip.String()
+			if ip4 := c.ip.To4(); ip4 == nil {
+				var parts []string
+				for _, b := range c.ip.To16() {
+					parts = append(parts, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+				}
+				v = strings.Join(parts, ".")
+			}
+		case 'v':
+			v = "in-addr"
+			if c.ip.To4() == nil {
+				v = "ip6"
+			}
+		case 'h':
+			v = sdom
+		default:
+			return "", errors.Errorf("strew/spf: unsupported macro %q", macro)
+		}
+		v, err := transform(v, macro[1:])
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(v)
+	}
+	return out.String(), nil
+}
+
+// transform applies the transformers and delimiters of a macro to v.
+func transform(v, tr string) (string, error) {
+	var (
+		digits  = 0
+		reverse = false
+		delims  = "."
+	)
+	i := 0
+	for i < len(tr) && tr[i] >= '0' && tr[i] <= '9' {
+		i++
+	}
+	if i > 0 {
+		digits, _ = strconv.Atoi(tr[:i])
+		if digits == 0 {
+			return "", errors.Errorf("strew/spf: invalid macro transformer %q", tr)
+		}
+	}
+	if i < len(tr) && (tr[i]|0x20) == 'r' {
+		reverse = true
+		i++
+	}
+	if i < len(tr) {
+		delims = tr[i:]
+		for _, c := range delims {
+			if !strings.ContainsRune(".-+,/_=", c) {
+				return "", errors.Errorf("strew/spf: invalid macro delimiter %q", tr)
+			}
+		}
+	}
+	if digits == 0 && !reverse && delims == "." {
+		return v, nil
+	}
+
+	parts := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && !e.Temporary()
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type fakeDNS struct {
+	txt map[string][]string
+	ips map[string][]string
+	mxs map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (dns fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, ok := dns.txt[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return v, nil
+}
+
+func (dns fakeDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	v, ok := dns.ips[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	var ips []net.IPAddr
+	for _, ip := range v {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return ips, nil
+}
+
+func (dns fakeDNS) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, ok := dns.mxs[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	var mxs []*net.MX
+	for _, host := range v {
+		mxs = append(mxs, &net.MX{Host: host, Pref: 10})
+	}
+	return mxs, nil
+}
+
+func TestCheck(t *testing.T) {
+	dns := fakeDNS{
+		txt: map[string][]string{
+			"example.com":      {"v=spf1 ip4:192.0.2.0/24 mx include:_spf.example.net -all"},
+			"_spf.example.net": {"v=spf1 a:relay.example.net ip6:2001:db8::/32 ~all"},
+			"redirect.com":     {"v=spf1 redirect=example.com"},
+			"macro.com":        {"v=spf1 exists:%{i}._ip.%{d} -all"},
+			"multi.com":        {"v=spf1 -all", "v=spf1 +all"},
+			"loop.com":         {"v=spf1 include:loop.com -all"},
+			"neutral.com":      {"v=spf1 ?all"},
+			"other.com":        {"some unrelated record"},
+			"bad.com":          {"v=spf1 foo:bar -all"},
+			"include-none.com": {"v=spf1 include:nowhere.com -all"},
+			"cidr.com":         {"v=spf1 a/24 -all"},
+		},
+		ips: map[string][]string{
+			"mx.example.com":             {"198.51.100.1"},
+			"relay.example.net":          {"203.0.113.5"},
+			"198.51.100.7._ip.macro.com": {"127.0.0.2"},
+			"cidr.com":                   {"203.0.113.1"},
+		},
+		mxs: map[string][]string{
+			"example.com": {"mx.example.com"},
+		},
+	}
+
+	for _, tc := range []struct {
+		ip     string
+		domain string
+		want   Result
+	}{
+		{"192.0.2.10", "example.com", Pass},
+		{"198.51.100.1", "example.com", Pass},
+		{"203.0.113.5", "example.com", Pass},
+		{"2001:db8::1", "example.com", Pass},
+		{"203.0.113.6", "example.com", Fail},
+		{"192.0.2.10", "redirect.com", Pass},
+		{"203.0.113.6", "redirect.com", Fail},
+		{"198.51.100.7", "macro.com", Pass},
+		{"198.51.100.8", "macro.com", Fail},
+		{"192.0.2.10", "multi.com", PermError},
+		{"192.0.2.10", "loop.com", PermError},
+		{"192.0.2.10", "neutral.com", Neutral},
+		{"192.0.2.10", "other.com", None},
+		{"192.0.2.10", "nowhere.com", None},
+		{"192.0.2.10", "bad.com", PermError},
+		{"192.0.2.10", "include-none.com", PermError},
+		{"203.0.113.200", "cidr.com", Pass},
+		{"203.0.114.1", "cidr.com", Fail},
+	} {
+		got, _ := Check(context.Background(), dns, net.ParseIP(tc.ip), tc.domain, "alice@"+tc.domain)
+		if got != tc.want {
+			t.Errorf("check(%s, %s): got=%q, want=%q", tc.ip, tc.domain, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The strew Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strew
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// spoolThreshold is the size above which message bodies are spooled to disk.
+const spoolThreshold = 1 << 20
+
+// spool holds a message body in memory, spilling it to a temporary file
+// once it grows past spoolThreshold.
+type spool struct {
+	buf bytes.Buffer
+	f   *os.File
+	n   int64
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.f == nil && int64(sp.buf.Len()+len(p)) > spoolThreshold {
+		f, err := ioutil.TempFile("", "strew-spool-")
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		_, err = f.Write(sp.buf.Bytes())
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, errors.WithStack(err)
+		}
+		sp.f = f
+		sp.buf = bytes.Buffer{}
+	}
+
+	var (
+		n   int
+		err error
+	)
+	switch sp.f {
+	case nil:
+		n, err = sp.buf.Write(p)
+	default:
+		n, err = sp.f.Write(p)
+	}
+	sp.n += int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes written to the spool.
+func (sp *spool) Len() int64 { return sp.n }
+
+// onDisk reports whether the content has been spilled to disk.
+func (sp *spool) onDisk() bool { return sp.f != nil }
+
+// String returns the in-memory content of the spool.
+func (sp *spool) String() string { return sp.buf.String() }
+
+// Reader returns a reader over the whole content of the spool.
+func (sp *spool) Reader() io.Reader {
+	return io.NewSectionReader(sp.ReaderAt(), 0, sp.n)
+}
+
+// ReaderAt returns a random access reader over the content of the spool.
+func (sp *spool) ReaderAt() io.ReaderAt {
+	if sp.f == nil {
+		return bytes.NewReader(sp.buf.Bytes())
+	}
+	return sp.f
+}
+
+// Close releases the resources held by the spool.
+func (sp *spool) Close() error {
+	if sp.f == nil {
+		return nil
+	}
+	f := sp.f
+	sp.f = nil
+	err := f.Close()
+	os.Remove(f.Name())
+	return err
+}